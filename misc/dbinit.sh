@@ -6,9 +6,17 @@ psql="psql -f - ${dbname}"
 
 $psql << EOF
 DROP TABLE IF EXISTS rra_assetgroup;
+DROP TABLE IF EXISTS indicatorsummary;
 DROP TABLE IF EXISTS indicator;
+DROP TABLE IF EXISTS asseteventsource;
+DROP TABLE IF EXISTS assetalias;
+DROP TABLE IF EXISTS assetlabel;
+DROP TABLE IF EXISTS assetipmap;
+DROP TABLE IF EXISTS assetdependency;
+DROP TABLE IF EXISTS servicedependency;
 DROP TABLE IF EXISTS asset;
 DROP TABLE IF EXISTS assetowners;
+DROP TABLE IF EXISTS ownercontact;
 DROP TABLE IF EXISTS risk;
 DROP TABLE IF EXISTS rra;
 DROP TABLE IF EXISTS assetgroup;
@@ -66,6 +74,16 @@ CREATE TABLE assetowners (
 	operator TEXT NOT NULL,
 	UNIQUE (team, operator)
 );
+CREATE TABLE ownercontact (
+	operator TEXT NOT NULL,
+	team TEXT NOT NULL,
+	email TEXT NOT NULL DEFAULT '',
+	chat TEXT NOT NULL DEFAULT '',
+	escalation TEXT NOT NULL DEFAULT '',
+	description TEXT NOT NULL DEFAULT '',
+	manual BOOLEAN NOT NULL DEFAULT FALSE,
+	UNIQUE (operator, team)
+);
 CREATE TABLE asset (
 	assetid SERIAL PRIMARY KEY,
 	assettype TEXT NOT NULL,
@@ -74,12 +92,66 @@ CREATE TABLE asset (
 	assetgroupid INTEGER REFERENCES assetgroup (assetgroupid),
 	ownerid INTEGER REFERENCES assetowners (ownerid),
 	triageoverride TEXT,
-	lastindicator TIMESTAMP WITH TIME ZONE NOT NULL,
+	firstindicator TIMESTAMP WITH TIME ZONE,
+	lastindicator TIMESTAMP WITH TIME ZONE,
+	manual BOOLEAN NOT NULL DEFAULT FALSE,
+	state TEXT NOT NULL DEFAULT 'active',
+	importoperator TEXT,
+	importteam TEXT,
+	importassetgroup TEXT,
+	address INET,
 	UNIQUE(assettype, name, zone)
 );
+CREATE INDEX ON asset USING gist (address inet_ops);
 CREATE INDEX ON asset (name);
+CREATE INDEX ON asset (assettype, split_part(name, '.', 1));
 CREATE INDEX ON asset (assettype);
 CREATE INDEX ON asset (assetgroupid);
+CREATE INDEX ON asset (lastindicator);
+CREATE TABLE assetalias (
+	aliasid SERIAL PRIMARY KEY,
+	assetid INTEGER REFERENCES asset (assetid),
+	assettype TEXT NOT NULL,
+	name TEXT NOT NULL,
+	zone TEXT NOT NULL,
+	UNIQUE(assettype, name, zone)
+);
+CREATE INDEX ON assetalias (assetid);
+CREATE INDEX ON assetalias (name);
+CREATE INDEX ON assetalias (assettype, split_part(name, '.', 1));
+CREATE TABLE assetlabel (
+	assetid INTEGER REFERENCES asset (assetid),
+	key TEXT NOT NULL,
+	value TEXT NOT NULL,
+	manual BOOLEAN NOT NULL DEFAULT FALSE,
+	UNIQUE(assetid, key)
+);
+CREATE INDEX ON assetlabel (key, value);
+CREATE TABLE assetipmap (
+	ipassetid INTEGER REFERENCES asset (assetid),
+	hostassetid INTEGER REFERENCES asset (assetid),
+	UNIQUE(ipassetid, hostassetid)
+);
+CREATE INDEX ON assetipmap (hostassetid);
+CREATE TABLE assetdependency (
+	assetid INTEGER REFERENCES asset (assetid) NOT NULL,
+	assetgroupid INTEGER REFERENCES assetgroup (assetgroupid) NOT NULL,
+	manual BOOLEAN NOT NULL DEFAULT FALSE,
+	UNIQUE(assetid, assetgroupid)
+);
+CREATE TABLE servicedependency (
+	service TEXT NOT NULL,
+	dependson TEXT NOT NULL,
+	manual BOOLEAN NOT NULL DEFAULT FALSE,
+	UNIQUE(service, dependson)
+);
+CREATE TABLE asseteventsource (
+	assetid INTEGER REFERENCES asset (assetid),
+	event_source TEXT NOT NULL,
+	firstindicator TIMESTAMP WITH TIME ZONE NOT NULL,
+	lastindicator TIMESTAMP WITH TIME ZONE NOT NULL,
+	UNIQUE (assetid, event_source)
+);
 CREATE TABLE indicator (
 	indicatorid SERIAL PRIMARY KEY,
 	timestamp TIMESTAMP WITH TIME ZONE NOT NULL,
@@ -87,11 +159,23 @@ CREATE TABLE indicator (
 	likelihood_indicator TEXT NOT NULL,
 	assetid INTEGER REFERENCES asset (assetid),
 	details JSONB NOT NULL,
-	UNIQUE (assetid, event_source, timestamp)
+	clientid UUID,
+	UNIQUE (assetid, event_source, timestamp),
+	UNIQUE (clientid)
 );
 CREATE INDEX ON indicator (timestamp);
 CREATE INDEX ON indicator (assetid);
 CREATE INDEX ON indicator USING gin (details);
+CREATE TABLE indicatorsummary (
+	assetid INTEGER REFERENCES asset (assetid),
+	event_source TEXT NOT NULL,
+	day DATE NOT NULL,
+	count INTEGER NOT NULL,
+	likelihood_indicator TEXT NOT NULL,
+	firstseen TIMESTAMP WITH TIME ZONE NOT NULL,
+	lastseen TIMESTAMP WITH TIME ZONE NOT NULL,
+	UNIQUE (assetid, event_source, day)
+);
 CREATE TABLE apikey (
 	keyid SERIAL PRIMARY KEY,
 	name TEXT NOT NULL,
@@ -100,6 +184,7 @@ CREATE TABLE apikey (
 	readowner BOOLEAN DEFAULT FALSE,
 	writeindicator BOOLEAN DEFAULT FALSE,
 	writerra BOOLEAN DEFAULT FALSE,
+	writeasset BOOLEAN DEFAULT FALSE,
 	UNIQUE(name),
 	UNIQUE(hash)
 );
@@ -0,0 +1,393 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor:
+// - Aaron Meihm ameihm@mozilla.com
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	slib "github.com/mozilla/service-map/servicelib"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// errAliasConflict is returned if an alias would conflict with an existing asset or alias
+var errAliasConflict = errors.New("alias conflicts with existing asset or alias")
+
+// assetIDFromAlias returns the ID of the asset that has an alias matching the type, name
+// and zone, or sql.ErrNoRows if no alias exists. Alias names are not case sensitive.
+func assetIDFromAlias(op opContext, atype, name, zone string) (aid int, err error) {
+	err = op.QueryRow(`SELECT assetid FROM assetalias
+		WHERE assettype = $1 AND name = $2 AND zone = $3`,
+		atype, strings.ToLower(name), zone).Scan(&aid)
+	return
+}
+
+// assetGetAliases returns the aliases for asset a
+func assetGetAliases(op opContext, a slib.Asset) (ret []slib.AssetAlias, err error) {
+	rows, err := op.Query(`SELECT aliasid, assetid, assettype, name, zone
+		FROM assetalias WHERE assetid = $1 ORDER BY aliasid`, a.ID)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		var nalias slib.AssetAlias
+		err = rows.Scan(&nalias.ID, &nalias.AssetID, &nalias.Type, &nalias.Name,
+			&nalias.Zone)
+		if err != nil {
+			rows.Close()
+			return
+		}
+		ret = append(ret, nalias)
+	}
+	err = rows.Err()
+	return
+}
+
+// aliasAdd adds alias a, returning errAliasConflict if an asset already exists with
+// the same identity as the alias, or the alias is already in use
+func aliasAdd(op opContext, a slib.AssetAlias) (id int, err error) {
+	a.Name = strings.ToLower(a.Name)
+	var n int
+	err = op.QueryRow(`SELECT COUNT(*) FROM asset WHERE assettype = $1 AND
+		lower(name) = $2 AND zone = $3 AND assetid != $4`,
+		a.Type, a.Name, a.Zone, a.AssetID).Scan(&n)
+	if err != nil {
+		return
+	}
+	if n != 0 {
+		return 0, errAliasConflict
+	}
+	err = op.QueryRow(`INSERT INTO assetalias (assetid, assettype, name, zone)
+		VALUES ($1, $2, $3, $4) RETURNING aliasid`,
+		a.AssetID, a.Type, a.Name, a.Zone).Scan(&id)
+	if e, ok := err.(*pq.Error); ok && e.Code == pqUniqueViolation {
+		err = errAliasConflict
+	}
+	return
+}
+
+// assetMerge merges the asset with ID src into the asset with ID dst. Indicators, event
+// source details, indicator summaries and aliases are moved to dst, the identity of src
+// is added as an alias of dst, and src is removed. Labels, ip mappings and dependencies on src
+// are copied to dst, unless dst already has a label with the same key.
+func assetMerge(op opContext, src, dst int) (err error) {
+	srcasset, err := getAssetBase(op, src)
+	if err != nil {
+		return
+	}
+	// Indicators from src that have the same event source and timestamp as an indicator
+	// already present for dst are duplicates and are discarded
+	_, err = op.Exec(`DELETE FROM indicator s USING indicator d
+		WHERE s.assetid = $1 AND d.assetid = $2 AND
+		s.event_source = d.event_source AND s.timestamp = d.timestamp`, src, dst)
+	if err != nil {
+		return
+	}
+	_, err = op.Exec(`UPDATE indicator SET assetid = $1 WHERE assetid = $2`, dst, src)
+	if err != nil {
+		return
+	}
+	_, err = op.Exec(`INSERT INTO asseteventsource
+		(assetid, event_source, firstindicator, lastindicator)
+		SELECT $1::integer, event_source, firstindicator, lastindicator
+		FROM asseteventsource WHERE assetid = $2
+		ON CONFLICT (assetid, event_source) DO UPDATE SET
+		firstindicator = LEAST(asseteventsource.firstindicator, EXCLUDED.firstindicator),
+		lastindicator = GREATEST(asseteventsource.lastindicator, EXCLUDED.lastindicator)`,
+		dst, src)
+	if err != nil {
+		return
+	}
+	_, err = op.Exec(`UPDATE asset SET
+		firstindicator = LEAST(asset.firstindicator, s.firstindicator),
+		lastindicator = GREATEST(asset.lastindicator, s.lastindicator)
+		FROM asset s WHERE asset.assetid = $1 AND s.assetid = $2`, dst, src)
+	if err != nil {
+		return
+	}
+	err = aliasMergeSummaries(op, src, dst)
+	if err != nil {
+		return
+	}
+	_, err = op.Exec(`UPDATE assetalias SET assetid = $1 WHERE assetid = $2`, dst, src)
+	if err != nil {
+		return
+	}
+	_, err = op.Exec(`INSERT INTO assetipmap (ipassetid, hostassetid)
+		SELECT CASE WHEN ipassetid = $2 THEN $1 ELSE ipassetid END,
+		CASE WHEN hostassetid = $2 THEN $1 ELSE hostassetid END
+		FROM assetipmap WHERE ipassetid = $2 OR hostassetid = $2
+		ON CONFLICT (ipassetid, hostassetid) DO NOTHING`, dst, src)
+	if err != nil {
+		return
+	}
+	_, err = op.Exec(`INSERT INTO assetdependency (assetid, assetgroupid, manual)
+		SELECT $1::integer, assetgroupid, manual FROM assetdependency WHERE assetid = $2
+		ON CONFLICT (assetid, assetgroupid) DO NOTHING`, dst, src)
+	if err != nil {
+		return
+	}
+	// Labels already present on dst take precedence over those on src
+	_, err = op.Exec(`INSERT INTO assetlabel (assetid, key, value, manual)
+		SELECT $1::integer, key, value, manual FROM assetlabel WHERE assetid = $2
+		ON CONFLICT (assetid, key) DO NOTHING`, dst, src)
+	if err != nil {
+		return
+	}
+	// With everything moved, src can be removed and its identity added as an alias
+	err = assetDelete(op, src)
+	if err != nil {
+		return
+	}
+	_, err = aliasAdd(op, slib.AssetAlias{
+		AssetID: dst,
+		Type:    srcasset.Type,
+		Name:    srcasset.Name,
+		Zone:    srcasset.Zone,
+	})
+	return
+}
+
+// aliasMergeSummaries moves the daily indicator summaries for asset src to asset dst,
+// combining summaries for days both assets have a summary for
+func aliasMergeSummaries(op opContext, src, dst int) error {
+	summaries := make(map[retentionSummaryKey]retentionSummary)
+	rows, err := op.Query(`SELECT event_source, to_char(day, 'YYYY-MM-DD'), count,
+		likelihood_indicator, firstseen, lastseen FROM indicatorsummary
+		WHERE assetid = $1`, src)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var (
+			k = retentionSummaryKey{assetid: dst}
+			s retentionSummary
+		)
+		err = rows.Scan(&k.eventSource, &k.day, &s.count, &s.likelihood,
+			&s.firstseen, &s.lastseen)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		summaries[k] = s
+	}
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+	_, err = op.Exec(`DELETE FROM indicatorsummary WHERE assetid = $1`, src)
+	if err != nil {
+		return err
+	}
+	for k, s := range summaries {
+		err = retentionStoreSummary(op, k, s)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getAssetDuplicates returns groups of assets that are likely to be duplicates of each
+// other; assets of the same type are suggested if their names differ only in case or zone,
+// or if a hostname without a domain matches the first label of another hostname
+func getAssetDuplicates(op opContext) (ret []slib.AssetDuplicate, err error) {
+	ret = make([]slib.AssetDuplicate, 0)
+	rows, err := op.Query(`SELECT a.assetid, b.assetid, 'name differs only in case or zone'
+		FROM asset a INNER JOIN asset b ON a.assettype = b.assettype AND
+		a.assetid < b.assetid AND lower(a.name) = lower(b.name)
+		UNION ALL
+		SELECT a.assetid, b.assetid, 'short name matches qualified name'
+		FROM asset a INNER JOIN asset b ON a.assettype = b.assettype AND
+		a.assettype = 'hostname' AND a.assetid != b.assetid AND
+		strpos(a.name, '.') = 0 AND strpos(b.name, '.') != 0 AND
+		lower(a.name) = lower(split_part(b.name, '.', 1))
+		ORDER BY 1, 2`)
+	if err != nil {
+		return
+	}
+	type pair struct {
+		a, b   int
+		reason string
+	}
+	var pairs []pair
+	for rows.Next() {
+		var p pair
+		err = rows.Scan(&p.a, &p.b, &p.reason)
+		if err != nil {
+			rows.Close()
+			return
+		}
+		pairs = append(pairs, p)
+	}
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+	for _, p := range pairs {
+		var d slib.AssetDuplicate
+		d.Reason = p.reason
+		for _, aid := range []int{p.a, p.b} {
+			a, err := getAssetBase(op, aid)
+			if err != nil {
+				return ret, err
+			}
+			d.Assets = append(d.Assets, a)
+		}
+		ret = append(ret, d)
+	}
+	return
+}
+
+// serviceAddAlias is the API entry point to add an alias for an asset
+func serviceAddAlias(rw http.ResponseWriter, req *http.Request) {
+	op := opContext{}
+	op.newContext(dbconn, false, req.RemoteAddr)
+
+	var a slib.AssetAlias
+	err := json.NewDecoder(req.Body).Decode(&a)
+	if err == nil {
+		err = a.Validate()
+	}
+	if err == nil {
+		a.Type, a.Name, err = assetTypeResolve(a.Type, a.Name)
+	}
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "alias document malformed", 400)
+		return
+	}
+	_, err = getAssetBase(op, a.AssetID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(rw, "asset not found", 404)
+			return
+		}
+		op.logf(err.Error())
+		http.Error(rw, "error adding alias", 500)
+		return
+	}
+	_, err = aliasAdd(op, a)
+	if err != nil {
+		if err == errAliasConflict {
+			http.Error(rw, err.Error(), 409)
+			return
+		}
+		op.logf(err.Error())
+		http.Error(rw, "error adding alias", 500)
+		return
+	}
+	assetWriteResponse(op, rw, a.AssetID, "error adding alias")
+}
+
+// serviceDeleteAlias is the API entry point to remove an alias
+func serviceDeleteAlias(rw http.ResponseWriter, req *http.Request) {
+	op := opContext{}
+	op.newContext(dbconn, false, req.RemoteAddr)
+
+	req.ParseForm()
+	id, err := strconv.Atoi(req.FormValue("id"))
+	if err != nil {
+		http.Error(rw, "invalid alias id", 400)
+		return
+	}
+	res, err := op.Exec(`DELETE FROM assetalias WHERE aliasid = $1`, id)
+	if err == nil {
+		var n int64
+		n, err = res.RowsAffected()
+		if err == nil && n == 0 {
+			http.Error(rw, "alias not found", 404)
+			return
+		}
+	}
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "error deleting alias", 500)
+		return
+	}
+}
+
+// serviceMergeAssets is the API entry point to merge one asset into another
+func serviceMergeAssets(rw http.ResponseWriter, req *http.Request) {
+	op := opContext{}
+	op.newContext(dbconn, false, req.RemoteAddr)
+
+	var m slib.AssetMerge
+	err := json.NewDecoder(req.Body).Decode(&m)
+	if err == nil {
+		err = m.Validate()
+	}
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "merge document malformed", 400)
+		return
+	}
+	err = op.begin()
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "error merging assets", 500)
+		return
+	}
+	// Lock both assets so indicators are not added to the source asset while the
+	// merge is in progress
+	var n int
+	err = op.QueryRow(`SELECT COUNT(*) FROM (SELECT assetid FROM asset
+		WHERE assetid = $1 OR assetid = $2 FOR UPDATE) x`,
+		m.SourceID, m.TargetID).Scan(&n)
+	if err == nil && n != 2 {
+		op.rollback()
+		http.Error(rw, "asset not found", 404)
+		return
+	}
+	if err == nil {
+		err = assetMerge(op, m.SourceID, m.TargetID)
+	}
+	if err != nil {
+		op.rollback()
+		op.logf(err.Error())
+		http.Error(rw, "error merging assets", 500)
+		return
+	}
+	err = op.commit()
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "error merging assets", 500)
+		return
+	}
+	op.logf("merged asset %v into %v", m.SourceID, m.TargetID)
+	assetWriteResponse(op, rw, m.TargetID, "error merging assets")
+}
+
+// serviceAssetDuplicates is the API entry point to retrieve suggestions for assets that
+// are likely duplicates of each other
+func serviceAssetDuplicates(rw http.ResponseWriter, req *http.Request) {
+	op := opContext{}
+	op.newContext(dbconn, false, req.RemoteAddr)
+
+	var (
+		resp slib.AssetDuplicatesResponse
+		err  error
+	)
+	resp.Duplicates, err = getAssetDuplicates(op)
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "error retrieving duplicate assets", 500)
+		return
+	}
+	buf, err := json.Marshal(&resp)
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "error retrieving duplicate assets", 500)
+		return
+	}
+	fmt.Fprint(rw, string(buf))
+}
@@ -0,0 +1,134 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor:
+// - Aaron Meihm ameihm@mozilla.com
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	slib "github.com/mozilla/service-map/servicelib"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// testPostJSON posts v to the API path and verifies the response code is expect,
+// unmarshaling the response into ret if the request was successful
+func testPostJSON(t *testing.T, path string, v interface{}, expect int, ret interface{}) {
+	client := http.Client{}
+	buf, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	rr, err := client.Post(testserv.URL+path, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		t.Fatalf("client.Post: %v", err)
+	}
+	rbuf, err := ioutil.ReadAll(rr.Body)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll: %v", err)
+	}
+	rr.Body.Close()
+	if rr.StatusCode != expect {
+		t.Fatalf("%v response code %v", path, rr.StatusCode)
+	}
+	if expect == http.StatusOK && ret != nil {
+		err = json.Unmarshal(rbuf, ret)
+		if err != nil {
+			t.Fatalf("json.Unmarshal: %v", err)
+		}
+	}
+}
+
+func TestAssetMerge(t *testing.T) {
+	client := http.Client{}
+	now := time.Now().UTC().Truncate(time.Second)
+
+	testPostAssetIndicators(t, "mergehost", "mergetest", now.Add(-2*time.Hour),
+		now.Add(-1*time.Hour))
+	testPostAssetIndicators(t, "mergehost.mozilla.com", "mergetest", now.Add(-3*time.Hour),
+		now.Add(-1*time.Hour))
+	src := testAssetID(t, "hostname", "mergehost")
+	dst := testAssetID(t, "hostname", "mergehost.mozilla.com")
+
+	// The two assets should be suggested as duplicates
+	rr, err := client.Get(testserv.URL + "/api/v1/assets/duplicates")
+	if err != nil {
+		t.Fatalf("client.Get: %v", err)
+	}
+	buf, err := ioutil.ReadAll(rr.Body)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll: %v", err)
+	}
+	rr.Body.Close()
+	var dups slib.AssetDuplicatesResponse
+	err = json.Unmarshal(buf, &dups)
+	if err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	found := false
+	for _, x := range dups.Duplicates {
+		if len(x.Assets) == 2 && x.Assets[0].ID == src && x.Assets[1].ID == dst {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("duplicate assets were not suggested")
+	}
+
+	testPostJSON(t, "/api/v1/asset/merge", slib.AssetMerge{SourceID: src, TargetID: src},
+		http.StatusBadRequest, nil)
+	var a slib.Asset
+	testPostJSON(t, "/api/v1/asset/merge", slib.AssetMerge{SourceID: src, TargetID: dst},
+		http.StatusOK, &a)
+	if a.ID != dst || len(a.Aliases) != 1 || a.Aliases[0].Name != "mergehost" {
+		t.Fatalf("merged asset had unexpected aliases")
+	}
+	if !a.FirstIndicator.Equal(now.Add(-3 * time.Hour)) {
+		t.Fatalf("merged asset had unexpected first indicator time")
+	}
+
+	// The indicator with the same timestamp should have been discarded during the merge
+	op := opContext{}
+	op.newContext(dbconn, false, "127.0.0.1")
+	var n int
+	err = op.QueryRow(`SELECT COUNT(*) FROM indicator WHERE assetid = $1`, dst).Scan(&n)
+	if err != nil {
+		t.Fatalf("op.QueryRow: %v", err)
+	}
+	if n != 3 {
+		t.Fatalf("merged asset had unexpected number of indicators %v", n)
+	}
+
+	// New indicators for the merged asset and an alias added with a different case
+	// and zone should resolve to the remaining asset
+	testPostJSON(t, "/api/v1/asset/alias/add", slib.AssetAlias{AssetID: dst,
+		Type: "hostname", Name: "mergehost.mozilla.com", Zone: "scl3"},
+		http.StatusConflict, nil)
+	testPostJSON(t, "/api/v1/asset/alias/add", slib.AssetAlias{AssetID: dst,
+		Type: "hostname", Name: "MERGEHOST.mozilla.com", Zone: "mdc1"},
+		http.StatusOK, &a)
+	if len(a.Aliases) != 2 {
+		t.Fatalf("alias was not added to asset")
+	}
+	testPostAssetIndicators(t, "mergehost", "mergetest", now)
+	err = op.QueryRow(`SELECT COUNT(*) FROM indicator WHERE assetid = $1`, dst).Scan(&n)
+	if err != nil {
+		t.Fatalf("op.QueryRow: %v", err)
+	}
+	if n != 4 {
+		t.Fatalf("indicator for alias was not added to asset")
+	}
+	alist, err := getAssetHostname(op, "mergehost")
+	if err != nil {
+		t.Fatalf("getAssetHostname: %v", err)
+	}
+	if len(alist) != 1 || alist[0].ID != dst {
+		t.Fatalf("getAssetHostname did not resolve alias")
+	}
+}
@@ -0,0 +1,579 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor:
+// - Aaron Meihm ameihm@mozilla.com
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/lib/pq"
+	slib "github.com/mozilla/service-map/servicelib"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// assetFilter describes the criteria used to select assets in an asset listing
+type assetFilter struct {
+	assetType    string
+	zone         string
+	state        string
+	operator     string
+	team         string
+	assetGroupID int
+	name         string    // Case insensitive regular expression asset name must match
+	seenSince    time.Time // Last indicator must be at or after this time if set
+	seenBefore   time.Time // Last indicator must be before this time if set
+	sort         string
+	desc         bool
+	limit        int
+	offset       int
+	indicators   bool // Include indicators and event sources in results
+}
+
+// assetSortColumns maps the sort values accepted in an asset listing to asset columns
+var assetSortColumns = map[string]string{
+	"id":               "assetid",
+	"asset_type":       "assettype",
+	"asset_identifier": "name",
+	"zone":             "zone",
+	"first_indicator":  "firstindicator",
+	"last_indicator":   "lastindicator",
+}
+
+// getAssets returns assets matching filter f, along with the total number of matching
+// assets
+func getAssets(op opContext, f assetFilter) (ret []slib.Asset, total int, err error) {
+	var (
+		where []string
+		args  []interface{}
+	)
+	ret = make([]slib.Asset, 0)
+	addArg := func(clause string, v interface{}) {
+		args = append(args, v)
+		where = append(where, fmt.Sprintf(clause, len(args)))
+	}
+	if f.assetType != "" {
+		addArg("assettype = $%v", f.assetType)
+	}
+	if f.zone != "" {
+		addArg("zone = $%v", f.zone)
+	}
+	if f.state != "" {
+		addArg("state = $%v", f.state)
+	}
+	if f.operator != "" {
+		addArg("operator = $%v", f.operator)
+	}
+	if f.team != "" {
+		addArg("team = $%v", f.team)
+	}
+	if f.assetGroupID != 0 {
+		addArg("assetgroupid = $%v", f.assetGroupID)
+	}
+	if f.name != "" {
+		addArg("name ~* $%v", f.name)
+	}
+	if !f.seenSince.IsZero() {
+		addArg("lastindicator >= $%v", f.seenSince)
+	}
+	if !f.seenBefore.IsZero() {
+		addArg("lastindicator < $%v", f.seenBefore)
+	}
+	wherestr := "TRUE"
+	if len(where) > 0 {
+		wherestr = strings.Join(where, " AND ")
+	}
+	col, ok := assetSortColumns[f.sort]
+	if !ok {
+		col = "assetid"
+	}
+	order := "ASC"
+	if f.desc {
+		order = "DESC"
+	}
+
+	from := `FROM asset LEFT OUTER JOIN assetowners ON (asset.ownerid = assetowners.ownerid)
+		WHERE ` + wherestr
+	err = op.QueryRow(`SELECT COUNT(*) `+from, args...).Scan(&total)
+	if err != nil {
+		return
+	}
+	args = append(args, f.limit, f.offset)
+	rows, err := op.Query(fmt.Sprintf(`SELECT assetid %v ORDER BY %v %v, assetid %v
+		LIMIT $%v OFFSET $%v`, from, col, order, order, len(args)-1, len(args)), args...)
+	if err != nil {
+		return
+	}
+	var aids []int
+	for rows.Next() {
+		var aid int
+		err = rows.Scan(&aid)
+		if err != nil {
+			rows.Close()
+			return
+		}
+		aids = append(aids, aid)
+	}
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+	for _, aid := range aids {
+		var a slib.Asset
+		if f.indicators {
+			a, err = getAsset(op, aid)
+		} else {
+			a, err = getAssetBase(op, aid)
+		}
+		if err != nil {
+			return
+		}
+		ret = append(ret, a)
+	}
+	return
+}
+
+const (
+	assetListDefaultLimit = 100
+	assetListMaxLimit     = 1000
+)
+
+// serviceAssets is the API entry point to list and search assets
+//
+// Assets can be filtered by asset_type, zone, state, operator, team, assetgroup, a name regular
+// expression, and the time of the last indicator (seen_since and seen_before, RFC3339). The
+// name expression uses Postgres syntax and is not case sensitive, as with interlink rules.
+// Results are paginated using limit and offset, and can be sorted using sort and
+// order. Indicators for each asset are only included if indicators=true is set.
+func serviceAssets(rw http.ResponseWriter, req *http.Request) {
+	op := opContext{}
+	op.newContext(dbconn, false, req.RemoteAddr)
+
+	req.ParseForm()
+	f := assetFilter{
+		zone:     req.FormValue("zone"),
+		state:    req.FormValue("state"),
+		operator: req.FormValue("operator"),
+		team:     req.FormValue("team"),
+		name:     req.FormValue("name"),
+		sort:     req.FormValue("sort"),
+		limit:    assetListDefaultLimit,
+	}
+	if v := req.FormValue("asset_type"); v != "" {
+		f.assetType, _ = slib.CanonicalAssetType(v)
+	}
+	if f.state != "" && !slib.ValidAssetState(f.state) {
+		http.Error(rw, "invalid state value", 400)
+		return
+	}
+	var err error
+	if v := req.FormValue("assetgroup"); v != "" {
+		f.assetGroupID, err = strconv.Atoi(v)
+		if err != nil {
+			http.Error(rw, "invalid assetgroup value", 400)
+			return
+		}
+	}
+	if v := req.FormValue("seen_since"); v != "" {
+		f.seenSince, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(rw, "invalid seen_since value", 400)
+			return
+		}
+	}
+	if v := req.FormValue("seen_before"); v != "" {
+		f.seenBefore, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(rw, "invalid seen_before value", 400)
+			return
+		}
+	}
+	if f.sort != "" {
+		if _, ok := assetSortColumns[f.sort]; !ok {
+			http.Error(rw, "invalid sort value", 400)
+			return
+		}
+	}
+	switch req.FormValue("order") {
+	case "", "asc":
+	case "desc":
+		f.desc = true
+	default:
+		http.Error(rw, "invalid order value", 400)
+		return
+	}
+	if v := req.FormValue("limit"); v != "" {
+		f.limit, err = strconv.Atoi(v)
+		if err != nil || f.limit < 1 || f.limit > assetListMaxLimit {
+			http.Error(rw, "invalid limit value", 400)
+			return
+		}
+	}
+	if v := req.FormValue("offset"); v != "" {
+		f.offset, err = strconv.Atoi(v)
+		if err != nil || f.offset < 0 {
+			http.Error(rw, "invalid offset value", 400)
+			return
+		}
+	}
+	if v := req.FormValue("indicators"); v != "" {
+		f.indicators, err = strconv.ParseBool(v)
+		if err != nil {
+			http.Error(rw, "invalid indicators value", 400)
+			return
+		}
+	}
+
+	resp := slib.AssetsResponse{Limit: f.limit, Offset: f.offset}
+	resp.Assets, resp.Total, err = getAssets(op, f)
+	if err != nil {
+		// The name expression is only checked by Postgres when the query is run
+		if e, ok := err.(*pq.Error); ok && e.Code == pqInvalidRegularExpression {
+			http.Error(rw, "invalid name expression", 400)
+			return
+		}
+		op.logf(err.Error())
+		http.Error(rw, "error retrieving assets", 500)
+		return
+	}
+	buf, err := json.Marshal(&resp)
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "error retrieving assets", 500)
+		return
+	}
+	fmt.Fprint(rw, string(buf))
+}
+
+// getStaleAssets returns all active assets which have not had an indicator since cutoff,
+// grouped by owner. Assets that have never had an indicator (e.g., manually registered
+// assets) are included, and are listed before other assets for the owner.
+func getStaleAssets(op opContext, cutoff time.Time) (ret []slib.StaleAssetOwner, err error) {
+	var aids []int
+	ret = make([]slib.StaleAssetOwner, 0)
+	rows, err := op.Query(`SELECT assetid FROM asset
+		LEFT OUTER JOIN assetowners ON (asset.ownerid = assetowners.ownerid)
+		WHERE (lastindicator IS NULL OR lastindicator < $1) AND state = $2
+		ORDER BY operator NULLS FIRST, team NULLS FIRST, lastindicator NULLS FIRST`,
+		cutoff, slib.AssetStateActive)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		var aid int
+		err = rows.Scan(&aid)
+		if err != nil {
+			rows.Close()
+			return
+		}
+		aids = append(aids, aid)
+	}
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+	// Assets are ordered by owner, so start a new entry each time the owner changes
+	for _, aid := range aids {
+		a, err := getAsset(op, aid)
+		if err != nil {
+			return ret, err
+		}
+		if len(ret) == 0 || ret[len(ret)-1].Owner.ID != a.Owner.ID {
+			ret = append(ret, slib.StaleAssetOwner{
+				Owner: slib.Owner{
+					ID:           a.Owner.ID,
+					Operator:     a.Owner.Operator,
+					Team:         a.Owner.Team,
+					OwnerContact: a.Owner.OwnerContact,
+				},
+			})
+		}
+		ret[len(ret)-1].Assets = append(ret[len(ret)-1].Assets, a)
+	}
+	return
+}
+
+// serviceStaleAssets is the API entry point to retrieve a report of assets which have
+// not had an indicator in a given number of days, grouped by owner
+func serviceStaleAssets(rw http.ResponseWriter, req *http.Request) {
+	op := opContext{}
+	op.newContext(dbconn, false, req.RemoteAddr)
+
+	req.ParseForm()
+	days, err := strconv.Atoi(req.FormValue("days"))
+	if err != nil || days < 1 {
+		op.logf("invalid days value")
+		http.Error(rw, "invalid days value", 400)
+		return
+	}
+
+	resp := slib.StaleAssetsResponse{Days: days}
+	cutoff := time.Now().UTC().Add(-1 * time.Duration(days) * 24 * time.Hour)
+	resp.Owners, err = getStaleAssets(op, cutoff)
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "error retrieving stale assets", 500)
+		return
+	}
+	buf, err := json.Marshal(&resp)
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "error retrieving stale assets", 500)
+		return
+	}
+	fmt.Fprint(rw, string(buf))
+}
+
+// assetCreate registers asset a manually, returning the new asset ID
+func assetCreate(op opContext, a slib.Asset) (aid int, err error) {
+	err = op.QueryRow(`INSERT INTO asset (assettype, name, zone, manual, address)
+		VALUES ($1, $2, $3, TRUE, $4) RETURNING assetid`,
+		a.Type, a.Name, a.Zone, assetAddress(a.Type, a.Name)).Scan(&aid)
+	return
+}
+
+// assetUpdate updates the type, name and zone of the asset with ID a.ID, returning
+// sql.ErrNoRows if the asset does not exist, or errAliasConflict if the new identity is
+// an alias of another asset
+func assetUpdate(op opContext, a slib.Asset) error {
+	aid, err := assetIDFromAlias(op, a.Type, a.Name, a.Zone)
+	if err == nil && aid != a.ID {
+		return errAliasConflict
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	res, err := op.Exec(`UPDATE asset SET assettype = $1, name = $2, zone = $3,
+		address = $4 WHERE assetid = $5`, a.Type, a.Name, a.Zone,
+		assetAddress(a.Type, a.Name), a.ID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// assetDelete removes asset ID aid along with all indicators, indicator summaries, aliases,
+// labels, ip mappings and dependencies for the asset, returning sql.ErrNoRows if the asset
+// does not exist
+func assetDelete(op opContext, aid int) error {
+	for _, x := range []string{
+		`DELETE FROM indicatorsummary WHERE assetid = $1`,
+		`DELETE FROM indicator WHERE assetid = $1`,
+		`DELETE FROM asseteventsource WHERE assetid = $1`,
+		`DELETE FROM assetalias WHERE assetid = $1`,
+		`DELETE FROM assetlabel WHERE assetid = $1`,
+		`DELETE FROM assetipmap WHERE ipassetid = $1 OR hostassetid = $1`,
+		`DELETE FROM assetdependency WHERE assetid = $1`,
+	} {
+		_, err := op.Exec(x, aid)
+		if err != nil {
+			return err
+		}
+	}
+	res, err := op.Exec(`DELETE FROM asset WHERE assetid = $1`, aid)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// assetWriteResponse writes asset ID aid to the response, or an error using errmsg
+// if the asset cannot be retrieved
+func assetWriteResponse(op opContext, rw http.ResponseWriter, aid int, errmsg string) {
+	a, err := getAsset(op, aid)
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, errmsg, 500)
+		return
+	}
+	buf, err := json.Marshal(&a)
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, errmsg, 500)
+		return
+	}
+	fmt.Fprint(rw, string(buf))
+}
+
+// assetDecode reads an asset document from the request body
+func assetDecode(req *http.Request) (ret slib.Asset, err error) {
+	err = json.NewDecoder(req.Body).Decode(&ret)
+	if err != nil {
+		return
+	}
+	err = ret.Validate()
+	if err != nil {
+		return
+	}
+	ret.Type, ret.Name, err = assetTypeResolve(ret.Type, ret.Name)
+	return
+}
+
+// serviceGetAsset is the API entry point to retrieve a single asset
+func serviceGetAsset(rw http.ResponseWriter, req *http.Request) {
+	op := opContext{}
+	op.newContext(dbconn, false, req.RemoteAddr)
+
+	req.ParseForm()
+	aid, err := strconv.Atoi(req.FormValue("id"))
+	if err != nil {
+		http.Error(rw, "invalid asset id", 400)
+		return
+	}
+	_, err = getAssetBase(op, aid)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(rw, "asset not found", 404)
+			return
+		}
+		op.logf(err.Error())
+		http.Error(rw, "error retrieving asset", 500)
+		return
+	}
+	assetWriteResponse(op, rw, aid, "error retrieving asset")
+}
+
+// serviceGetAssetRisk returns the risk for a given asset ID
+func serviceGetAssetRisk(rw http.ResponseWriter, req *http.Request) {
+	op := opContext{}
+	op.newContext(dbconn, false, req.RemoteAddr)
+
+	req.ParseForm()
+	aid, err := strconv.Atoi(req.FormValue("id"))
+	if err != nil {
+		http.Error(rw, "invalid asset id", 400)
+		return
+	}
+	rs, err := riskForAsset(op, aid)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(rw, "asset not found", 404)
+			return
+		}
+		op.logf(err.Error())
+		http.Error(rw, "error retrieving risk", 500)
+		return
+	}
+	buf, err := json.Marshal(&rs)
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "error retrieving risk", 500)
+		return
+	}
+	fmt.Fprint(rw, string(buf))
+}
+
+// serviceCreateAsset is the API entry point to manually register an asset
+func serviceCreateAsset(rw http.ResponseWriter, req *http.Request) {
+	op := opContext{}
+	op.newContext(dbconn, false, req.RemoteAddr)
+
+	a, err := assetDecode(req)
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "asset document malformed", 400)
+		return
+	}
+	aid, err := assetCreate(op, a)
+	if err != nil {
+		if e, ok := err.(*pq.Error); ok && e.Code == pqUniqueViolation {
+			http.Error(rw, "asset already exists", 409)
+			return
+		}
+		op.logf(err.Error())
+		http.Error(rw, "error creating asset", 500)
+		return
+	}
+	op.logf("manually registered asset %v/%v/%v (%v)", a.Name, a.Type, a.Zone, aid)
+	assetWriteResponse(op, rw, aid, "error creating asset")
+}
+
+// serviceUpdateAsset is the API entry point to update the type, name and zone of an asset
+func serviceUpdateAsset(rw http.ResponseWriter, req *http.Request) {
+	op := opContext{}
+	op.newContext(dbconn, false, req.RemoteAddr)
+
+	a, err := assetDecode(req)
+	if err != nil || a.ID == 0 {
+		http.Error(rw, "asset document malformed", 400)
+		return
+	}
+	err = assetUpdate(op, a)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(rw, "asset not found", 404)
+			return
+		}
+		if e, ok := err.(*pq.Error); ok && e.Code == pqUniqueViolation {
+			http.Error(rw, "asset already exists", 409)
+			return
+		}
+		if err == errAliasConflict {
+			http.Error(rw, "asset conflicts with alias of another asset", 409)
+			return
+		}
+		op.logf(err.Error())
+		http.Error(rw, "error updating asset", 500)
+		return
+	}
+	assetWriteResponse(op, rw, a.ID, "error updating asset")
+}
+
+// serviceDeleteAsset is the API entry point to delete an asset; any indicators for the
+// asset are also removed
+func serviceDeleteAsset(rw http.ResponseWriter, req *http.Request) {
+	op := opContext{}
+	op.newContext(dbconn, false, req.RemoteAddr)
+
+	req.ParseForm()
+	aid, err := strconv.Atoi(req.FormValue("id"))
+	if err != nil {
+		http.Error(rw, "invalid asset id", 400)
+		return
+	}
+	err = op.begin()
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "error deleting asset", 500)
+		return
+	}
+	err = assetDelete(op, aid)
+	if err != nil {
+		op.rollback()
+		if err == sql.ErrNoRows {
+			http.Error(rw, "asset not found", 404)
+			return
+		}
+		op.logf(err.Error())
+		http.Error(rw, "error deleting asset", 500)
+		return
+	}
+	err = op.commit()
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "error deleting asset", 500)
+		return
+	}
+	op.logf("deleted asset %v", aid)
+}
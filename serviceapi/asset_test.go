@@ -0,0 +1,317 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor:
+// - Aaron Meihm ameihm@mozilla.com
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	slib "github.com/mozilla/service-map/servicelib"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testAssetID returns the ID of the asset with the specified type and name
+func testAssetID(t *testing.T, atype string, name string) (ret int) {
+	op := opContext{}
+	op.newContext(dbconn, false, "127.0.0.1")
+	err := op.QueryRow(`SELECT assetid FROM asset WHERE assettype = $1 AND
+		name = $2`, atype, name).Scan(&ret)
+	if err != nil {
+		t.Fatalf("op.QueryRow: %v", err)
+	}
+	return
+}
+
+// testPostAssetIndicators submits indicators for a hostname asset, one for each
+// timestamp in ts
+func testPostAssetIndicators(t *testing.T, name string, src string, ts ...time.Time) {
+	client := http.Client{}
+	var batch []slib.RawIndicator
+	for _, x := range ts {
+		batch = append(batch, slib.RawIndicator{
+			Type:        "hostname",
+			Name:        name,
+			Zone:        "scl3",
+			EventSource: src,
+			Likelihood:  "low",
+			Timestamp:   x,
+			Details:     map[string]string{"noop": "asset test indicator"},
+		})
+	}
+	buf, err := json.Marshal(batch)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	resp := postIndicators(t, &client, buf)
+	if resp.Accepted != len(batch) {
+		t.Fatalf("asset test indicators were not accepted")
+	}
+}
+
+func TestAssetSeen(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	// Submit indicators out of order, so the first and last indicator times are not
+	// simply the times of the first and last submitted indicators
+	testPostAssetIndicators(t, "seenhost.mozilla.com", "seenfirst",
+		now.Add(-72*time.Hour), now.Add(-24*time.Hour), now.Add(-120*time.Hour))
+	testPostAssetIndicators(t, "seenhost.mozilla.com", "seensecond",
+		now.Add(-96*time.Hour))
+
+	op := opContext{}
+	op.newContext(dbconn, false, "127.0.0.1")
+	a, err := getAsset(op, testAssetID(t, "hostname", "seenhost.mozilla.com"))
+	if err != nil {
+		t.Fatalf("getAsset: %v", err)
+	}
+	if !a.FirstIndicator.Equal(now.Add(-120 * time.Hour)) {
+		t.Fatalf("getAsset: unexpected first indicator time")
+	}
+	if !a.LastIndicator.Equal(now.Add(-24 * time.Hour)) {
+		t.Fatalf("getAsset: unexpected last indicator time")
+	}
+	if len(a.EventSources) != 2 {
+		t.Fatalf("getAsset: unexpected number of event sources")
+	}
+	var stab = []struct {
+		src   string
+		first time.Time
+		last  time.Time
+	}{
+		{"seenfirst", now.Add(-120 * time.Hour), now.Add(-24 * time.Hour)},
+		{"seensecond", now.Add(-96 * time.Hour), now.Add(-96 * time.Hour)},
+	}
+	for i, x := range stab {
+		es := a.EventSources[i]
+		if es.EventSource != x.src || !es.FirstIndicator.Equal(x.first) ||
+			!es.LastIndicator.Equal(x.last) {
+			t.Fatalf("getAsset: unexpected values for event source %v", x.src)
+		}
+	}
+}
+
+func TestServiceStaleAssets(t *testing.T) {
+	client := http.Client{}
+
+	testPostAssetIndicators(t, "stalehost.mozilla.com", "stale",
+		time.Now().Add(-30*24*time.Hour))
+	// A manually registered asset that has never had an indicator is also stale
+	testPostJSON(t, "/api/v1/asset/create", slib.Asset{Type: "hostname",
+		Name: "staleneverseen.mozilla.com", Zone: "stale"}, http.StatusOK, nil)
+
+	rr, err := client.Get(testserv.URL + "/api/v1/assets/stale?days=7")
+	if err != nil {
+		t.Fatalf("client.Get: %v", err)
+	}
+	if rr.StatusCode != http.StatusOK {
+		t.Fatalf("stale assets response code %v", rr.StatusCode)
+	}
+	buf, err := ioutil.ReadAll(rr.Body)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll: %v", err)
+	}
+	rr.Body.Close()
+	var resp slib.StaleAssetsResponse
+	err = json.Unmarshal(buf, &resp)
+	if err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	found, foundneverseen := false, false
+	for _, o := range resp.Owners {
+		for _, a := range o.Assets {
+			if a.Name == "stalehost.mozilla.com" {
+				if o.Owner.Operator != "unset" || o.Owner.Team != "unset" {
+					t.Fatalf("stale asset had unexpected owner")
+				}
+				found = true
+			}
+			if a.Name == "staleneverseen.mozilla.com" {
+				foundneverseen = true
+			}
+			if a.Name == "testhost1.mozilla.com" {
+				t.Fatalf("stale assets included active asset")
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("stale assets did not include stale asset")
+	}
+	if !foundneverseen {
+		t.Fatalf("stale assets did not include asset that has never been seen")
+	}
+
+	rr, err = client.Get(testserv.URL + "/api/v1/assets/stale?days=0")
+	if err != nil {
+		t.Fatalf("client.Get: %v", err)
+	}
+	if rr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("stale assets response code %v", rr.StatusCode)
+	}
+	rr.Body.Close()
+}
+
+func TestServiceAssets(t *testing.T) {
+	client := http.Client{}
+
+	get := func(query string) (ret slib.AssetsResponse) {
+		rr, err := client.Get(testserv.URL + "/api/v1/assets?" + query)
+		if err != nil {
+			t.Fatalf("client.Get: %v", err)
+		}
+		if rr.StatusCode != http.StatusOK {
+			t.Fatalf("assets response code %v", rr.StatusCode)
+		}
+		buf, err := ioutil.ReadAll(rr.Body)
+		if err != nil {
+			t.Fatalf("ioutil.ReadAll: %v", err)
+		}
+		rr.Body.Close()
+		err = json.Unmarshal(buf, &ret)
+		if err != nil {
+			t.Fatalf("json.Unmarshal: %v", err)
+		}
+		return
+	}
+
+	resp := get("name=%5Etesthost1%5C.&indicators=true")
+	if resp.Total != 1 || len(resp.Assets) != 1 {
+		t.Fatalf("unexpected number of assets %v", resp.Total)
+	}
+	a := resp.Assets[0]
+	if a.Name != "testhost1.mozilla.com" || a.Owner.Operator != "operator" {
+		t.Fatalf("unexpected asset in listing")
+	}
+	if len(a.Indicators) == 0 {
+		t.Fatalf("asset listing did not include indicators")
+	}
+
+	// Name expressions are not case sensitive
+	resp = get("name=%5ETESTHOST1%5C.")
+	if resp.Total != 1 || resp.Assets[0].Name != "testhost1.mozilla.com" {
+		t.Fatalf("name expression was case sensitive")
+	}
+
+	resp = get("asset_type=hostname&assetgroup=1&sort=asset_identifier&order=desc&limit=1")
+	if resp.Total < 2 || len(resp.Assets) != 1 || resp.Limit != 1 {
+		t.Fatalf("unexpected paginated asset listing")
+	}
+	if resp.Assets[0].AssetGroupID != 1 || len(resp.Assets[0].Indicators) != 0 {
+		t.Fatalf("unexpected asset in paginated listing")
+	}
+	next := get("asset_type=hostname&assetgroup=1&sort=asset_identifier&order=desc&limit=1&offset=1")
+	if len(next.Assets) != 1 || next.Assets[0].Name >= resp.Assets[0].Name {
+		t.Fatalf("asset listing not sorted as requested")
+	}
+
+	resp = get("seen_before=2000-01-01T00:00:00Z")
+	if resp.Total != 0 {
+		t.Fatalf("asset listing returned assets outside last seen window")
+	}
+
+	for _, x := range []string{"sort=bad", "limit=0", "name=%5B",
+		"name=%28%3FP%3Cn%3Etest%29", "seen_since=yesterday"} {
+		rr, err := client.Get(testserv.URL + "/api/v1/assets?" + x)
+		if err != nil {
+			t.Fatalf("client.Get: %v", err)
+		}
+		rr.Body.Close()
+		if rr.StatusCode != http.StatusBadRequest {
+			t.Fatalf("assets response code %v for %v", rr.StatusCode, x)
+		}
+	}
+}
+
+func TestServiceAssetManual(t *testing.T) {
+	client := http.Client{}
+
+	post := func(path string, body []byte, expect int) (ret slib.Asset) {
+		rr, err := client.Post(testserv.URL+"/api/v1/asset/"+path, "application/json",
+			bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("client.Post: %v", err)
+		}
+		if rr.StatusCode != expect {
+			t.Fatalf("asset %v response code %v", path, rr.StatusCode)
+		}
+		buf, err := ioutil.ReadAll(rr.Body)
+		if err != nil {
+			t.Fatalf("ioutil.ReadAll: %v", err)
+		}
+		rr.Body.Close()
+		if expect == http.StatusOK && len(buf) > 0 {
+			err = json.Unmarshal(buf, &ret)
+			if err != nil {
+				t.Fatalf("json.Unmarshal: %v", err)
+			}
+		}
+		return
+	}
+	marshal := func(a slib.Asset) []byte {
+		buf, err := json.Marshal(a)
+		if err != nil {
+			t.Fatalf("json.Marshal: %v", err)
+		}
+		return buf
+	}
+
+	newasset := slib.Asset{Type: "hostname", Name: "manualhost.mozilla.com", Zone: "scl3"}
+	a := post("create", marshal(newasset), http.StatusOK)
+	if a.ID == 0 || !a.Manual || !a.LastIndicator.IsZero() {
+		t.Fatalf("manually created asset had unexpected values")
+	}
+	post("create", marshal(newasset), http.StatusConflict)
+	post("create", []byte(`{"asset_type":"hostname"}`), http.StatusBadRequest)
+
+	// An indicator for the asset should make use of the manually registered asset
+	ts := time.Now().UTC().Truncate(time.Second).Add(-1 * time.Hour)
+	testPostAssetIndicators(t, "manualhost.mozilla.com", "manualtest", ts)
+	if testAssetID(t, "hostname", "manualhost.mozilla.com") != a.ID {
+		t.Fatalf("indicator did not use manually registered asset")
+	}
+
+	a.Zone = "mdc1"
+	u := post("update", marshal(a), http.StatusOK)
+	if u.Zone != "mdc1" || !u.Manual || !u.LastIndicator.Equal(ts) || len(u.Indicators) != 1 {
+		t.Fatalf("updated asset had unexpected values")
+	}
+	// Renaming the asset to an alias of another asset should be rejected
+	other := post("create", marshal(slib.Asset{Type: "hostname",
+		Name: "manualother.mozilla.com", Zone: "mdc1"}), http.StatusOK)
+	testPostJSON(t, "/api/v1/asset/alias/add", slib.AssetAlias{AssetID: other.ID,
+		Type: "hostname", Name: "manualalias.mozilla.com", Zone: "mdc1"},
+		http.StatusOK, nil)
+	rename := u
+	rename.Name = "manualalias.mozilla.com"
+	post("update", marshal(rename), http.StatusConflict)
+	a.ID = 999999
+	post("update", marshal(a), http.StatusNotFound)
+
+	// Deleting the asset should also remove its indicators
+	post("delete?id="+strconv.Itoa(u.ID), nil, http.StatusOK)
+	post("delete?id="+strconv.Itoa(u.ID), nil, http.StatusNotFound)
+	op := opContext{}
+	op.newContext(dbconn, false, "127.0.0.1")
+	var n int
+	err := op.QueryRow(`SELECT COUNT(*) FROM indicator WHERE assetid = $1`, u.ID).Scan(&n)
+	if err != nil {
+		t.Fatalf("op.QueryRow: %v", err)
+	}
+	if n != 0 {
+		t.Fatalf("indicators remained for deleted asset")
+	}
+	rr, err := client.Get(testserv.URL + "/api/v1/asset/id?id=" + strconv.Itoa(u.ID))
+	if err != nil {
+		t.Fatalf("client.Get: %v", err)
+	}
+	rr.Body.Close()
+	if rr.StatusCode != http.StatusNotFound {
+		t.Fatalf("deleted asset response code %v", rr.StatusCode)
+	}
+}
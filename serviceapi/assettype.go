@@ -0,0 +1,237 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor:
+// - Aaron Meihm ameihm@mozilla.com
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/lib/pq"
+	slib "github.com/mozilla/service-map/servicelib"
+	"os"
+	"strings"
+)
+
+// assetTypeMap returns the configured mapping of unknown asset types to known types
+func assetTypeMap() (ret map[string]string, err error) {
+	ret = make(map[string]string)
+	for _, x := range cfg.AssetTypes.Map {
+		kv := strings.SplitN(x, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid asset type mapping %q", x)
+		}
+		from := strings.ToLower(strings.TrimSpace(kv[0]))
+		to, known := slib.CanonicalAssetType(kv[1])
+		if !known {
+			return nil, fmt.Errorf("asset type mapping %q refers to unknown type", x)
+		}
+		ret[from] = to
+	}
+	return
+}
+
+// assetTypeResolve applies the asset type configuration to an asset type and name that
+// have already been normalized. Unknown types are mapped to a known type if a mapping is
+// configured, otherwise they are rejected if unknown types are not allowed.
+func assetTypeResolve(atype, name string) (string, string, error) {
+	if _, known := slib.CanonicalAssetType(atype); known {
+		return atype, name, nil
+	}
+	m, err := assetTypeMap()
+	if err != nil {
+		return atype, name, err
+	}
+	if to, ok := m[atype]; ok {
+		return slib.NormalizeAsset(to, name)
+	}
+	if cfg.AssetTypes.Unknown == "reject" {
+		return atype, name, fmt.Errorf("unknown asset type %q", atype)
+	}
+	return atype, name, nil
+}
+
+// indicatorResolveType applies the asset type configuration to an indicator
+func indicatorResolveType(indicator *slib.RawIndicator) (err error) {
+	indicator.Type, indicator.Name, err = assetTypeResolve(indicator.Type, indicator.Name)
+	return
+}
+
+// assetNormalizeResult summarizes the changes made by assetTypeNormalizeExisting
+type assetNormalizeResult struct {
+	renamed  int // Assets renamed to their normalized name
+	merged   int // Assets merged into an asset with the normalized identity
+	aliases  int // Aliases renamed or removed
+	address  int // IP assets whose missing address was set
+	invalid  int // Assets and aliases with names that are not valid for their type
+	conflict int // Aliases whose normalized identity refers to a different asset
+}
+
+// assetNormalizeRow is an asset or alias identity loaded for normalization
+type assetNormalizeRow struct {
+	id, assetid       int
+	atype, name, zone string
+}
+
+// assetNormalizeRows returns the rows returned by qs, which must select the row ID, asset
+// ID, type, name and zone for assets or aliases with a known asset type
+func assetNormalizeRows(op opContext, qs string) (ret []assetNormalizeRow, err error) {
+	rows, err := op.Query(qs, pq.Array(slib.AssetTypes()))
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		var r assetNormalizeRow
+		err = rows.Scan(&r.id, &r.assetid, &r.atype, &r.name, &r.zone)
+		if err != nil {
+			rows.Close()
+			return
+		}
+		ret = append(ret, r)
+	}
+	err = rows.Err()
+	return
+}
+
+// assetTypeNormalizeExisting normalizes the names of assets and aliases of known types that
+// were stored before asset names were normalized, so indicators using the normalized name
+// continue to be associated with them. An asset whose normalized identity is already used by
+// another asset, or by an alias of another asset, is merged into that asset. An alias whose
+// normalized identity is already used by the asset it refers to is removed. Names that are
+// not valid for their type, and aliases that would conflict with a different asset, are
+// reported and left unchanged. The changes are made in a single transaction, which is rolled
+// back if dryrun is true.
+func assetTypeNormalizeExisting(op opContext, dryrun bool) (ret assetNormalizeResult, err error) {
+	err = op.begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil || dryrun {
+			op.rollback()
+			return
+		}
+		err = op.commit()
+	}()
+
+	assets, err := assetNormalizeRows(op, `SELECT assetid, assetid, assettype, name, zone
+		FROM asset WHERE assettype = ANY($1) ORDER BY assetid`)
+	if err != nil {
+		return
+	}
+	for _, a := range assets {
+		_, name, e := slib.NormalizeAsset(a.atype, a.name)
+		if e != nil {
+			op.logf("asset %v: %v", a.id, e)
+			ret.invalid++
+			continue
+		}
+		if name == a.name {
+			// IP assets stored before addresses were recorded still need the address
+			// set, even if the name is already normalized
+			if a.atype == slib.AssetTypeIP {
+				var res sql.Result
+				res, err = op.Exec(`UPDATE asset SET address = $1 WHERE assetid = $2
+					AND address IS NULL`, assetAddress(a.atype, name), a.id)
+				if err != nil {
+					return
+				}
+				var n int64
+				n, err = res.RowsAffected()
+				if err != nil {
+					return
+				}
+				ret.address += int(n)
+			}
+			continue
+		}
+		var dst int
+		err = op.QueryRow(`SELECT assetid FROM asset WHERE assettype = $1 AND
+			name = $2 AND zone = $3`, a.atype, name, a.zone).Scan(&dst)
+		if err == sql.ErrNoRows {
+			dst, err = assetIDFromAlias(op, a.atype, name, a.zone)
+		}
+		switch {
+		case err == nil && dst != a.id:
+			op.logf("merging asset %v (%v) into asset %v (%v)", a.id, a.name, dst, name)
+			err = assetMerge(op, a.id, dst)
+			if err != nil {
+				return
+			}
+			ret.merged++
+			continue
+		case err != nil && err != sql.ErrNoRows:
+			return
+		}
+		op.logf("renaming asset %v from %v to %v", a.id, a.name, name)
+		_, err = op.Exec(`UPDATE asset SET name = $1, address = $2 WHERE assetid = $3`,
+			name, assetAddress(a.atype, name), a.id)
+		if err != nil {
+			return
+		}
+		ret.renamed++
+	}
+
+	aliases, err := assetNormalizeRows(op, `SELECT aliasid, assetid, assettype, name, zone
+		FROM assetalias WHERE assettype = ANY($1) ORDER BY aliasid`)
+	if err != nil {
+		return
+	}
+	for _, a := range aliases {
+		_, name, e := slib.NormalizeAsset(a.atype, a.name)
+		if e != nil {
+			op.logf("alias %v: %v", a.id, e)
+			ret.invalid++
+			continue
+		}
+		// Alias names are stored in lower case
+		name = strings.ToLower(name)
+		if name == a.name {
+			continue
+		}
+		var dst int
+		err = op.QueryRow(`SELECT assetid FROM asset WHERE assettype = $1 AND
+			name = $2 AND zone = $3 UNION SELECT assetid FROM assetalias WHERE
+			assettype = $1 AND name = $2 AND zone = $3 AND aliasid != $4`,
+			a.atype, name, a.zone, a.id).Scan(&dst)
+		switch {
+		case err == nil && dst == a.assetid:
+			op.logf("removing alias %v (%v), asset %v already uses %v", a.id, a.name,
+				a.assetid, name)
+			_, err = op.Exec(`DELETE FROM assetalias WHERE aliasid = $1`, a.id)
+		case err == nil:
+			op.logf("alias %v (%v) of asset %v conflicts with asset %v", a.id, a.name,
+				a.assetid, dst)
+			ret.conflict++
+			continue
+		case err == sql.ErrNoRows:
+			op.logf("renaming alias %v from %v to %v", a.id, a.name, name)
+			_, err = op.Exec(`UPDATE assetalias SET name = $1 WHERE aliasid = $2`,
+				name, a.id)
+		}
+		if err != nil {
+			return
+		}
+		ret.aliases++
+	}
+	return
+}
+
+// assetTypeNormalizeCLI runs assetTypeNormalizeExisting when serviceapi is run in normalize
+// mode, writing a summary of the changes to stdout
+func assetTypeNormalizeCLI(dryrun bool) error {
+	op := opContext{}
+	op.newContext(dbconn, false, "normalize")
+	res, err := assetTypeNormalizeExisting(op, dryrun)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "%v assets renamed, %v merged, %v aliases updated, "+
+		"%v addresses set, %v invalid names, %v alias conflicts (dry run: %v)\n",
+		res.renamed, res.merged, res.aliases, res.address, res.invalid, res.conflict,
+		dryrun)
+	return nil
+}
@@ -0,0 +1,178 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor:
+// - Aaron Meihm ameihm@mozilla.com
+
+package main
+
+import (
+	"database/sql"
+	slib "github.com/mozilla/service-map/servicelib"
+	"testing"
+)
+
+func TestNormalizeAsset(t *testing.T) {
+	tests := []struct {
+		atype, name  string
+		etype, ename string
+		valid        bool
+	}{
+		{"Hostname", "TestHost.Mozilla.com.", "hostname", "testhost.mozilla.com", true},
+		{"host", "testhost", "hostname", "testhost", true},
+		{"hostname", "bad host", "", "", false},
+		{"website", "www.Mozilla.org/", "website", "www.mozilla.org", true},
+		{"website", "www.mozilla.org:8443/path/", "website", "www.mozilla.org:8443/path", true},
+		{"url", "HTTP://www.mozilla.org:80/path/", "website", "http://www.mozilla.org/path", true},
+		{"website", "https://www.mozilla.org:8443", "website", "https://www.mozilla.org:8443", true},
+		{"website", "https://www.mozilla.org/path/?q=1#top", "website",
+			"https://www.mozilla.org/path?q=1", true},
+		{"website", "https://www.mozilla.org/#top", "website", "https://www.mozilla.org", true},
+		{"website", "ftp://www.mozilla.org", "", "", false},
+		{"ip", "10.0.0.1", "ip", "10.0.0.1", true},
+		{"ipv6", "2001:DB8::0001", "ip", "2001:db8::1", true},
+		{"ip", "10.0.0.256", "", "", false},
+		{"image", "docker.io/library/Nginx:1.13", "container_image", "nginx:1.13", true},
+		{"container_image", "registry:5000/app/web", "container_image", "registry:5000/app/web", true},
+		{"aws_account", "123456789012", "cloud_account", "123456789012", true},
+		{"repo", "git@GitHub.com:mozilla/service-map.git", "code_repository",
+			"github.com/mozilla/service-map", true},
+		{"code_repository", "https://github.com/mozilla/service-map/", "code_repository",
+			"github.com/mozilla/service-map", true},
+		{"Something", " Value ", "something", "Value", true},
+	}
+	for _, x := range tests {
+		rt, rn, err := slib.NormalizeAsset(x.atype, x.name)
+		if x.valid != (err == nil) {
+			t.Fatalf("NormalizeAsset %v/%v: unexpected result %v", x.atype, x.name, err)
+		}
+		if x.valid && (rt != x.etype || rn != x.ename) {
+			t.Fatalf("NormalizeAsset %v/%v: unexpected values %v/%v", x.atype, x.name, rt, rn)
+		}
+	}
+
+	// Websites that differ only in the query must remain distinct assets
+	_, n1, err := slib.NormalizeAsset("website", "https://www.mozilla.org/app?id=1")
+	if err != nil {
+		t.Fatalf("NormalizeAsset: %v", err)
+	}
+	_, n2, err := slib.NormalizeAsset("website", "https://www.mozilla.org/app?id=2")
+	if err != nil {
+		t.Fatalf("NormalizeAsset: %v", err)
+	}
+	if n1 == n2 {
+		t.Fatalf("NormalizeAsset: websites differing in query were not distinct")
+	}
+}
+
+func TestAssetTypeResolve(t *testing.T) {
+	defer func() {
+		cfg.AssetTypes.Unknown = ""
+		cfg.AssetTypes.Map = nil
+	}()
+	cfg.AssetTypes.Map = []string{"vm=hostname"}
+	rt, rn, err := assetTypeResolve("vm", "VMHost.mozilla.com")
+	if err != nil {
+		t.Fatalf("assetTypeResolve: %v", err)
+	}
+	if rt != "hostname" || rn != "vmhost.mozilla.com" {
+		t.Fatalf("assetTypeResolve: unexpected mapped values %v/%v", rt, rn)
+	}
+	_, _, err = assetTypeResolve("other", "value")
+	if err != nil {
+		t.Fatalf("assetTypeResolve: unknown type rejected when allowed")
+	}
+	cfg.AssetTypes.Unknown = "reject"
+	_, _, err = assetTypeResolve("other", "value")
+	if err == nil {
+		t.Fatalf("assetTypeResolve: unknown type allowed when rejected")
+	}
+	cfg.AssetTypes.Map = []string{"vm=nottype"}
+	if cfg.validate() == nil {
+		t.Fatalf("validate: mapping to unknown type accepted")
+	}
+}
+
+func TestAssetTypeNormalizeExisting(t *testing.T) {
+	op := opContext{}
+	op.newContext(dbconn, false, "127.0.0.1")
+
+	// Assets and aliases stored before names were normalized
+	for _, n := range []string{"LegacyHost.mozilla.com", "legacyhost.mozilla.com.",
+		"LegacyOther.mozilla.com"} {
+		_, err := op.Exec(`INSERT INTO asset (assettype, name, zone)
+			VALUES ('hostname', $1, 'legacytest')`, n)
+		if err != nil {
+			t.Fatalf("op.Exec: %v", err)
+		}
+	}
+	_, err := op.Exec(`INSERT INTO assetalias (assetid, assettype, name, zone)
+		SELECT assetid, 'hostname', 'legacyalias.mozilla.com.', 'legacytest'
+		FROM asset WHERE name = 'LegacyOther.mozilla.com'`)
+	if err != nil {
+		t.Fatalf("op.Exec: %v", err)
+	}
+	// An ip asset with a normalized name but no address
+	var ipid int
+	err = op.QueryRow(`INSERT INTO asset (assettype, name, zone)
+		VALUES ('ip', '10.99.0.1', 'legacyiptest') RETURNING assetid`).Scan(&ipid)
+	if err != nil {
+		t.Fatalf("op.QueryRow: %v", err)
+	}
+	names := func() (ret []string) {
+		rows, err := op.Query(`SELECT name FROM asset WHERE zone = 'legacytest'
+			UNION ALL SELECT name FROM assetalias WHERE zone = 'legacytest' ORDER BY 1`)
+		if err != nil {
+			t.Fatalf("op.Query: %v", err)
+		}
+		for rows.Next() {
+			var n string
+			err = rows.Scan(&n)
+			if err != nil {
+				t.Fatalf("rows.Scan: %v", err)
+			}
+			ret = append(ret, n)
+		}
+		return
+	}
+
+	// A dry run should not change anything
+	_, err = assetTypeNormalizeExisting(op, true)
+	if err != nil {
+		t.Fatalf("assetTypeNormalizeExisting: %v", err)
+	}
+	if len(names()) != 4 {
+		t.Fatalf("assetTypeNormalizeExisting: dry run modified assets")
+	}
+
+	res, err := assetTypeNormalizeExisting(op, false)
+	if err != nil {
+		t.Fatalf("assetTypeNormalizeExisting: %v", err)
+	}
+	if res.renamed < 2 || res.merged < 1 || res.aliases < 1 || res.address < 1 {
+		t.Fatalf("assetTypeNormalizeExisting: unexpected result %+v", res)
+	}
+	var address sql.NullString
+	err = op.QueryRow(`SELECT host(address) FROM asset WHERE assetid = $1`,
+		ipid).Scan(&address)
+	if err != nil {
+		t.Fatalf("op.QueryRow: %v", err)
+	}
+	if !address.Valid || address.String != "10.99.0.1" {
+		t.Fatalf("assetTypeNormalizeExisting: ip asset address was not set")
+	}
+	// The two assets differing only in case and trailing dot should be merged, and the
+	// alias added for the merged asset removed as it matches the normalized name
+	exp := []string{"legacyalias.mozilla.com", "legacyhost.mozilla.com",
+		"legacyother.mozilla.com"}
+	got := names()
+	if len(got) != len(exp) {
+		t.Fatalf("assetTypeNormalizeExisting: unexpected names %v", got)
+	}
+	for i := range exp {
+		if got[i] != exp[i] {
+			t.Fatalf("assetTypeNormalizeExisting: unexpected names %v", got)
+		}
+	}
+}
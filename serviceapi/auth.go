@@ -17,6 +17,7 @@ const (
 	authReadOwner
 	authWriteIndicator
 	authWriteRRA
+	authWriteAsset
 )
 
 type authPeer struct {
@@ -26,6 +27,7 @@ type authPeer struct {
 	readowner      bool
 	writeindicator bool
 	writerra       bool
+	writeasset     bool
 }
 
 // apiAuthenticate authenticates a request with an API key token
@@ -33,10 +35,10 @@ func apiAuthenticate(hdr string) (ret authPeer, err error) {
 	op := opContext{}
 	op.newContext(dbconn, false, "apiAuthenticate")
 
-	err = op.QueryRow(`SELECT name, readrisk, readowner, writeindicator, writerra
-		FROM apikey WHERE
+	err = op.QueryRow(`SELECT name, readrisk, readowner, writeindicator, writerra,
+		writeasset FROM apikey WHERE
 		hash = crypt($1, hash)`, hdr).Scan(&ret.name, &ret.readrisk, &ret.readowner,
-		&ret.writeindicator, &ret.writerra)
+		&ret.writeindicator, &ret.writerra, &ret.writeasset)
 	if err != nil {
 		err = errors.New("api key invalid")
 	}
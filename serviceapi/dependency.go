@@ -0,0 +1,399 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor:
+// - Aaron Meihm ameihm@mozilla.com
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/lib/pq"
+	slib "github.com/mozilla/service-map/servicelib"
+	"net/http"
+)
+
+// getDependencies returns all service and asset dependencies
+func getDependencies(op opContext) (ret slib.DependenciesResponse, err error) {
+	ret.Services = make([]slib.ServiceDependency, 0)
+	ret.Assets = make([]slib.AssetDependency, 0)
+	rows, err := op.Query(`SELECT service, dependson, manual FROM servicedependency
+		ORDER BY service, dependson`)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		var d slib.ServiceDependency
+		err = rows.Scan(&d.Service, &d.DependsOn, &d.Manual)
+		if err != nil {
+			rows.Close()
+			return
+		}
+		ret.Services = append(ret.Services, d)
+	}
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+	rows, err = op.Query(`SELECT assetid, assetgroupid, manual FROM assetdependency
+		ORDER BY assetgroupid, assetid`)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		var d slib.AssetDependency
+		err = rows.Scan(&d.AssetID, &d.AssetGroupID, &d.Manual)
+		if err != nil {
+			rows.Close()
+			return
+		}
+		ret.Assets = append(ret.Assets, d)
+	}
+	err = rows.Err()
+	return
+}
+
+// dependencyServiceAdd adds a dependency of one service on another; if the dependency was
+// already created by interlink it is marked as manual so it is kept by interlink
+func dependencyServiceAdd(op opContext, d slib.ServiceDependency) error {
+	_, err := op.Exec(`INSERT INTO servicedependency (service, dependson, manual)
+		VALUES ($1, $2, TRUE) ON CONFLICT (service, dependson) DO UPDATE SET
+		manual = TRUE`, d.Service, d.DependsOn)
+	return err
+}
+
+// dependencyServiceDelete removes a dependency of one service on another
+func dependencyServiceDelete(op opContext, d slib.ServiceDependency) error {
+	res, err := op.Exec(`DELETE FROM servicedependency WHERE service = $1 AND
+		dependson = $2`, d.Service, d.DependsOn)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// dependencyAssetAdd adds a dependency of an asset group on an asset, returning
+// sql.ErrNoRows if the asset or the asset group does not exist
+func dependencyAssetAdd(op opContext, d slib.AssetDependency) error {
+	_, err := getAssetBase(op, d.AssetID)
+	if err != nil {
+		return err
+	}
+	var agid int
+	err = op.QueryRow(`SELECT assetgroupid FROM assetgroup WHERE assetgroupid = $1`,
+		d.AssetGroupID).Scan(&agid)
+	if err != nil {
+		return err
+	}
+	_, err = op.Exec(`INSERT INTO assetdependency (assetid, assetgroupid, manual)
+		VALUES ($1, $2, TRUE) ON CONFLICT (assetid, assetgroupid) DO UPDATE SET
+		manual = TRUE`, d.AssetID, d.AssetGroupID)
+	return err
+}
+
+// dependencyAssetDelete removes a dependency of an asset group on an asset
+func dependencyAssetDelete(op opContext, d slib.AssetDependency) error {
+	res, err := op.Exec(`DELETE FROM assetdependency WHERE assetid = $1 AND
+		assetgroupid = $2`, d.AssetID, d.AssetGroupID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// dependencyServices returns the names of all services service depends on, either directly
+// or through other dependencies
+func dependencyServices(op opContext, service string) (ret []string, err error) {
+	seen := map[string]bool{service: true}
+	queue := []string{service}
+	for len(queue) > 0 {
+		var rows *sql.Rows
+		rows, err = op.Query(`SELECT dependson FROM servicedependency
+			WHERE service = $1 ORDER BY dependson`, queue[0])
+		if err != nil {
+			return
+		}
+		queue = queue[1:]
+		for rows.Next() {
+			var s string
+			err = rows.Scan(&s)
+			if err != nil {
+				rows.Close()
+				return
+			}
+			if seen[s] {
+				continue
+			}
+			seen[s] = true
+			ret = append(ret, s)
+			queue = append(queue, s)
+		}
+		err = rows.Err()
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// dependencyGroupAssets returns the assets which support any of the asset groups in grps
+func dependencyGroupAssets(op opContext, grps []slib.AssetGroup) (ret []slib.Asset, err error) {
+	var agids []int
+	for _, g := range grps {
+		agids = append(agids, g.ID)
+	}
+	if len(agids) == 0 {
+		return
+	}
+	rows, err := op.Query(`SELECT DISTINCT assetid FROM assetdependency
+		WHERE assetgroupid = ANY($1) ORDER BY assetid`, pq.Array(agids))
+	if err != nil {
+		return
+	}
+	var aids []int
+	for rows.Next() {
+		var aid int
+		err = rows.Scan(&aid)
+		if err != nil {
+			rows.Close()
+			return
+		}
+		aids = append(aids, aid)
+	}
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+	for _, aid := range aids {
+		var a slib.Asset
+		a, err = getAsset(op, aid)
+		if err != nil {
+			return
+		}
+		ret = append(ret, a)
+	}
+	return
+}
+
+// dependencyServiceAssets returns the assets which are part of the most recent RRA for
+// service, including assets which support the asset groups linked to the RRA
+func dependencyServiceAssets(op opContext, service string) (ret []slib.Asset, err error) {
+	var rraid int
+	err = op.QueryRow(`SELECT rraid FROM rra WHERE service = $1
+		ORDER BY lastupdated DESC LIMIT 1`, service).Scan(&rraid)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return
+	}
+	r, err := getRRA(op, rraid)
+	if err != nil {
+		return
+	}
+	rs := slib.Risk{RRA: r}
+	ret = riskRRAAssets(&rs)
+	sup, err := dependencyGroupAssets(op, r.Groups)
+	if err != nil {
+		return
+	}
+	ret = append(ret, sup...)
+	return
+}
+
+// riskInheritedScenario adds a scenario to rs using the highest probability derived from
+// the indicators for assets; from describes the dependency the assets are part of. If none
+// of the assets have current indicators no scenario is added.
+func riskInheritedScenario(op opContext, rs *slib.Risk, from string, assets []slib.Asset) error {
+	var dep slib.Risk
+	err := riskIndicatorScenarios(op, &dep, rs.UsedRRAAttrib, assets)
+	if err != nil {
+		return err
+	}
+	if len(dep.Scenarios) == 0 {
+		return nil
+	}
+	src := dep.Scenarios[0]
+	for _, x := range dep.Scenarios[1:] {
+		if x.Probability > src.Probability {
+			src = x
+		}
+	}
+	newscen := slib.RiskScenario{
+		Name:        "inherited from " + from,
+		Likelihood:  src.Likelihood,
+		DecayFactor: src.DecayFactor,
+		Probability: src.Probability,
+		Impact:      rs.UsedRRAAttrib.Impact,
+	}
+	newscen.Score = newscen.Impact * newscen.Probability
+	err = newscen.Validate()
+	if err != nil {
+		return err
+	}
+	rs.Scenarios = append(rs.Scenarios, newscen)
+	return nil
+}
+
+// riskDependencyScenarios creates a risk scenario for each asset that supports an asset group
+// which is part of the service, and for each service the service depends on. The likelihood
+// for the scenario is the highest likelihood from indicators for the dependency.
+func riskDependencyScenarios(op opContext, rs *slib.Risk) error {
+	sup, err := dependencyGroupAssets(op, rs.RRA.Groups)
+	if err != nil {
+		return err
+	}
+	for _, a := range sup {
+		err = riskInheritedScenario(op, rs, "asset "+a.Name, []slib.Asset{a})
+		if err != nil {
+			return err
+		}
+	}
+	deps, err := dependencyServices(op, rs.RRA.Name)
+	if err != nil {
+		return err
+	}
+	for _, s := range deps {
+		assets, err := dependencyServiceAssets(op, s)
+		if err != nil {
+			return err
+		}
+		err = riskInheritedScenario(op, rs, s, assets)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serviceDependencies returns all service and asset dependencies
+func serviceDependencies(rw http.ResponseWriter, req *http.Request) {
+	op := opContext{}
+	op.newContext(dbconn, false, req.RemoteAddr)
+
+	resp, err := getDependencies(op)
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "error retrieving dependencies", 500)
+		return
+	}
+	buf, err := json.Marshal(&resp)
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "error retrieving dependencies", 500)
+		return
+	}
+	fmt.Fprint(rw, string(buf))
+}
+
+// dependencyWriteResponse writes the current set of dependencies to the response
+func dependencyWriteResponse(op opContext, rw http.ResponseWriter) {
+	resp, err := getDependencies(op)
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "error updating dependency", 500)
+		return
+	}
+	buf, err := json.Marshal(&resp)
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "error updating dependency", 500)
+		return
+	}
+	fmt.Fprint(rw, string(buf))
+}
+
+// dependencyServiceRequest handles a request to add or remove a service dependency, using
+// fn to apply the change
+func dependencyServiceRequest(rw http.ResponseWriter, req *http.Request, fn func(opContext, slib.ServiceDependency) error) {
+	op := opContext{}
+	op.newContext(dbconn, false, req.RemoteAddr)
+
+	var d slib.ServiceDependency
+	err := json.NewDecoder(req.Body).Decode(&d)
+	if err == nil {
+		err = d.Validate()
+	}
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "dependency document malformed", 400)
+		return
+	}
+	err = fn(op, d)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(rw, "dependency not found", 404)
+			return
+		}
+		op.logf(err.Error())
+		http.Error(rw, "error updating dependency", 500)
+		return
+	}
+	dependencyWriteResponse(op, rw)
+}
+
+// dependencyAssetRequest handles a request to add or remove an asset dependency, using
+// fn to apply the change
+func dependencyAssetRequest(rw http.ResponseWriter, req *http.Request, fn func(opContext, slib.AssetDependency) error) {
+	op := opContext{}
+	op.newContext(dbconn, false, req.RemoteAddr)
+
+	var d slib.AssetDependency
+	err := json.NewDecoder(req.Body).Decode(&d)
+	if err == nil {
+		err = d.Validate()
+	}
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "dependency document malformed", 400)
+		return
+	}
+	err = fn(op, d)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(rw, "asset, asset group or dependency not found", 404)
+			return
+		}
+		op.logf(err.Error())
+		http.Error(rw, "error updating dependency", 500)
+		return
+	}
+	dependencyWriteResponse(op, rw)
+}
+
+// serviceAddServiceDependency is the API entry point to add a service dependency
+func serviceAddServiceDependency(rw http.ResponseWriter, req *http.Request) {
+	dependencyServiceRequest(rw, req, dependencyServiceAdd)
+}
+
+// serviceDeleteServiceDependency is the API entry point to remove a service dependency
+func serviceDeleteServiceDependency(rw http.ResponseWriter, req *http.Request) {
+	dependencyServiceRequest(rw, req, dependencyServiceDelete)
+}
+
+// serviceAddAssetDependency is the API entry point to add an asset dependency
+func serviceAddAssetDependency(rw http.ResponseWriter, req *http.Request) {
+	dependencyAssetRequest(rw, req, dependencyAssetAdd)
+}
+
+// serviceDeleteAssetDependency is the API entry point to remove an asset dependency
+func serviceDeleteAssetDependency(rw http.ResponseWriter, req *http.Request) {
+	dependencyAssetRequest(rw, req, dependencyAssetDelete)
+}
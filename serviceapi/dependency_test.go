@@ -0,0 +1,126 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor:
+// - Aaron Meihm ameihm@mozilla.com
+
+package main
+
+import (
+	"encoding/json"
+	slib "github.com/mozilla/service-map/servicelib"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDependencies(t *testing.T) {
+	client := http.Client{}
+	ind := slib.RawIndicator{
+		Type:        "hostname",
+		Name:        "dependhost.mozilla.com",
+		Zone:        "scl3",
+		EventSource: "dependtest",
+		Likelihood:  "high",
+		Timestamp:   time.Now().UTC(),
+		Details:     map[string]interface{}{"dependency": true},
+	}
+	buf, err := json.Marshal([]slib.RawIndicator{ind})
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	resp := postIndicators(t, &client, buf)
+	if resp.Accepted != 1 {
+		t.Fatalf("dependency test indicator was not accepted")
+	}
+
+	rules, err := interlinkLoadRules()
+	if err != nil {
+		t.Fatalf("interlinkLoadRules: %v", err)
+	}
+	err = interlinkRunRules(rules)
+	if err != nil {
+		t.Fatalf("interlinkRunRules: %v", err)
+	}
+
+	op := opContext{}
+	op.newContext(dbconn, false, "127.0.0.1")
+	aid := testAssetID(t, "hostname", "dependhost.mozilla.com")
+	var agid int
+	err = op.QueryRow(`SELECT assetgroupid FROM assetgroup WHERE name = 'testgroup1'`).Scan(&agid)
+	if err != nil {
+		t.Fatalf("op.QueryRow: %v", err)
+	}
+	deps, err := getDependencies(op)
+	if err != nil {
+		t.Fatalf("getDependencies: %v", err)
+	}
+	if len(deps.Services) != 1 || deps.Services[0].Service != "test service" ||
+		deps.Services[0].DependsOn != "another test service" || deps.Services[0].Manual {
+		t.Fatalf("service dependency was not created by interlink")
+	}
+	if len(deps.Assets) != 1 || deps.Assets[0].AssetID != aid ||
+		deps.Assets[0].AssetGroupID != agid {
+		t.Fatalf("asset dependency was not created by interlink")
+	}
+
+	// Inherited scenarios are only included if propagation is enabled
+	inherited := func() (ret map[string]bool) {
+		ret = make(map[string]bool)
+		risk, err := riskForRRA(op, false, 1)
+		if err != nil {
+			t.Fatalf("riskForRRA: %v", err)
+		}
+		for _, x := range risk.Scenarios {
+			ret[x.Name] = true
+		}
+		return
+	}
+	if len(inherited()) == 0 || inherited()["inherited from another test service"] {
+		t.Fatalf("inherited scenario included without propagation")
+	}
+	cfg.General.PropagateRisk = true
+	defer func() {
+		cfg.General.PropagateRisk = false
+	}()
+	scen := inherited()
+	if !scen["inherited from another test service"] ||
+		!scen["inherited from asset dependhost.mozilla.com"] {
+		t.Fatalf("risk did not include inherited scenarios")
+	}
+
+	// Dependencies added through the API; a dependency cycle should not be an issue
+	// for propagation
+	sdep := slib.ServiceDependency{Service: "another test service", DependsOn: "test service"}
+	testPostJSON(t, "/api/v1/dependency/service/add", sdep, http.StatusOK, &deps)
+	if len(deps.Services) != 2 {
+		t.Fatalf("service dependency was not added")
+	}
+	if !inherited()["inherited from another test service"] {
+		t.Fatalf("risk did not include inherited scenarios with dependency cycle")
+	}
+	testPostJSON(t, "/api/v1/dependency/service/delete", sdep, http.StatusOK, nil)
+	testPostJSON(t, "/api/v1/dependency/service/delete", sdep, http.StatusNotFound, nil)
+	testPostJSON(t, "/api/v1/dependency/service/add", slib.ServiceDependency{
+		Service: "test service", DependsOn: "test service"}, http.StatusBadRequest, nil)
+
+	adep := slib.AssetDependency{AssetID: aid, AssetGroupID: agid}
+	testPostJSON(t, "/api/v1/dependency/asset/add", adep, http.StatusOK, &deps)
+	if len(deps.Assets) != 1 || !deps.Assets[0].Manual {
+		t.Fatalf("asset dependency was not marked as manual")
+	}
+	err = interlinkRunRules(rules)
+	if err != nil {
+		t.Fatalf("interlinkRunRules: %v", err)
+	}
+	deps, err = getDependencies(op)
+	if err != nil {
+		t.Fatalf("getDependencies: %v", err)
+	}
+	if len(deps.Assets) != 1 || !deps.Assets[0].Manual {
+		t.Fatalf("manual asset dependency was not kept by interlink")
+	}
+	testPostJSON(t, "/api/v1/dependency/asset/add", slib.AssetDependency{AssetID: aid,
+		AssetGroupID: 999999}, http.StatusNotFound, nil)
+}
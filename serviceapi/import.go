@@ -0,0 +1,322 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor:
+// - Aaron Meihm ameihm@mozilla.com
+
+package main
+
+// Bulk import of assets, along with optional owner and asset group details, from an
+// inventory export. Imported owner and group details are kept with the asset, and are
+// used by interlink if no interlink rule sets an owner or group for the asset; an import
+// does not change the owner or group of an asset itself.
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	slib "github.com/mozilla/service-map/servicelib"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// importColumns maps the CSV header values accepted in an import to record fields
+var importColumns = map[string]string{
+	"asset_type":       "type",
+	"type":             "type",
+	"asset_identifier": "name",
+	"name":             "name",
+	"hostname":         "name",
+	"zone":             "zone",
+	"operator":         "operator",
+	"team":             "team",
+	"assetgroup":       "assetgroup",
+	"group":            "assetgroup",
+}
+
+// importDecodeCSV reads import records from CSV data; the first row must be a header
+// identifying the columns
+func importDecodeCSV(r io.Reader) (ret []slib.AssetImportRecord, err error) {
+	rdr := csv.NewReader(r)
+	rdr.TrimLeadingSpace = true
+	hdr, err := rdr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading csv header: %v", err)
+	}
+	cols := make([]string, len(hdr))
+	havename := false
+	for i, x := range hdr {
+		f, ok := importColumns[strings.ToLower(strings.TrimSpace(x))]
+		if !ok {
+			return nil, fmt.Errorf("unknown csv column %q", x)
+		}
+		cols[i] = f
+		if f == "name" {
+			havename = true
+		}
+	}
+	if !havename {
+		return nil, errors.New("csv header has no asset name column")
+	}
+	for {
+		row, err := rdr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var rec slib.AssetImportRecord
+		for i, x := range row {
+			x = strings.TrimSpace(x)
+			switch cols[i] {
+			case "type":
+				rec.Type = x
+			case "name":
+				rec.Name = x
+			case "zone":
+				rec.Zone = x
+			case "operator":
+				rec.Operator = x
+			case "team":
+				rec.Team = x
+			case "assetgroup":
+				rec.AssetGroup = x
+			}
+		}
+		ret = append(ret, rec)
+	}
+	return ret, nil
+}
+
+// importDecode reads import records from r in the specified format (csv or json)
+func importDecode(r io.Reader, format string) (ret []slib.AssetImportRecord, err error) {
+	switch format {
+	case "csv":
+		return importDecodeCSV(r)
+	case "json":
+		err = json.NewDecoder(r).Decode(&ret)
+		return
+	}
+	return nil, fmt.Errorf("unsupported import format %q", format)
+}
+
+// importOwnerAdd adds the owner with the specified operator and team if it does not exist,
+// so interlink can link imported assets with it
+func importOwnerAdd(op opContext, operator, team string) error {
+	_, err := op.Exec(`INSERT INTO assetowners (operator, team) VALUES ($1, $2)
+		ON CONFLICT (team, operator) DO NOTHING`, operator, team)
+	return err
+}
+
+// importAssetGroupAdd adds the asset group with the specified name if it does not exist,
+// so interlink can link imported assets with it
+func importAssetGroupAdd(op opContext, name string) error {
+	_, err := op.Exec(`INSERT INTO assetgroup (name) VALUES ($1)
+		ON CONFLICT (name) DO NOTHING`, name)
+	return err
+}
+
+// importRecord applies a single validated import record, returning the action taken
+func importRecord(op opContext, rec slib.AssetImportRecord) (action string, aid int, err error) {
+	var operator, team, group sql.NullString
+	err = op.QueryRow(`SELECT assetid, importoperator, importteam, importassetgroup
+		FROM asset WHERE assettype = $1 AND name = $2 AND zone = $3`,
+		rec.Type, rec.Name, rec.Zone).Scan(&aid, &operator, &team, &group)
+	switch err {
+	case nil:
+		// Empty values in the record leave existing values unchanged
+		if (rec.Operator == "" || (rec.Operator == operator.String && rec.Team == team.String)) &&
+			(rec.AssetGroup == "" || rec.AssetGroup == group.String) {
+			return slib.AssetImportUnchanged, aid, nil
+		}
+		action = slib.AssetImportUpdate
+	case sql.ErrNoRows:
+		// If the record matches an alias, an asset already exists under another name
+		var alid int
+		alid, err = assetIDFromAlias(op, rec.Type, rec.Name, rec.Zone)
+		if err == nil {
+			return slib.AssetImportConflict, alid, fmt.Errorf("record matches alias of asset %v", alid)
+		}
+		if err != sql.ErrNoRows {
+			return
+		}
+		err = op.QueryRow(`INSERT INTO asset (assettype, name, zone, manual, address)
+			VALUES ($1, $2, $3, TRUE, $4) RETURNING assetid`,
+			rec.Type, rec.Name, rec.Zone, assetAddress(rec.Type, rec.Name)).Scan(&aid)
+		if err != nil {
+			return
+		}
+		action = slib.AssetImportCreate
+	default:
+		return
+	}
+
+	// Only the imported details are stored here, the asset is linked with the owner and
+	// group by interlink
+	if rec.Operator != "" {
+		err = importOwnerAdd(op, rec.Operator, rec.Team)
+		if err != nil {
+			return
+		}
+		_, err = op.Exec(`UPDATE asset SET importoperator = $1, importteam = $2
+			WHERE assetid = $3`, rec.Operator, rec.Team, aid)
+		if err != nil {
+			return
+		}
+	}
+	if rec.AssetGroup != "" {
+		err = importAssetGroupAdd(op, rec.AssetGroup)
+		if err != nil {
+			return
+		}
+		_, err = op.Exec(`UPDATE asset SET importassetgroup = $1 WHERE assetid = $2`,
+			rec.AssetGroup, aid)
+	}
+	return
+}
+
+// assetImport imports recs, returning a description of the action taken for each record.
+// The import runs in a single transaction, which is rolled back if dryrun is true.
+func assetImport(op opContext, recs []slib.AssetImportRecord, dryrun bool) (ret slib.AssetImportResponse,
+	err error) {
+	ret.DryRun = dryrun
+	ret.Results = make([]slib.AssetImportResult, 0)
+	err = op.begin()
+	if err != nil {
+		return
+	}
+	seen := make(map[string]slib.AssetImportRecord)
+	for i, rec := range recs {
+		res := slib.AssetImportResult{Index: i}
+		e := rec.Validate()
+		if e == nil {
+			rec.Type, rec.Name, e = assetTypeResolve(rec.Type, rec.Name)
+		}
+		if e != nil {
+			res.Action = slib.AssetImportError
+			res.Error = e.Error()
+			ret.Add(res)
+			continue
+		}
+		res.Type, res.Name, res.Zone = rec.Type, rec.Name, rec.Zone
+		// The same asset appearing more than once is a conflict unless the details match
+		key := rec.Type + "/" + rec.Name + "/" + rec.Zone
+		if prev, ok := seen[key]; ok && prev != rec {
+			res.Action = slib.AssetImportConflict
+			res.Error = "asset appears more than once with different details"
+			ret.Add(res)
+			continue
+		}
+		seen[key] = rec
+		var aid int
+		res.Action, aid, err = importRecord(op, rec)
+		if res.Action == slib.AssetImportConflict {
+			res.Error = err.Error()
+			err = nil
+		}
+		if err != nil {
+			op.rollback()
+			return
+		}
+		res.AssetID = aid
+		ret.Add(res)
+	}
+	if dryrun {
+		err = op.rollback()
+		return
+	}
+	err = op.commit()
+	return
+}
+
+// importFormat returns the import format for a request, using the format query parameter
+// if set or otherwise the content type
+func importFormat(req *http.Request) string {
+	if v := req.FormValue("format"); v != "" {
+		return strings.ToLower(v)
+	}
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "text/csv") {
+		return "csv"
+	}
+	return "json"
+}
+
+// serviceAssetImport is the API entry point for bulk asset import. Records can be provided
+// as CSV with a header row, or as a JSON array of AssetImportRecord. If dryrun is set,
+// the import is validated and the actions that would be taken are returned without any
+// changes being made.
+func serviceAssetImport(rw http.ResponseWriter, req *http.Request) {
+	op := opContext{}
+	op.newContext(dbconn, false, req.RemoteAddr)
+
+	req.ParseForm()
+	dryrun := false
+	if v := req.FormValue("dryrun"); v != "" {
+		var err error
+		dryrun, err = strconv.ParseBool(v)
+		if err != nil {
+			http.Error(rw, "invalid dryrun value", 400)
+			return
+		}
+	}
+	recs, err := importDecode(req.Body, importFormat(req))
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "import document malformed: "+err.Error(), 400)
+		return
+	}
+	resp, err := assetImport(op, recs, dryrun)
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "error importing assets", 500)
+		return
+	}
+	op.logf("asset import (dryrun %v): %v created, %v updated, %v conflicts, %v errors",
+		dryrun, resp.Created, resp.Updated, resp.Conflicts, resp.Errors)
+	buf, err := json.Marshal(&resp)
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "error importing assets", 500)
+		return
+	}
+	fmt.Fprint(rw, string(buf))
+}
+
+// importCLI runs an asset import from a file when serviceapi is run in import mode,
+// writing the result to stdout
+func importCLI(path string, format string, dryrun bool) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	if format == "" {
+		format = "json"
+		if strings.HasSuffix(strings.ToLower(path), ".csv") {
+			format = "csv"
+		}
+	}
+	recs, err := importDecode(fd, format)
+	if err != nil {
+		return err
+	}
+	op := opContext{}
+	op.newContext(dbconn, false, "import")
+	resp, err := assetImport(op, recs, dryrun)
+	if err != nil {
+		return err
+	}
+	buf, err := json.MarshalIndent(&resp, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "%v\n", string(buf))
+	return nil
+}
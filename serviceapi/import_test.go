@@ -0,0 +1,117 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor:
+// - Aaron Meihm ameihm@mozilla.com
+
+package main
+
+import (
+	"encoding/json"
+	slib "github.com/mozilla/service-map/servicelib"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAssetImport(t *testing.T) {
+	client := http.Client{}
+
+	csvdata := `hostname,zone,operator,team,assetgroup
+importhost1.mozilla.com,scl3,importop,importteam,importgroup
+IMPORTHOST1.mozilla.com.,scl3,importop,otherteam,
+bad host,scl3,,,
+testhost2.mozilla.com,scl3,,,
+`
+	rr, err := client.Post(testserv.URL+"/api/v1/assets/import?dryrun=true", "text/csv",
+		strings.NewReader(csvdata))
+	if err != nil {
+		t.Fatalf("client.Post: %v", err)
+	}
+	if rr.StatusCode != http.StatusOK {
+		t.Fatalf("import response code %v", rr.StatusCode)
+	}
+	buf, err := ioutil.ReadAll(rr.Body)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll: %v", err)
+	}
+	rr.Body.Close()
+	var resp slib.AssetImportResponse
+	err = json.Unmarshal(buf, &resp)
+	if err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	if !resp.DryRun || resp.Created != 1 || resp.Conflicts != 1 || resp.Errors != 1 ||
+		resp.Unchanged != 1 || len(resp.Results) != 4 {
+		t.Fatalf("unexpected dry run import results")
+	}
+	if resp.Results[1].Action != slib.AssetImportConflict ||
+		resp.Results[2].Action != slib.AssetImportError {
+		t.Fatalf("unexpected dry run import record results")
+	}
+	op := opContext{}
+	op.newContext(dbconn, false, "127.0.0.1")
+	var n int
+	err = op.QueryRow(`SELECT COUNT(*) FROM asset WHERE name = 'importhost1.mozilla.com'`).Scan(&n)
+	if err != nil {
+		t.Fatalf("op.QueryRow: %v", err)
+	}
+	if n != 0 {
+		t.Fatalf("dry run import created asset")
+	}
+
+	recs := []slib.AssetImportRecord{
+		{Name: "importhost1.mozilla.com", Zone: "scl3", Operator: "importop",
+			Team: "importteam", AssetGroup: "importgroup"},
+		{Name: "testhost1.mozilla.com", Zone: "scl3", Operator: "importop",
+			Team: "importteam"},
+	}
+	testPostJSON(t, "/api/v1/assets/import", recs, http.StatusOK, &resp)
+	if resp.DryRun || resp.Created != 1 || resp.Updated != 1 {
+		t.Fatalf("unexpected import results")
+	}
+
+	// The import itself only stores the imported details, so an existing owner is kept
+	// until interlink runs
+	a, err := getAssetBase(op, resp.Results[1].AssetID)
+	if err != nil {
+		t.Fatalf("getAssetBase: %v", err)
+	}
+	if a.Owner.Operator != "operator" || a.Owner.Team != "testservice" {
+		t.Fatalf("import replaced owner of existing asset")
+	}
+
+	// The imported owner and group should be used for the imported asset once interlink
+	// runs; assets matching an ownership rule keep the owner from the rule
+	rules, err := interlinkLoadRules()
+	if err != nil {
+		t.Fatalf("interlinkLoadRules: %v", err)
+	}
+	err = interlinkRunRules(rules)
+	if err != nil {
+		t.Fatalf("interlinkRunRules: %v", err)
+	}
+	a, err = getAssetBase(op, resp.Results[0].AssetID)
+	if err != nil {
+		t.Fatalf("getAssetBase: %v", err)
+	}
+	if !a.Manual || a.Owner.Operator != "importop" || a.Owner.Team != "importteam" {
+		t.Fatalf("imported asset had unexpected owner")
+	}
+	ag, err := getAssetGroup(op, a.AssetGroupID)
+	if err != nil {
+		t.Fatalf("getAssetGroup: %v", err)
+	}
+	if ag.Name != "importgroup" {
+		t.Fatalf("imported asset had unexpected asset group")
+	}
+	a, err = getAssetBase(op, resp.Results[1].AssetID)
+	if err != nil {
+		t.Fatalf("getAssetBase: %v", err)
+	}
+	if a.Owner.Operator != "operator" || a.Owner.Team != "testservice" {
+		t.Fatalf("imported owner replaced owner from interlink rule")
+	}
+}
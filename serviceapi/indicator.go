@@ -8,11 +8,21 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
 	slib "github.com/mozilla/service-map/servicelib"
+	"io"
 	"net/http"
+	"reflect"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
 )
 
 // serviceIndicator processes a new indicator being sent to serviceapi by
@@ -33,58 +43,475 @@ func serviceIndicator(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 	err = indicator.Validate()
+	if err == nil {
+		err = indicatorResolveType(&indicator)
+	}
 	if err != nil {
 		op.logf(err.Error())
 		http.Error(rw, "indicator document malformed", 400)
 		return
 	}
+	err = indicatorValidateDetails(indicator.EventSource, indicator.Details)
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "indicator details do not match schema: "+err.Error(), 400)
+		return
+	}
 
+	// Store the indicator and update the asset in a transaction
+	err = op.begin()
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "error processing indicator", 500)
+		return
+	}
 	asset, err := assetFromIndicator(op, indicator)
 	if err != nil {
+		op.rollback()
 		op.logf(err.Error())
 		http.Error(rw, "error processing indicator", 500)
 		return
 	}
-	err = asset.Validate()
+	op.logf("adding new indicator for asset %v (%v)", asset.ID, indicator.EventSource)
+	resp := slib.IndicatorResponse{IndicatorID: indicator.IndicatorID}
+	resp.ID, resp.Duplicate, err = indicatorInsert(op, indicator, asset.ID)
 	if err != nil {
+		op.rollback()
 		op.logf(err.Error())
+		if err == errIndicatorConflict {
+			http.Error(rw, err.Error(), 409)
+			return
+		}
 		http.Error(rw, "error processing indicator", 500)
 		return
 	}
-	detailsbuf, err := json.Marshal(indicator.Details)
+	err = op.commit()
 	if err != nil {
 		op.logf(err.Error())
 		http.Error(rw, "error processing indicator", 500)
 		return
 	}
-	op.logf("adding new indicator for asset %v (%v)", asset.ID, indicator.EventSource)
-	_, err = op.Exec(`INSERT INTO indicator
-		(timestamp, event_source, likelihood_indicator, assetid, details)
-		VALUES ($1, $2, $3, $4, $5)`,
-		indicator.Timestamp, indicator.EventSource, indicator.Likelihood,
-		asset.ID, string(detailsbuf))
+	if resp.Duplicate {
+		op.logf("indicator %v already exists as %v", resp.IndicatorID, resp.ID)
+	}
+	buf, err := json.Marshal(&resp)
 	if err != nil {
 		op.logf(err.Error())
 		http.Error(rw, "error processing indicator", 500)
 		return
 	}
+	fmt.Fprint(rw, string(buf))
+}
+
+// serviceIndicators processes a batch of indicators being sent to serviceapi by an
+// event publisher. The request body can either be a JSON array of RawIndicators, or
+// a stream of newline delimited RawIndicator documents. The response includes a
+// result for each indicator in the batch, so a publisher can resubmit only the
+// indicators that failed. Batches with more than general..indicatorbatchmax entries are
+// rejected.
+func serviceIndicators(rw http.ResponseWriter, req *http.Request) {
+	op := opContext{}
+	op.newContext(dbconn, false, req.RemoteAddr)
+
+	limit := cfg.General.IndicatorBatchMax
+	if limit <= 0 {
+		limit = indicatorDefaultBatchMax
+	}
+	items, err := indicatorsDecode(req.Body, limit)
+	if err != nil {
+		op.logf(err.Error())
+		if err == errIndicatorBatchTooLarge {
+			http.Error(rw, fmt.Sprintf("indicator batch exceeds %v entries", limit), 413)
+			return
+		}
+		http.Error(rw, "indicator batch malformed", 400)
+		return
+	}
+	op.logf("processing indicator batch with %v entries", len(items))
+	resp := slib.IndicatorsResponse{}
+	resp.Results = indicatorsInsert(req.RemoteAddr, items)
+	for _, x := range resp.Results {
+		if x.Accepted() {
+			resp.Accepted++
+		} else {
+			resp.Failed++
+		}
+	}
+	buf, err := json.Marshal(&resp)
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "error processing indicator batch", 500)
+		return
+	}
+	fmt.Fprint(rw, string(buf))
+}
+
+// indicatorsDecode reads a batch of raw indicator documents from r. The batch can
+// either be a JSON array, or newline delimited JSON. The individual documents are
+// returned undecoded so errors can be reported for each indicator in the batch. If limit
+// is greater than zero, errIndicatorBatchTooLarge is returned once the batch is found to
+// have more than limit entries.
+func indicatorsDecode(r io.Reader, limit int) (ret []json.RawMessage, err error) {
+	rdr := bufio.NewReader(r)
+	for {
+		var b byte
+		b, err = rdr.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				return ret, errors.New("empty indicator batch")
+			}
+			return
+		}
+		if unicode.IsSpace(rune(b)) {
+			continue
+		}
+		err = rdr.UnreadByte()
+		if err != nil {
+			return
+		}
+		if b == '[' {
+			return indicatorsDecodeArray(rdr, limit)
+		}
+		break
+	}
+	scnr := bufio.NewScanner(rdr)
+	scnr.Buffer(make([]byte, 0, 64*1024), indicatorMaxLine)
+	for scnr.Scan() {
+		buf := bytes.TrimSpace(scnr.Bytes())
+		if len(buf) == 0 {
+			continue
+		}
+		if limit > 0 && len(ret) == limit {
+			return nil, errIndicatorBatchTooLarge
+		}
+		ret = append(ret, json.RawMessage(append([]byte(nil), buf...)))
+	}
+	err = scnr.Err()
+	return
+}
+
+// indicatorsDecodeArray reads a batch of raw indicator documents from a JSON array in r,
+// one element at a time so an oversized batch can be rejected without reading all of it
+func indicatorsDecodeArray(r io.Reader, limit int) (ret []json.RawMessage, err error) {
+	dec := json.NewDecoder(r)
+	_, err = dec.Token()
+	if err != nil {
+		return
+	}
+	ret = make([]json.RawMessage, 0)
+	for dec.More() {
+		if limit > 0 && len(ret) == limit {
+			return nil, errIndicatorBatchTooLarge
+		}
+		var m json.RawMessage
+		err = dec.Decode(&m)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, m)
+	}
+	_, err = dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// indicatorErrProcessing is the error reported for an indicator in a batch that was
+// valid, but could not be stored
+const indicatorErrProcessing = "error processing indicator"
+
+// indicatorDefaultBatchMax is the largest number of entries accepted in an indicator batch
+// submission if general..indicatorbatchmax is not set
+const indicatorDefaultBatchMax = 10000
+
+// errIndicatorBatchTooLarge is returned by indicatorsDecode if a batch has too many entries
+var errIndicatorBatchTooLarge = errors.New("indicator batch too large")
+
+// indicatorMaxLine is the longest line we will accept in a newline delimited
+// indicator batch
+const indicatorMaxLine = 4 * 1024 * 1024
+
+// indicatorsInsert validates and stores each indicator in items, returning a result
+// for each entry. Indicators are written in transactions of at most
+// general..indicatorchunksize entries (or a single transaction if this is not set); a
+// savepoint is used for each indicator so a failure only affects the indicator that
+// caused it.
+func indicatorsInsert(rhost string, items []json.RawMessage) (ret []slib.IndicatorResult) {
+	ret = make([]slib.IndicatorResult, len(items))
+	for i := range ret {
+		ret[i].Index = i
+	}
+	chunk := cfg.General.IndicatorChunkSize
+	if chunk <= 0 {
+		chunk = len(items)
+	}
+	for s := 0; s < len(items); s += chunk {
+		e := s + chunk
+		if e > len(items) {
+			e = len(items)
+		}
+		indicatorsInsertChunk(rhost, items[s:e], ret[s:e])
+	}
+	return
+}
+
+// indicatorsInsertChunk stores the indicators in items within a single transaction,
+// updating the corresponding entries in results
+func indicatorsInsertChunk(rhost string, items []json.RawMessage, results []slib.IndicatorResult) {
+	setError := func(r *slib.IndicatorResult, e string) {
+		r.Status = slib.IndicatorStatusError
+		r.ID = 0
+		r.Error = e
+	}
+
+	op := opContext{}
+	err := op.newContext(dbconn, true, rhost)
+	if err != nil {
+		logf("indicator batch: %v", err)
+		for i := range results {
+			setError(&results[i], indicatorErrProcessing)
+		}
+		return
+	}
+	// Cache the asset ID for each asset we see in the chunk, so we do not need to
+	// look up the same asset for every indicator
+	assets := make(map[string]int)
+	for i, x := range items {
+		var indicator slib.RawIndicator
+		e := json.Unmarshal(x, &indicator)
+		if e == nil {
+			e = indicator.Validate()
+		}
+		if e == nil {
+			e = indicatorResolveType(&indicator)
+		}
+		if e != nil {
+			setError(&results[i], "indicator document malformed: "+e.Error())
+			continue
+		}
+		e = indicatorValidateDetails(indicator.EventSource, indicator.Details)
+		if e != nil {
+			setError(&results[i], "indicator details do not match schema: "+e.Error())
+			continue
+		}
+		_, err = op.Exec(`SAVEPOINT indicator`)
+		if err != nil {
+			break
+		}
+		akey := indicator.Type + "/" + indicator.Name + "/" + indicator.Zone
+		aid, ok := assets[akey]
+		if !ok {
+			aid, err = assetIDFromIndicator(op, indicator)
+		}
+		dup := false
+		if err == nil {
+			results[i].ID, dup, err = indicatorInsert(op, indicator, aid)
+		}
+		if err != nil {
+			op.logf(err.Error())
+			if err == errIndicatorConflict {
+				results[i].Status = slib.IndicatorStatusConflict
+				results[i].ID = 0
+				results[i].Error = err.Error()
+			} else {
+				setError(&results[i], indicatorErrProcessing)
+			}
+			_, err = op.Exec(`ROLLBACK TO SAVEPOINT indicator`)
+			if err != nil {
+				break
+			}
+			continue
+		}
+		_, err = op.Exec(`RELEASE SAVEPOINT indicator`)
+		if err != nil {
+			break
+		}
+		assets[akey] = aid
+		if dup {
+			results[i].Status = slib.IndicatorStatusDuplicate
+		} else {
+			results[i].Status = slib.IndicatorStatusOK
+		}
+	}
+	if err == nil {
+		err = op.commit()
+	} else {
+		op.rollback()
+	}
+	if err != nil {
+		op.logf(err.Error())
+		// Nothing in this chunk was stored, so make sure no indicators are
+		// reported as successful
+		for i := range results {
+			if results[i].Accepted() {
+				setError(&results[i], indicatorErrProcessing)
+			}
+		}
+		return
+	}
+	op.logf("stored indicator batch chunk of %v entries", len(items))
+}
+
+// errIndicatorConflict is returned when an indicator could not be stored as it conflicts
+// with an existing indicator
+var errIndicatorConflict = errors.New("indicator conflicts with existing indicator")
+
+// indicatorInsert stores indicator in the database, associated with asset ID aid,
+// and returns the new indicator ID. The first and last indicator times for the asset
+// are also updated, and any labels present in the indicator details are applied.
+//
+// If the indicator includes a client supplied indicator ID and an identical indicator
+// with the same ID has already been stored, the ID of the existing indicator is returned
+// and dup will be true; this includes an identical indicator stored by a concurrent
+// submission. If an indicator with the same ID exists but differs, or the indicator
+// otherwise duplicates an existing indicator, errIndicatorConflict is returned. The
+// indicator must be stored as part of a transaction.
+func indicatorInsert(op opContext, indicator slib.RawIndicator, aid int) (ret int, dup bool, err error) {
+	detailsbuf, err := json.Marshal(indicator.Details)
+	if err != nil {
+		return
+	}
+	var clientid sql.NullString
+	if indicator.IndicatorID != "" {
+		ret, dup, err = indicatorFindExisting(op, indicator, aid, detailsbuf)
+		if err != nil || dup {
+			return
+		}
+		clientid.String = indicator.IndicatorID
+		clientid.Valid = true
+		// The same indicator may be submitted concurrently, in which case the insert
+		// fails once the other submission is stored; insert under a savepoint so the
+		// stored indicator can be compared with this one if that happens
+		_, err = op.Exec(`SAVEPOINT indicatorclientid`)
+		if err != nil {
+			return
+		}
+	}
+	err = op.QueryRow(`INSERT INTO indicator
+		(timestamp, event_source, likelihood_indicator, assetid, details, clientid)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING indicatorid`,
+		indicator.Timestamp, indicator.EventSource, indicator.Likelihood,
+		aid, string(detailsbuf), clientid).Scan(&ret)
+	if err != nil {
+		if e, ok := err.(*pq.Error); !ok || e.Code != pqUniqueViolation {
+			return
+		}
+		if !clientid.Valid {
+			return 0, false, errIndicatorConflict
+		}
+		_, err = op.Exec(`ROLLBACK TO SAVEPOINT indicatorclientid`)
+		if err != nil {
+			return
+		}
+		ret, dup, err = indicatorFindExisting(op, indicator, aid, detailsbuf)
+		if err == nil && !dup {
+			// The violation was not caused by an indicator with the same ID
+			err = errIndicatorConflict
+		}
+		return
+	}
+	if clientid.Valid {
+		_, err = op.Exec(`RELEASE SAVEPOINT indicatorclientid`)
+		if err != nil {
+			return
+		}
+	}
+	err = assetUpdateSeen(op, aid, indicator)
+	if err != nil {
+		return
+	}
+	err = assetLabelsFromIndicator(op, aid, indicator)
+	return
+}
+
+// pqUniqueViolation is the Postgres error code returned when a unique constraint is violated
+const pqUniqueViolation = "23505"
+
+// pqInvalidRegularExpression is the Postgres error code returned when a regular expression
+// used in a query is not valid
+const pqInvalidRegularExpression = "2201B"
+
+// indicatorFindExisting looks for an existing indicator with the same client supplied
+// indicator ID as indicator. If one exists and is identical, the existing indicator ID is
+// returned and dup will be true. If one exists but differs errIndicatorConflict is returned.
+func indicatorFindExisting(op opContext, indicator slib.RawIndicator, aid int,
+	detailsbuf []byte) (ret int, dup bool, err error) {
+	var (
+		eaid        int
+		esrc, elike string
+		ets         time.Time
+		edetails    []byte
+	)
+	err = op.QueryRow(`SELECT indicatorid, assetid, event_source, timestamp,
+		likelihood_indicator, details FROM indicator WHERE clientid = $1`,
+		indicator.IndicatorID).Scan(&ret, &eaid, &esrc, &ets, &elike, &edetails)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, false, nil
+		}
+		return
+	}
+	// Compare the details after decoding both documents, as the stored details may
+	// be formatted differently than what was submitted
+	var d1, d2 interface{}
+	err = json.Unmarshal(edetails, &d1)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(detailsbuf, &d2)
+	if err != nil {
+		return
+	}
+	// Timestamps are stored with microsecond precision
+	if eaid != aid || esrc != indicator.EventSource || elike != indicator.Likelihood ||
+		!ets.Equal(indicator.Timestamp.Round(time.Microsecond)) ||
+		!reflect.DeepEqual(d1, d2) {
+		return 0, false, errIndicatorConflict
+	}
+	return ret, true, nil
 }
 
 // getAsset returns asset ID aid from the database
 func getAsset(op opContext, aid int) (ret slib.Asset, err error) {
+	ret, err = getAssetBase(op, aid)
+	if err != nil {
+		return
+	}
+	// Add the most recent indicators for the asset
+	ret.Indicators, err = assetGetIndicators(op, ret)
+	if err != nil {
+		return
+	}
+	ret.EventSources, err = assetGetEventSources(op, ret)
+	return
+}
+
+// getAssetBase returns asset ID aid from the database, including ownership details but
+// without any indicator information
+func getAssetBase(op opContext, aid int) (ret slib.Asset, err error) {
 	var (
 		grpid, ownid   sql.NullInt64
 		triageoverride sql.NullString
+		first, last    pq.NullTime
 	)
 
 	err = op.QueryRow(`SELECT assetid, assettype, name, zone,
-		assetgroupid, ownerid, triageoverride, lastindicator
-		FROM asset WHERE assetid = $1`, aid).Scan(&ret.ID,
+		assetgroupid, ownerid, triageoverride, firstindicator, lastindicator,
+		manual, state FROM asset WHERE assetid = $1`, aid).Scan(&ret.ID,
 		&ret.Type, &ret.Name, &ret.Zone,
-		&grpid, &ownid, &triageoverride, &ret.LastIndicator)
+		&grpid, &ownid, &triageoverride, &first, &last, &ret.Manual, &ret.State)
 	if err != nil {
 		return
 	}
+	// Manually registered assets will not have indicator times until an indicator
+	// is received for the asset
+	if first.Valid {
+		ret.FirstIndicator = first.Time
+	}
+	if last.Valid {
+		ret.LastIndicator = last.Time
+	}
 	if grpid.Valid {
 		ret.AssetGroupID = int(grpid.Int64)
 	}
@@ -101,17 +528,72 @@ func getAsset(op opContext, aid int) (ret slib.Asset, err error) {
 	} else {
 		ret.Owner.TriageKey = ret.Owner.Operator + "-" + ret.Owner.Team
 	}
-	// Add the most recent indicators for the asset
-	ret.Indicators, err = assetGetIndicators(op, ret)
+	ret.Aliases, err = assetGetAliases(op, ret)
+	if err != nil {
+		return
+	}
+	ret.Labels, err = assetGetLabels(op, ret)
+	if err != nil {
+		return
+	}
+	ret.MappedAssets, err = assetGetMapped(op, ret)
 	return
 }
 
+// assetGetEventSources returns the event sources that have reported indicators for an
+// asset, along with the first and last time an indicator was received from each
+func assetGetEventSources(op opContext, a slib.Asset) (ret []slib.AssetEventSource, err error) {
+	rows, err := op.Query(`SELECT event_source, firstindicator, lastindicator
+		FROM asseteventsource WHERE assetid = $1 ORDER BY event_source`, a.ID)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		var nsrc slib.AssetEventSource
+		err = rows.Scan(&nsrc.EventSource, &nsrc.FirstIndicator, &nsrc.LastIndicator)
+		if err != nil {
+			rows.Close()
+			return
+		}
+		ret = append(ret, nsrc)
+	}
+	err = rows.Err()
+	return
+}
+
+// assetUpdateSeen updates the first and last indicator times for asset ID aid, both
+// for the asset and the event source the indicator is from. A decommissioned asset is
+// made active again if the indicator is newer than any previous indicator for it.
+func assetUpdateSeen(op opContext, aid int, indicator slib.RawIndicator) error {
+	_, err := op.Exec(`UPDATE asset SET
+		state = CASE WHEN state = $1 AND
+			(lastindicator IS NULL OR lastindicator < $2)
+			THEN $3 ELSE state END,
+		firstindicator = LEAST(firstindicator, $2),
+		lastindicator = GREATEST(lastindicator, $2)
+		WHERE assetid = $4`, slib.AssetStateDecommissioned, indicator.Timestamp,
+		slib.AssetStateActive, aid)
+	if err != nil {
+		return err
+	}
+	_, err = op.Exec(`INSERT INTO asseteventsource
+		(assetid, event_source, firstindicator, lastindicator)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (assetid, event_source) DO UPDATE SET
+		firstindicator = LEAST(asseteventsource.firstindicator, EXCLUDED.firstindicator),
+		lastindicator = GREATEST(asseteventsource.lastindicator, EXCLUDED.lastindicator)`,
+		aid, indicator.EventSource, indicator.Timestamp, indicator.Timestamp)
+	return err
+}
+
 // getAssetByHost returns any hostname type assets from the database where the hostname
-// matches hn
+// or an alias of the asset matches hn
 func getAssetHostname(op opContext, hn string) (ret []slib.Asset, err error) {
 	hn = strings.ToLower(hn)
 	rows, err := op.Query(`SELECT assetid FROM asset WHERE
-		name = $1 AND assettype = 'hostname'`, hn)
+		name = $1 AND assettype = 'hostname'
+		UNION SELECT assetid FROM assetalias WHERE
+		name = $1 AND assettype = 'hostname' ORDER BY assetid`, hn)
 	if err != nil {
 		return
 	}
@@ -136,7 +618,8 @@ func getAssetHostname(op opContext, hn string) (ret []slib.Asset, err error) {
 // assetGetIndicators returns a list of the most recent indicators for each distinct
 // event source for an asset
 func assetGetIndicators(op opContext, a slib.Asset) (ret []slib.Indicator, err error) {
-	rows, err := op.Query(`SELECT x.timestamp, x.event_source, x.likelihood_indicator, x.details
+	rows, err := op.Query(`SELECT x.indicatorid, x.clientid, x.timestamp, x.event_source,
+		x.likelihood_indicator, x.details
 		FROM indicator x INNER JOIN
 		(SELECT event_source, MAX(timestamp) FROM indicator WHERE assetid = $1
 		GROUP BY event_source) y
@@ -145,17 +628,127 @@ func assetGetIndicators(op opContext, a slib.Asset) (ret []slib.Indicator, err e
 		return
 	}
 	for rows.Next() {
-		var (
-			newind  slib.Indicator
-			details []byte
-		)
-		err = rows.Scan(&newind.Timestamp, &newind.EventSource, &newind.Likelihood,
-			&details)
+		var newind slib.Indicator
+		newind, err = scanIndicator(rows)
 		if err != nil {
 			rows.Close()
 			return
 		}
-		err = json.Unmarshal(details, &newind.Details)
+		ret = append(ret, newind)
+	}
+	err = rows.Err()
+	return
+}
+
+// scanIndicator returns an indicator from the current row in rows, where the row
+// contains indicatorid, clientid, timestamp, event_source, likelihood_indicator and
+// details followed by any columns to be stored in extra
+func scanIndicator(rows *sql.Rows, extra ...interface{}) (ret slib.Indicator, err error) {
+	var (
+		details  []byte
+		clientid sql.NullString
+	)
+	dest := []interface{}{&ret.ID, &clientid, &ret.Timestamp, &ret.EventSource,
+		&ret.Likelihood, &details}
+	err = rows.Scan(append(dest, extra...)...)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(details, &ret.Details)
+	if err != nil {
+		return
+	}
+	ret.IndicatorID = clientid.String
+	ret.Stale = indicatorStale(ret)
+	return
+}
+
+// indicatorTTL returns the maximum age of an indicator from event source src before it
+// is considered stale, or 0 if indicators from the event source do not expire
+func indicatorTTL(src string) time.Duration {
+	v := cfg.General.IndicatorTTL
+	if es, ok := cfg.EventSource[src]; ok && es.TTL != "" {
+		v = es.TTL
+	}
+	return indicatorDuration(v)
+}
+
+// indicatorHalfLife returns the half-life used to decay the probability derived from
+// an indicator from event source src, or 0 if no decay should be applied
+func indicatorHalfLife(src string) time.Duration {
+	v := cfg.General.IndicatorHalfLife
+	if es, ok := cfg.EventSource[src]; ok && es.HalfLife != "" {
+		v = es.HalfLife
+	}
+	return indicatorDuration(v)
+}
+
+// indicatorDuration converts a duration configuration value, returning 0 if the value
+// is unset
+func indicatorDuration(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	// Values are checked when the configuration is validated
+	ret, _ := time.ParseDuration(v)
+	return ret
+}
+
+// indicatorStale returns true if indicator i has exceeded the TTL configured for
+// its event source
+func indicatorStale(i slib.Indicator) bool {
+	ttl := indicatorTTL(i.EventSource)
+	if ttl == 0 {
+		return false
+	}
+	return i.Timestamp.Before(time.Now().Add(-1 * ttl))
+}
+
+// indicatorHistoryFilter describes the criteria used to select indicators from the
+// indicator history for an asset
+type indicatorHistoryFilter struct {
+	since       time.Time
+	until       time.Time
+	eventSource string
+	limit       int
+	offset      int
+}
+
+// assetGetIndicatorHistory returns all indicators stored for asset ID aid which match
+// filter f, most recent first. The total number of indicators matching the filter
+// (ignoring the limit and offset) is also returned.
+func assetGetIndicatorHistory(op opContext, aid int, f indicatorHistoryFilter) (ret []slib.Indicator,
+	total int, err error) {
+	ret = make([]slib.Indicator, 0)
+	where := "assetid = $1"
+	args := []interface{}{aid}
+	if !f.since.IsZero() {
+		args = append(args, f.since)
+		where += fmt.Sprintf(" AND timestamp >= $%v", len(args))
+	}
+	if !f.until.IsZero() {
+		args = append(args, f.until)
+		where += fmt.Sprintf(" AND timestamp <= $%v", len(args))
+	}
+	if f.eventSource != "" {
+		args = append(args, f.eventSource)
+		where += fmt.Sprintf(" AND event_source = $%v", len(args))
+	}
+	err = op.QueryRow(`SELECT COUNT(*) FROM indicator WHERE `+where, args...).Scan(&total)
+	if err != nil {
+		return
+	}
+	args = append(args, f.limit, f.offset)
+	rows, err := op.Query(fmt.Sprintf(`SELECT indicatorid, clientid, timestamp, event_source,
+		likelihood_indicator, details FROM indicator WHERE %v
+		ORDER BY timestamp DESC, indicatorid DESC LIMIT $%v OFFSET $%v`,
+		where, len(args)-1, len(args)), args...)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		var newind slib.Indicator
+		newind, err = scanIndicator(rows)
 		if err != nil {
 			rows.Close()
 			return
@@ -166,31 +759,137 @@ func assetGetIndicators(op opContext, a slib.Asset) (ret []slib.Indicator, err e
 	return
 }
 
+// Default and maximum number of entries returned in a single page of indicator
+// history
+const (
+	indicatorHistoryDefaultLimit = 100
+	indicatorHistoryMaxLimit     = 1000
+)
+
+// serviceAssetIndicators is the API entry point to retrieve the indicator history for
+// an asset. Results can be filtered by time range and event source, and are paginated
+// using the limit and offset parameters.
+func serviceAssetIndicators(rw http.ResponseWriter, req *http.Request) {
+	op := opContext{}
+	op.newContext(dbconn, false, req.RemoteAddr)
+
+	req.ParseForm()
+	aid, err := strconv.Atoi(req.FormValue("id"))
+	if err != nil {
+		op.logf("invalid asset id")
+		http.Error(rw, "invalid asset id", 400)
+		return
+	}
+	f := indicatorHistoryFilter{
+		eventSource: req.FormValue("event_source"),
+		limit:       indicatorHistoryDefaultLimit,
+	}
+	if v := req.FormValue("since"); v != "" {
+		f.since, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(rw, "invalid since value", 400)
+			return
+		}
+	}
+	if v := req.FormValue("until"); v != "" {
+		f.until, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(rw, "invalid until value", 400)
+			return
+		}
+	}
+	if v := req.FormValue("limit"); v != "" {
+		f.limit, err = strconv.Atoi(v)
+		if err != nil || f.limit < 1 || f.limit > indicatorHistoryMaxLimit {
+			http.Error(rw, "invalid limit value", 400)
+			return
+		}
+	}
+	if v := req.FormValue("offset"); v != "" {
+		f.offset, err = strconv.Atoi(v)
+		if err != nil || f.offset < 0 {
+			http.Error(rw, "invalid offset value", 400)
+			return
+		}
+	}
+
+	var exists bool
+	err = op.QueryRow(`SELECT EXISTS (SELECT 1 FROM asset WHERE assetid = $1)`,
+		aid).Scan(&exists)
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "error retrieving indicators", 500)
+		return
+	}
+	if !exists {
+		http.Error(rw, "asset not found", 404)
+		return
+	}
+
+	resp := slib.AssetIndicatorsResponse{
+		AssetID: aid,
+		Limit:   f.limit,
+		Offset:  f.offset,
+	}
+	resp.Indicators, resp.Total, err = assetGetIndicatorHistory(op, aid, f)
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "error retrieving indicators", 500)
+		return
+	}
+	buf, err := json.Marshal(&resp)
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "error retrieving indicators", 500)
+		return
+	}
+	fmt.Fprint(rw, string(buf))
+}
+
 // assetFromIndicator returns an asset given the information present in a RawIndicator, if
 // an existing asset is present in the database this will be returned, otherwise a new asset
 // is created and returned.
 func assetFromIndicator(op opContext, indicator slib.RawIndicator) (ret slib.Asset, err error) {
-	var aid int
+	aid, err := assetIDFromIndicator(op, indicator)
+	if err != nil {
+		return
+	}
+	return getAsset(op, aid)
+}
+
+// assetIDFromIndicator returns the ID of the asset described in a RawIndicator, creating
+// the asset if it does not already exist
+func assetIDFromIndicator(op opContext, indicator slib.RawIndicator) (aid int, err error) {
 	err = op.QueryRow(`SELECT assetid FROM asset
 		WHERE assettype = $1 AND name = $2 AND zone = $3`,
 		indicator.Type, indicator.Name, indicator.Zone).Scan(&aid)
 	if err == nil {
 		op.logf("making use of existing asset id %v", aid)
-		return getAsset(op, aid)
+		return
+	}
+	if err != sql.ErrNoRows {
+		return
+	}
+	// If the indicator matches an alias, use the asset the alias refers to
+	aid, err = assetIDFromAlias(op, indicator.Type, indicator.Name, indicator.Zone)
+	if err == nil {
+		op.logf("making use of asset id %v via alias", aid)
+		return
 	}
 	if err != sql.ErrNoRows {
 		return
 	}
 	// Otherwise, add the new asset and return it
 	err = op.QueryRow(`INSERT INTO asset
-		(assettype, name, zone, lastindicator)
-		VALUES ($1, $2, $3, $4) RETURNING assetid`,
+		(assettype, name, zone, firstindicator, lastindicator, address)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING assetid`,
 		indicator.Type, indicator.Name, indicator.Zone,
-		indicator.Timestamp).Scan(&aid)
+		indicator.Timestamp, indicator.Timestamp,
+		assetAddress(indicator.Type, indicator.Name)).Scan(&aid)
 	if err != nil {
 		return
 	}
 	op.logf("created new asset for %v/%v/%v (%v)", indicator.Name, indicator.Type,
 		indicator.Zone, aid)
-	return getAsset(op, aid)
+	return
 }
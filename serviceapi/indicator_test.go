@@ -8,8 +8,14 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	slib "github.com/mozilla/service-map/servicelib"
+	"io/ioutil"
+	"net/http"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestGetAsset(t *testing.T) {
@@ -84,3 +90,310 @@ func TestGetAssetHostname(t *testing.T) {
 		t.Fatalf("getAsset: unexpected asset triage key")
 	}
 }
+
+func TestServiceIndicators(t *testing.T) {
+	client := http.Client{}
+
+	ind := slib.RawIndicator{
+		Type:        "hostname",
+		Name:        "batchhost1.mozilla.com",
+		Zone:        "scl3",
+		EventSource: "batchtest",
+		Likelihood:  "low",
+		Details:     map[string]string{"noop": "batch indicator"},
+	}
+	ts := time.Now().Add(-1 * time.Minute)
+
+	// Submit a JSON array with a valid indicator, an indicator that is missing
+	// an event source, and a second valid indicator
+	var batch []slib.RawIndicator
+	for i := 0; i < 3; i++ {
+		ind.Timestamp = ts.Add(time.Duration(i) * time.Second)
+		batch = append(batch, ind)
+	}
+	batch[1].EventSource = ""
+	sendbuf, err := json.Marshal(batch)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	resp := postIndicators(t, &client, sendbuf)
+	if resp.Accepted != 2 || resp.Failed != 1 || len(resp.Results) != 3 {
+		t.Fatalf("indicator batch had unexpected result counts")
+	}
+	if resp.Results[0].Status != slib.IndicatorStatusOK || resp.Results[0].ID == 0 {
+		t.Fatalf("indicator batch entry 0 should have been stored")
+	}
+	if resp.Results[1].Status != slib.IndicatorStatusError || resp.Results[1].Error == "" {
+		t.Fatalf("indicator batch entry 1 should have failed")
+	}
+	if resp.Results[2].Status != slib.IndicatorStatusOK {
+		t.Fatalf("indicator batch entry 2 should have been stored")
+	}
+
+	// Submit the same indicators again as NDJSON; the first and last now conflict
+	// with existing indicators and should fail, and the malformed line should not
+	// prevent the new indicator from being stored
+	ind.Timestamp = ts.Add(10 * time.Second)
+	var lines []string
+	for _, x := range []slib.RawIndicator{batch[0], ind, batch[2]} {
+		buf, err := json.Marshal(x)
+		if err != nil {
+			t.Fatalf("json.Marshal: %v", err)
+		}
+		lines = append(lines, string(buf))
+	}
+	lines = append(lines, "{not json")
+	resp = postIndicators(t, &client, []byte(strings.Join(lines, "\n")))
+	if len(resp.Results) != 4 {
+		t.Fatalf("indicator batch had unexpected number of results")
+	}
+	if resp.Results[0].Status != slib.IndicatorStatusConflict {
+		t.Fatalf("duplicate indicator should have conflicted")
+	}
+	if resp.Results[1].Status != slib.IndicatorStatusOK {
+		t.Fatalf("new indicator in batch should have been stored")
+	}
+	if resp.Results[3].Status != slib.IndicatorStatusError {
+		t.Fatalf("malformed indicator should have failed")
+	}
+
+	// A body that is not an indicator batch should be rejected entirely
+	rr, err := client.Post(testserv.URL+"/api/v1/indicators", "application/json",
+		bytes.NewReader([]byte("   ")))
+	if err != nil {
+		t.Fatalf("client.Post: %v", err)
+	}
+	if rr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("empty indicator batch response code %v", rr.StatusCode)
+	}
+	rr.Body.Close()
+
+	// Batches with more entries than the configured maximum should be rejected entirely,
+	// in either format
+	cfg.General.IndicatorBatchMax = 2
+	defer func() {
+		cfg.General.IndicatorBatchMax = 0
+	}()
+	for _, buf := range [][]byte{sendbuf, []byte(strings.Join(lines, "\n"))} {
+		rr, err = client.Post(testserv.URL+"/api/v1/indicators", "application/json",
+			bytes.NewReader(buf))
+		if err != nil {
+			t.Fatalf("client.Post: %v", err)
+		}
+		if rr.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Fatalf("oversized indicator batch response code %v", rr.StatusCode)
+		}
+		rr.Body.Close()
+	}
+}
+
+func postIndicators(t *testing.T, client *http.Client, buf []byte) (ret slib.IndicatorsResponse) {
+	rr, err := client.Post(testserv.URL+"/api/v1/indicators", "application/json",
+		bytes.NewReader(buf))
+	if err != nil {
+		t.Fatalf("client.Post: %v", err)
+	}
+	if rr.StatusCode != http.StatusOK {
+		t.Fatalf("indicator batch response code %v", rr.StatusCode)
+	}
+	rbuf, err := ioutil.ReadAll(rr.Body)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll: %v", err)
+	}
+	rr.Body.Close()
+	err = json.Unmarshal(rbuf, &ret)
+	if err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	return
+}
+
+func TestServiceAssetIndicators(t *testing.T) {
+	client := http.Client{}
+
+	// The first asset in service1 has 10 indicators from each of two event sources
+	var atab = []struct {
+		query string
+		total int
+		count int
+	}{
+		{"id=1", 20, 20},
+		{"id=1&event_source=testing", 10, 10},
+		{"id=1&event_source=testing&limit=4&offset=8", 10, 2},
+		{"id=1&since=" + time.Now().Add(time.Hour).UTC().Format(time.RFC3339), 0, 0},
+		{"id=1&until=" + time.Now().Add(time.Hour).UTC().Format(time.RFC3339), 20, 20},
+	}
+	for _, x := range atab {
+		rr, err := client.Get(testserv.URL + "/api/v1/asset/indicators?" + x.query)
+		if err != nil {
+			t.Fatalf("client.Get: %v", err)
+		}
+		if rr.StatusCode != http.StatusOK {
+			t.Fatalf("asset indicators response code %v", rr.StatusCode)
+		}
+		buf, err := ioutil.ReadAll(rr.Body)
+		if err != nil {
+			t.Fatalf("ioutil.ReadAll: %v", err)
+		}
+		rr.Body.Close()
+		var resp slib.AssetIndicatorsResponse
+		err = json.Unmarshal(buf, &resp)
+		if err != nil {
+			t.Fatalf("json.Unmarshal: %v", err)
+		}
+		if resp.Total != x.total || len(resp.Indicators) != x.count {
+			t.Fatalf("asset indicators %q returned unexpected number of indicators", x.query)
+		}
+		for i := 1; i < len(resp.Indicators); i++ {
+			if resp.Indicators[i].Timestamp.After(resp.Indicators[i-1].Timestamp) {
+				t.Fatalf("asset indicators were not ordered by time")
+			}
+		}
+	}
+
+	rr, err := client.Get(testserv.URL + "/api/v1/asset/indicators?id=999999")
+	if err != nil {
+		t.Fatalf("client.Get: %v", err)
+	}
+	if rr.StatusCode != http.StatusNotFound {
+		t.Fatalf("asset indicators response code %v", rr.StatusCode)
+	}
+	rr.Body.Close()
+}
+
+func TestServiceIndicatorIdempotent(t *testing.T) {
+	client := http.Client{}
+
+	ind := slib.RawIndicator{
+		IndicatorID: slib.NewUUID(),
+		Type:        "hostname",
+		Name:        "idempotenthost.mozilla.com",
+		Zone:        "scl3",
+		EventSource: "idempotent",
+		Likelihood:  "high",
+		Timestamp:   time.Now().Add(-1 * time.Minute),
+		Details:     map[string]interface{}{"noop": "idempotent indicator", "count": 1},
+	}
+	post := func(i slib.RawIndicator, expect int) (ret slib.IndicatorResponse) {
+		buf, err := json.Marshal(i)
+		if err != nil {
+			t.Fatalf("json.Marshal: %v", err)
+		}
+		rr, err := client.Post(testserv.URL+"/api/v1/indicator", "application/json",
+			bytes.NewReader(buf))
+		if err != nil {
+			t.Fatalf("client.Post: %v", err)
+		}
+		if rr.StatusCode != expect {
+			t.Fatalf("indicator response code %v", rr.StatusCode)
+		}
+		rbuf, err := ioutil.ReadAll(rr.Body)
+		if err != nil {
+			t.Fatalf("ioutil.ReadAll: %v", err)
+		}
+		rr.Body.Close()
+		if expect == http.StatusOK {
+			err = json.Unmarshal(rbuf, &ret)
+			if err != nil {
+				t.Fatalf("json.Unmarshal: %v", err)
+			}
+		}
+		return
+	}
+
+	first := post(ind, http.StatusOK)
+	if first.ID == 0 || first.Duplicate || first.IndicatorID != ind.IndicatorID {
+		t.Fatalf("indicator submission returned unexpected response")
+	}
+	// Resubmitting the same indicator should return the existing indicator
+	second := post(ind, http.StatusOK)
+	if second.ID != first.ID || !second.Duplicate {
+		t.Fatalf("duplicate indicator submission returned unexpected response")
+	}
+	// Changing the indicator but using the same ID should conflict
+	ind.Likelihood = "low"
+	post(ind, http.StatusConflict)
+	// As should a new ID for an indicator that matches an existing indicator
+	ind.Likelihood = "high"
+	ind.IndicatorID = slib.NewUUID()
+	post(ind, http.StatusConflict)
+	// An invalid ID should be rejected
+	ind.IndicatorID = "notauuid"
+	post(ind, http.StatusBadRequest)
+
+	// The duplicate should be reported in a batch as well
+	ind.IndicatorID = first.IndicatorID
+	buf, err := json.Marshal([]slib.RawIndicator{ind})
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	resp := postIndicators(t, &client, buf)
+	if resp.Accepted != 1 || resp.Results[0].Status != slib.IndicatorStatusDuplicate ||
+		resp.Results[0].ID != first.ID {
+		t.Fatalf("duplicate indicator in batch returned unexpected result")
+	}
+}
+
+func TestIndicatorInsertConcurrent(t *testing.T) {
+	ind := slib.RawIndicator{
+		IndicatorID: slib.NewUUID(),
+		Type:        "hostname",
+		Name:        "concurrenthost.mozilla.com",
+		Zone:        "scl3",
+		EventSource: "concurrent",
+		Likelihood:  "high",
+		Timestamp:   time.Now().Add(-1 * time.Minute),
+		Details:     map[string]interface{}{"noop": "concurrent indicator"},
+	}
+	op := opContext{}
+	op.newContext(dbconn, false, "127.0.0.1")
+	aid, err := assetIDFromIndicator(op, ind)
+	if err != nil {
+		t.Fatalf("assetIDFromIndicator: %v", err)
+	}
+
+	// The first submission stores the indicator, but does not commit until the second
+	// submission of the same indicator has started
+	first := opContext{}
+	err = first.newContext(dbconn, true, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("newContext: %v", err)
+	}
+	id, dup, err := indicatorInsert(first, ind, aid)
+	if err != nil || dup {
+		first.rollback()
+		t.Fatalf("indicatorInsert: unexpected result %v", err)
+	}
+	type result struct {
+		id  int
+		dup bool
+		err error
+	}
+	ch := make(chan result)
+	go func() {
+		var r result
+		second := opContext{}
+		r.err = second.newContext(dbconn, true, "127.0.0.1")
+		if r.err != nil {
+			ch <- r
+			return
+		}
+		r.id, r.dup, r.err = indicatorInsert(second, ind, aid)
+		if r.err == nil {
+			r.err = second.commit()
+		} else {
+			second.rollback()
+		}
+		ch <- r
+	}()
+	// Allow the second submission to block on the insert
+	time.Sleep(500 * time.Millisecond)
+	err = first.commit()
+	if err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	r := <-ch
+	if r.err != nil || !r.dup || r.id != id {
+		t.Fatalf("concurrent indicator submission returned unexpected result %+v", r)
+	}
+}
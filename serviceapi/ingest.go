@@ -0,0 +1,150 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor:
+// - Aaron Meihm ameihm@mozilla.com
+
+package main
+
+// Related to asynchronous ingestion of indicators from sources other than the
+// indicator API endpoints
+//
+// Each ingestion source returns messages, where each message contains one or
+// more RawIndicator documents in the same format accepted by the indicator batch
+// endpoint. Indicators are processed using the same path as the batch endpoint.
+// If a message cannot be decoded, or indicators in the message fail validation,
+// the message (or the failed indicators) are sent to the dead-letter location
+// for the source.
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ingestMessage is a message received from an ingestion source
+type ingestMessage struct {
+	id   string // Identifies the message within the source
+	body []byte // Message content
+	ref  interface{}
+}
+
+// ingestSource is implemented by each asynchronous indicator source
+type ingestSource interface {
+	// name returns a name describing the source, used in logging
+	name() string
+	// receive returns any messages currently available from the source, this may
+	// block for a period of time if the source supports waiting for messages
+	receive() ([]ingestMessage, error)
+	// done indicates processing of a message is complete, and it can be removed
+	// from the source
+	done(ingestMessage) error
+	// deadLetter stores body (the message or part of it) in the dead-letter
+	// location for the source, along with a reason describing why it could
+	// not be processed
+	deadLetter(m ingestMessage, body []byte, reason string) error
+}
+
+// ingestProcess processes a message received from src
+func ingestProcess(src ingestSource, m ingestMessage) error {
+	items, err := indicatorsDecode(bytes.NewReader(m.body), 0)
+	if err != nil {
+		logf("ingest: %v: message %v malformed: %v", src.name(), m.id, err)
+		err = src.deadLetter(m, m.body, "indicator batch malformed: "+err.Error())
+		if err != nil {
+			return err
+		}
+		return src.done(m)
+	}
+	results := indicatorsInsert(src.name(), items)
+
+	var (
+		failed  [][]byte
+		reasons []string
+	)
+	for i, x := range results {
+		if x.Accepted() {
+			continue
+		}
+		failed = append(failed, items[i])
+		reasons = append(reasons, fmt.Sprintf("%v: %v", len(failed)-1, x.Error))
+	}
+	if len(failed) == 0 {
+		logf("ingest: %v: stored %v indicators from message %v", src.name(), len(items), m.id)
+		return src.done(m)
+	}
+	// If every indicator failed and none of the failures were caused by the content
+	// of the message, the problem is likely temporary so leave the message in the
+	// source to be retried
+	transient := len(failed) == len(items)
+	for _, x := range results {
+		if x.Error != indicatorErrProcessing {
+			transient = false
+			break
+		}
+	}
+	if transient {
+		return fmt.Errorf("unable to process message %v, will retry", m.id)
+	}
+	logf("ingest: %v: %v of %v indicators in message %v failed", src.name(), len(failed),
+		len(items), m.id)
+	err = src.deadLetter(m, bytes.Join(failed, []byte("\n")), strings.Join(reasons, "\n"))
+	if err != nil {
+		return err
+	}
+	return src.done(m)
+}
+
+// ingestPoll receives and processes any available messages from src, returning the
+// number of messages that were received. If any message could not be processed, an
+// error is returned after all messages have been handled.
+func ingestPoll(src ingestSource) (int, error) {
+	msgs, err := src.receive()
+	if err != nil {
+		return 0, err
+	}
+	var ret error
+	for _, m := range msgs {
+		err = ingestProcess(src, m)
+		if err != nil {
+			logf("ingest: %v: %v", src.name(), err)
+			ret = err
+		}
+	}
+	return len(msgs), ret
+}
+
+// ingestRun continually processes messages from src, waiting for interval when no
+// messages were available
+func ingestRun(src ingestSource, interval time.Duration) {
+	logf("ingest: starting %v", src.name())
+	for {
+		// Wait before polling again if nothing was available, or if there was an
+		// error so messages that could not be processed are not retried immediately
+		n, err := ingestPoll(src)
+		if err != nil {
+			logf("ingest: %v: %v", src.name(), err)
+		}
+		if n == 0 || err != nil {
+			time.Sleep(interval)
+		}
+	}
+}
+
+// ingestSources returns the ingestion sources enabled in the configuration
+func ingestSources() (ret []ingestSource, err error) {
+	if cfg.Ingest.SQSQueueURL != "" {
+		ret = append(ret, newIngestSQS(cfg.Ingest.SQSQueueURL, cfg.Ingest.SQSDeadLetterURL,
+			cfg.Ingest.SQSRegion, cfg.Ingest.SQSEndpoint))
+	}
+	if cfg.Ingest.SpoolDir != "" {
+		s, err := newIngestSpool(cfg.Ingest.SpoolDir, cfg.Ingest.SpoolDeadLetterDir)
+		if err != nil {
+			return ret, err
+		}
+		ret = append(ret, s)
+	}
+	return
+}
@@ -0,0 +1,261 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor:
+// - Aaron Meihm ameihm@mozilla.com
+
+package main
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	slib "github.com/mozilla/service-map/servicelib"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSQSServer is a minimal stand-in for SQS, implementing the query API actions used
+// by the SQS ingestion source
+type testSQSServer struct {
+	sync.Mutex
+	pending map[string][]string     // Message bodies waiting to be received, by queue URL
+	deleted []string                // Receipt handles of deleted messages
+	sent    map[string][]url.Values // Requests for messages sent, by queue URL
+}
+
+func (s *testSQSServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	err := req.ParseForm()
+	if err != nil {
+		http.Error(rw, err.Error(), 400)
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	q := req.FormValue("QueueUrl")
+	switch req.FormValue("Action") {
+	case "ReceiveMessage":
+		fmt.Fprint(rw, "<ReceiveMessageResponse><ReceiveMessageResult>")
+		for i, b := range s.pending[q] {
+			fmt.Fprintf(rw, "<Message><MessageId>message%v</MessageId>"+
+				"<ReceiptHandle>handle%v</ReceiptHandle><MD5OfBody>%x</MD5OfBody><Body>",
+				i, i, md5.Sum([]byte(b)))
+			xml.EscapeText(rw, []byte(b))
+			fmt.Fprint(rw, "</Body></Message>")
+		}
+		delete(s.pending, q)
+		fmt.Fprint(rw, "</ReceiveMessageResult></ReceiveMessageResponse>")
+	case "DeleteMessage":
+		s.deleted = append(s.deleted, req.FormValue("ReceiptHandle"))
+		fmt.Fprint(rw, "<DeleteMessageResponse></DeleteMessageResponse>")
+	case "SendMessage":
+		s.sent[q] = append(s.sent[q], req.Form)
+		fmt.Fprintf(rw, "<SendMessageResponse><SendMessageResult>"+
+			"<MD5OfMessageBody>%x</MD5OfMessageBody><MessageId>sent%v</MessageId>"+
+			"</SendMessageResult></SendMessageResponse>",
+			md5.Sum([]byte(req.FormValue("MessageBody"))), len(s.sent[q]))
+	default:
+		http.Error(rw, "unsupported action", 400)
+	}
+}
+
+func TestIngestSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serviceapi-spool")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	src, err := newIngestSpool(dir, "")
+	if err != nil {
+		t.Fatalf("newIngestSpool: %v", err)
+	}
+
+	ind := slib.RawIndicator{
+		Type:        "hostname",
+		Name:        "spoolhost.mozilla.com",
+		Zone:        "scl3",
+		EventSource: "spool",
+		Likelihood:  "medium",
+		Timestamp:   time.Now().Add(-1 * time.Minute),
+		Details:     map[string]string{"noop": "spool indicator"},
+	}
+	var lines []string
+	for i := 0; i < 3; i++ {
+		if i == 2 {
+			// Make the last indicator invalid
+			ind.Likelihood = "invalid"
+		}
+		buf, err := json.Marshal(ind)
+		if err != nil {
+			t.Fatalf("json.Marshal: %v", err)
+		}
+		lines = append(lines, string(buf))
+		ind.Timestamp = ind.Timestamp.Add(time.Second)
+	}
+	var ftab = []struct {
+		name string
+		buf  string
+	}{
+		{"a.ndjson", strings.Join(lines, "\n")},
+		{"b.json", "[" + lines[0] + ",{"},
+		{".partial.json", lines[0]},
+		{"ignored.txt", lines[0]},
+	}
+	for _, x := range ftab {
+		err = ioutil.WriteFile(path.Join(dir, x.name), []byte(x.buf), 0644)
+		if err != nil {
+			t.Fatalf("ioutil.WriteFile: %v", err)
+		}
+	}
+
+	n, err := ingestPoll(src)
+	if err != nil {
+		t.Fatalf("ingestPoll: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("ingestPoll processed unexpected number of files")
+	}
+
+	// The valid indicators should have been stored
+	op := opContext{}
+	op.newContext(dbconn, false, "127.0.0.1")
+	var cnt int
+	err = op.QueryRow(`SELECT COUNT(*) FROM indicator WHERE event_source = 'spool'`).Scan(&cnt)
+	if err != nil {
+		t.Fatalf("op.QueryRow: %v", err)
+	}
+	if cnt != 2 {
+		t.Fatalf("spool ingestion stored unexpected number of indicators")
+	}
+
+	// Processed files should be removed, files we do not process should remain
+	var etab = []struct {
+		name   string
+		exists bool
+	}{
+		{"a.ndjson", false},
+		{"b.json", false},
+		{".partial.json", true},
+		{"ignored.txt", true},
+		{"deadletter/a.ndjson", true},
+		{"deadletter/a.ndjson.reason", true},
+		{"deadletter/b.json", true},
+		{"deadletter/b.json.reason", true},
+	}
+	for _, x := range etab {
+		_, err = os.Stat(path.Join(dir, x.name))
+		if (err == nil) != x.exists {
+			t.Fatalf("spool file %v in unexpected state", x.name)
+		}
+	}
+
+	// Only the invalid indicator should have been written to the dead-letter directory
+	buf, err := ioutil.ReadFile(path.Join(dir, "deadletter/a.ndjson"))
+	if err != nil {
+		t.Fatalf("ioutil.ReadFile: %v", err)
+	}
+	if string(buf) != lines[2] {
+		t.Fatalf("dead-letter file had unexpected content")
+	}
+}
+
+func TestIngestSQS(t *testing.T) {
+	os.Setenv("AWS_ACCESS_KEY_ID", "test")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	stub := &testSQSServer{
+		pending: make(map[string][]string),
+		sent:    make(map[string][]url.Values),
+	}
+	serv := httptest.NewServer(stub)
+	defer serv.Close()
+	queue := serv.URL + "/123456789012/indicators"
+	dlq := serv.URL + "/123456789012/indicators-dlq"
+	src := newIngestSQS(queue, dlq, "us-east-1", serv.URL)
+
+	ind := slib.RawIndicator{
+		Type:        "hostname",
+		Name:        "sqshost.mozilla.com",
+		Zone:        "scl3",
+		EventSource: "sqs",
+		Likelihood:  "medium",
+		Timestamp:   time.Now().Add(-1 * time.Minute),
+		Details:     map[string]string{"noop": "sqs indicator"},
+	}
+	var lines []string
+	for i := 0; i < 3; i++ {
+		if i == 2 {
+			// Make the last indicator invalid
+			ind.Likelihood = "invalid"
+		}
+		buf, err := json.Marshal(ind)
+		if err != nil {
+			t.Fatalf("json.Marshal: %v", err)
+		}
+		lines = append(lines, string(buf))
+		ind.Timestamp = ind.Timestamp.Add(time.Second)
+	}
+	stub.pending[queue] = []string{strings.Join(lines, "\n"), "[" + lines[0] + ",{"}
+
+	n, err := ingestPoll(src)
+	if err != nil {
+		t.Fatalf("ingestPoll: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("ingestPoll processed unexpected number of messages")
+	}
+
+	// The valid indicators should have been stored
+	op := opContext{}
+	op.newContext(dbconn, false, "127.0.0.1")
+	var cnt int
+	err = op.QueryRow(`SELECT COUNT(*) FROM indicator WHERE event_source = 'sqs'`).Scan(&cnt)
+	if err != nil {
+		t.Fatalf("op.QueryRow: %v", err)
+	}
+	if cnt != 2 {
+		t.Fatalf("sqs ingestion stored unexpected number of indicators")
+	}
+
+	// Both messages should have been removed from the queue, with the invalid indicator
+	// and the malformed message sent to the dead-letter queue
+	if len(stub.deleted) != 2 || stub.deleted[0] != "handle0" || stub.deleted[1] != "handle1" {
+		t.Fatalf("sqs messages not deleted from queue")
+	}
+	sent := stub.sent[dlq]
+	if len(stub.sent) != 1 || len(sent) != 2 {
+		t.Fatalf("sqs dead-letter queue received unexpected messages")
+	}
+	for i, x := range []string{lines[2], "[" + lines[0] + ",{"} {
+		if sent[i].Get("MessageBody") != x {
+			t.Fatalf("sqs dead-letter message %v had unexpected content", i)
+		}
+		found := false
+		for k, v := range sent[i] {
+			if strings.HasPrefix(k, "MessageAttribute.") && v[0] == "original_message_id" {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("sqs dead-letter message %v missing original message id", i)
+		}
+	}
+
+	// Nothing should remain in the queue
+	n, err = ingestPoll(src)
+	if err != nil {
+		t.Fatalf("ingestPoll: %v", err)
+	}
+	if n != 0 {
+		t.Fatalf("ingestPoll received messages from empty queue")
+	}
+}
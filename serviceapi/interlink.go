@@ -11,7 +11,10 @@ package main
 
 import (
 	"bufio"
+	"database/sql"
 	"errors"
+	slib "github.com/mozilla/service-map/servicelib"
+	"net"
 	"os"
 	"strings"
 	"time"
@@ -26,6 +29,13 @@ const (
 	websiteLinkAssetgroup
 	hostOwnership
 	ownerAdd
+	labelLinkAssetgroup
+	ipLinkAssetgroup
+	ipOwnership
+	serviceDependsService
+	hostSupportsAssetgroup
+	assetOwnership
+	assetgroupOwnership
 )
 
 // interlinkRule defines a rule in the interlink system
@@ -35,16 +45,26 @@ type interlinkRule struct {
 	srcHostMatch       string
 	srcAssetGroupMatch string
 
+	srcServiceMatch     string
 	destServiceMatch    string
 	destAssetGroupMatch string
 
 	srcWebsiteMatch  string
 	destWebsiteMatch string
 
+	srcLabelKey   string
+	srcLabelValue string
+
+	srcIPWithin string
+
+	srcAssetType  string
+	srcAssetMatch string
+
 	destOwnerMatch struct {
 		Operator string
 		Team     string
 	}
+	destOwnerContact slib.OwnerContact
 
 	destTriageOverride string
 }
@@ -66,13 +86,19 @@ func interlinkRunAssetGroupAdd(op opContext, rules []interlinkRule) error {
 			return err
 		}
 	}
-	// Remove any asset groups no longer required
+	// Remove any asset groups no longer required; groups referenced by imported assets
+	// are kept
+	imported, err := interlinkImportedNames(op, `SELECT DISTINCT importassetgroup
+		FROM asset WHERE importassetgroup IS NOT NULL`)
+	if err != nil {
+		return err
+	}
 	grps, err := getAssetGroups(op)
 	if err != nil {
 		return err
 	}
 	for _, x := range grps {
-		found := false
+		found := imported[x.Name]
 		for _, y := range rules {
 			if x.Name == y.destAssetGroupMatch {
 				found = true
@@ -93,6 +119,11 @@ func interlinkRunAssetGroupAdd(op opContext, rules []interlinkRule) error {
 		if err != nil {
 			return err
 		}
+		_, err = op.Exec(`DELETE FROM assetdependency WHERE
+			assetgroupid = $1`, x.ID)
+		if err != nil {
+			return err
+		}
 		_, err = op.Exec(`DELETE FROM assetgroup WHERE
 			assetgroupid = $1`, x.ID)
 		if err != nil {
@@ -117,13 +148,18 @@ func interlinkRunOwnerAdd(op opContext, rules []interlinkRule) error {
 			return err
 		}
 	}
-	// Remove any owners no longer required
+	// Remove any owners no longer required; owners referenced by imported assets are kept
+	imported, err := interlinkImportedNames(op, `SELECT DISTINCT importoperator || ' ' ||
+		importteam FROM asset WHERE importoperator IS NOT NULL`)
+	if err != nil {
+		return err
+	}
 	own, err := getOwners(op)
 	if err != nil {
 		return err
 	}
 	for _, x := range own {
-		found := false
+		found := imported[x.Operator+" "+x.Team]
 		for _, y := range rules {
 			if x.Team == y.destOwnerMatch.Team &&
 				x.Operator == y.destOwnerMatch.Operator {
@@ -146,12 +182,70 @@ func interlinkRunOwnerAdd(op opContext, rules []interlinkRule) error {
 			return err
 		}
 	}
+	// Contact details from the rules are replaced each time the rules are run, details
+	// set using the API take precedence
+	_, err = op.Exec(`DELETE FROM ownercontact WHERE manual = FALSE`)
+	if err != nil {
+		return err
+	}
+	for _, o := range rules {
+		c := o.destOwnerContact
+		if c == (slib.OwnerContact{}) {
+			continue
+		}
+		_, err = op.Exec(`INSERT INTO ownercontact (operator, team, email, chat,
+			escalation, description) VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (operator, team) DO NOTHING`,
+			o.destOwnerMatch.Operator, o.destOwnerMatch.Team,
+			c.Email, c.Chat, c.Escalation, c.Description)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-// interlinkHostOwnerLink links hostname type assets with owners based on host match and operator/team
+// interlinkImportedNames returns the set of names returned by query qs, which is used to
+// find owners and asset groups referenced by imported assets
+func interlinkImportedNames(op opContext, qs string) (ret map[string]bool, err error) {
+	ret = make(map[string]bool)
+	rows, err := op.Query(qs)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		var n string
+		err = rows.Scan(&n)
+		if err != nil {
+			rows.Close()
+			return
+		}
+		ret[n] = true
+	}
+	err = rows.Err()
+	return
+}
+
+// interlinkImportLink links assets with the owner and asset group provided when the asset
+// was imported, for any assets that were not linked with an owner or group by a rule
+func interlinkImportLink(op opContext) error {
+	_, err := op.Exec(`UPDATE asset SET ownerid = assetowners.ownerid
+		FROM assetowners WHERE asset.ownerid IS NULL AND
+		assetowners.operator = asset.importoperator AND
+		assetowners.team = asset.importteam`)
+	if err != nil {
+		return err
+	}
+	_, err = op.Exec(`UPDATE asset SET assetgroupid = assetgroup.assetgroupid
+		FROM assetgroup WHERE asset.assetgroupid IS NULL AND
+		assetgroup.name = asset.importassetgroup`)
+	return err
+}
+
+// interlinkHostOwnerLink links hostname type assets with owners based on host match and
+// operator/team; owners and triage key overrides are reset for all assets first
 func interlinkHostOwnerLink(op opContext, rules []interlinkRule) error {
-	_, err := op.Exec(`UPDATE asset SET ownerid = NULL`)
+	_, err := op.Exec(`UPDATE asset SET ownerid = NULL, triageoverride = NULL`)
 	if err != nil {
 		return err
 	}
@@ -186,6 +280,124 @@ func interlinkHostOwnerLink(op opContext, rules []interlinkRule) error {
 	return nil
 }
 
+// interlinkAssetOwnerLink links assets of a given type with owners based on asset name match
+// and operator/team; this is used for website ownership rules and ownership rules for any
+// other asset type, and is run after interlinkHostOwnerLink has reset owners
+func interlinkAssetOwnerLink(op opContext, rules []interlinkRule) error {
+	for _, r := range rules {
+		var triage sql.NullString
+		if r.destTriageOverride != "" {
+			triage.String = r.destTriageOverride
+			triage.Valid = true
+		}
+		_, err := op.Exec(`UPDATE asset
+			SET ownerid = (SELECT ownerid FROM assetowners
+			WHERE operator = $1 AND team = $2), triageoverride = $3 WHERE
+			name ~* $4 AND assettype = $5`,
+			r.destOwnerMatch.Operator, r.destOwnerMatch.Team, triage,
+			r.srcAssetMatch, r.srcAssetType)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// interlinkAssetGroupOwnerLink links all members of matching asset groups with owners based
+// on asset group match and operator/team. This is run once asset group linkage is complete,
+// and only applies to assets which were not linked with an owner by a more specific rule or
+// an import; if an asset is in a group matched by more than one rule, the first rule is used.
+func interlinkAssetGroupOwnerLink(op opContext, rules []interlinkRule) error {
+	for _, r := range rules {
+		var triage sql.NullString
+		if r.destTriageOverride != "" {
+			triage.String = r.destTriageOverride
+			triage.Valid = true
+		}
+		_, err := op.Exec(`UPDATE asset
+			SET ownerid = (SELECT ownerid FROM assetowners
+			WHERE operator = $1 AND team = $2), triageoverride = $3 WHERE
+			ownerid IS NULL AND assetgroupid IN (SELECT assetgroupid
+			FROM assetgroup WHERE name ~* $4)`,
+			r.destOwnerMatch.Operator, r.destOwnerMatch.Team, triage,
+			r.srcAssetGroupMatch)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// interlinkIPOwnerLink links ip type assets with owners based on the network the address
+// is within and operator/team; this is run after interlinkHostOwnerLink has reset owners
+func interlinkIPOwnerLink(op opContext, rules []interlinkRule) error {
+	for _, r := range rules {
+		_, err := op.Exec(`UPDATE asset
+			SET ownerid = (SELECT ownerid FROM assetowners
+			WHERE operator = $1 AND team = $2) WHERE
+			address <<= $3::inet AND assettype = 'ip'`,
+			r.destOwnerMatch.Operator, r.destOwnerMatch.Team,
+			r.srcIPWithin)
+		if err != nil {
+			return err
+		}
+		var triage sql.NullString
+		if r.destTriageOverride != "" {
+			triage.String = r.destTriageOverride
+			triage.Valid = true
+		}
+		_, err = op.Exec(`UPDATE asset
+			SET triageoverride = $1 WHERE
+			address <<= $2::inet AND assettype = 'ip'`,
+			triage, r.srcIPWithin)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// interlinkIPAssetGroupLink links ip type assets with asset groups based on the network
+// the address is within and asset group name
+func interlinkIPAssetGroupLink(op opContext, rules []interlinkRule) error {
+	_, err := op.Exec(`UPDATE asset SET assetgroupid = NULL WHERE assettype = 'ip'`)
+	if err != nil {
+		return err
+	}
+	for _, r := range rules {
+		_, err = op.Exec(`UPDATE asset
+			SET assetgroupid = (SELECT assetgroupid FROM assetgroup
+			WHERE name = $1) WHERE
+			address <<= $2::inet AND assettype = 'ip'`,
+			r.destAssetGroupMatch, r.srcIPWithin)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// interlinkIPMapLink links ip type assets that were not linked with an owner or asset group
+// by any other means with the owner and group of the hostname asset they are mapped to
+func interlinkIPMapLink(op opContext) error {
+	_, err := op.Exec(`UPDATE asset SET ownerid = (
+		SELECT h.ownerid FROM assetipmap m INNER JOIN asset h
+		ON m.hostassetid = h.assetid
+		WHERE m.ipassetid = asset.assetid AND h.ownerid IS NOT NULL
+		ORDER BY h.assetid LIMIT 1)
+		WHERE asset.ownerid IS NULL AND asset.assettype = 'ip'`)
+	if err != nil {
+		return err
+	}
+	_, err = op.Exec(`UPDATE asset SET assetgroupid = (
+		SELECT h.assetgroupid FROM assetipmap m INNER JOIN asset h
+		ON m.hostassetid = h.assetid
+		WHERE m.ipassetid = asset.assetid AND h.assetgroupid IS NOT NULL
+		ORDER BY h.assetid LIMIT 1)
+		WHERE asset.assetgroupid IS NULL AND asset.assettype = 'ip'`)
+	return err
+}
+
 // interlinkWebsiteAssetGroupLink links websites with asset groups based on site match and
 // system group name match
 func interlinkWebsiteAssetGroupLink(op opContext, rules []interlinkRule) error {
@@ -226,6 +438,29 @@ func interlinkHostAssetGroupLink(op opContext, rules []interlinkRule) error {
 	return nil
 }
 
+// interlinkLabelAssetGroupLink links assets of any type with asset groups based on asset
+// labels; this is run after the host, website and ip linkage, and takes precedence over it.
+// Asset groups for other asset types are only set by label rules, so are reset here.
+func interlinkLabelAssetGroupLink(op opContext, rules []interlinkRule) error {
+	_, err := op.Exec(`UPDATE asset SET assetgroupid = NULL
+		WHERE assettype NOT IN ('hostname', 'website', 'ip')`)
+	if err != nil {
+		return err
+	}
+	for _, r := range rules {
+		_, err = op.Exec(`UPDATE asset
+			SET assetgroupid = (SELECT assetgroupid FROM assetgroup
+			WHERE name = $1) WHERE
+			assetid IN (SELECT assetid FROM assetlabel
+			WHERE key = $2 AND value = $3)`,
+			r.destAssetGroupMatch, r.srcLabelKey, r.srcLabelValue)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // interlinkAssetGroupServiceLink links system groups with supported services based on group
 // and service name
 func interlinkAssetGroupServiceLink(op opContext, rules []interlinkRule) error {
@@ -271,6 +506,48 @@ func interlinkAssetGroupServiceLink(op opContext, rules []interlinkRule) error {
 	return nil
 }
 
+// interlinkServiceDependencyLink creates dependencies between services based on service
+// name; dependencies added through the API are kept
+func interlinkServiceDependencyLink(op opContext, rules []interlinkRule) error {
+	_, err := op.Exec(`DELETE FROM servicedependency WHERE manual = FALSE`)
+	if err != nil {
+		return err
+	}
+	for _, r := range rules {
+		_, err = op.Exec(`INSERT INTO servicedependency (service, dependson)
+			SELECT DISTINCT x.service, y.service FROM rra x, rra y
+			WHERE x.service ~* $1 AND y.service ~* $2 AND
+			x.service <> y.service
+			ON CONFLICT (service, dependson) DO NOTHING`,
+			r.srcServiceMatch, r.destServiceMatch)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// interlinkAssetDependencyLink creates dependencies of asset groups on hostname type assets
+// based on host match and asset group name; dependencies added through the API are kept
+func interlinkAssetDependencyLink(op opContext, rules []interlinkRule) error {
+	_, err := op.Exec(`DELETE FROM assetdependency WHERE manual = FALSE`)
+	if err != nil {
+		return err
+	}
+	for _, r := range rules {
+		_, err = op.Exec(`INSERT INTO assetdependency (assetid, assetgroupid)
+			SELECT a.assetid, g.assetgroupid FROM asset a, assetgroup g
+			WHERE a.name ~* $1 AND a.assettype = 'hostname' AND
+			g.name = $2
+			ON CONFLICT (assetid, assetgroupid) DO NOTHING`,
+			r.srcHostMatch, r.destAssetGroupMatch)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func getRulesType(rules []interlinkRule, ruletype int) (ret []interlinkRule) {
 	for _, x := range rules {
 		if x.ruletype == ruletype {
@@ -339,6 +616,28 @@ func interlinkRunRules(rules []interlinkRule) error {
 		return err
 	}
 	etim("HostOwnerLink")
+	// Run ip to owner linkage
+	stim()
+	err = interlinkIPOwnerLink(op, getRulesType(rules, ipOwnership))
+	if err != nil {
+		e := op.rollback()
+		if e != nil {
+			panic(e)
+		}
+		return err
+	}
+	etim("IPOwnerLink")
+	// Run website and other asset type to owner linkage
+	stim()
+	err = interlinkAssetOwnerLink(op, getRulesType(rules, assetOwnership))
+	if err != nil {
+		e := op.rollback()
+		if e != nil {
+			panic(e)
+		}
+		return err
+	}
+	etim("AssetOwnerLink")
 	// Run website to system group linkage
 	stim()
 	err = interlinkWebsiteAssetGroupLink(op, getRulesType(rules, websiteLinkAssetgroup))
@@ -350,6 +649,61 @@ func interlinkRunRules(rules []interlinkRule) error {
 		return err
 	}
 	etim("WebsiteAssetGroupLink")
+	// Run ip to system group linkage
+	stim()
+	err = interlinkIPAssetGroupLink(op, getRulesType(rules, ipLinkAssetgroup))
+	if err != nil {
+		e := op.rollback()
+		if e != nil {
+			panic(e)
+		}
+		return err
+	}
+	etim("IPAssetGroupLink")
+	// Run label to system group linkage
+	stim()
+	err = interlinkLabelAssetGroupLink(op, getRulesType(rules, labelLinkAssetgroup))
+	if err != nil {
+		e := op.rollback()
+		if e != nil {
+			panic(e)
+		}
+		return err
+	}
+	etim("LabelAssetGroupLink")
+	// Run linkage of imported owners and groups for assets not linked by a rule
+	stim()
+	err = interlinkImportLink(op)
+	if err != nil {
+		e := op.rollback()
+		if e != nil {
+			panic(e)
+		}
+		return err
+	}
+	etim("ImportLink")
+	// Run linkage of ip assets using the hostname assets they are mapped to
+	stim()
+	err = interlinkIPMapLink(op)
+	if err != nil {
+		e := op.rollback()
+		if e != nil {
+			panic(e)
+		}
+		return err
+	}
+	etim("IPMapLink")
+	// Run system group to owner linkage
+	stim()
+	err = interlinkAssetGroupOwnerLink(op, getRulesType(rules, assetgroupOwnership))
+	if err != nil {
+		e := op.rollback()
+		if e != nil {
+			panic(e)
+		}
+		return err
+	}
+	etim("AssetGroupOwnerLink")
 	// Run system group to service linkage
 	stim()
 	err = interlinkAssetGroupServiceLink(op, getRulesType(rules, assetgroupLinkService))
@@ -361,6 +715,28 @@ func interlinkRunRules(rules []interlinkRule) error {
 		return err
 	}
 	etim("AssetGroupServiceLink")
+	// Run service to service dependency linkage
+	stim()
+	err = interlinkServiceDependencyLink(op, getRulesType(rules, serviceDependsService))
+	if err != nil {
+		e := op.rollback()
+		if e != nil {
+			panic(e)
+		}
+		return err
+	}
+	etim("ServiceDependencyLink")
+	// Run asset to system group dependency linkage
+	stim()
+	err = interlinkAssetDependencyLink(op, getRulesType(rules, hostSupportsAssetgroup))
+	if err != nil {
+		e := op.rollback()
+		if e != nil {
+			panic(e)
+		}
+		return err
+	}
+	etim("AssetDependencyLink")
 	err = op.commit()
 	if err != nil {
 		panic(err)
@@ -368,6 +744,38 @@ func interlinkRunRules(rules []interlinkRule) error {
 	return nil
 }
 
+// interlinkValidNetwork returns true if s is a valid network in CIDR notation
+func interlinkValidNetwork(s string) bool {
+	_, _, err := net.ParseCIDR(s)
+	return err == nil
+}
+
+// interlinkParseContact parses owner contact details from the key=value tokens following
+// an add owner rule; description consumes the remainder of the rule so it can contain
+// spaces, and must be specified last
+func interlinkParseContact(tokens []string) (ret slib.OwnerContact, valid bool) {
+	for i, t := range tokens {
+		kv := strings.SplitN(t, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return ret, false
+		}
+		switch kv[0] {
+		case "email":
+			ret.Email = kv[1]
+		case "chat":
+			ret.Chat = kv[1]
+		case "escalation":
+			ret.Escalation = kv[1]
+		case "description":
+			ret.Description = strings.Join(append([]string{kv[1]}, tokens[i+1:]...), " ")
+			return ret, ret.Validate() == nil
+		default:
+			return ret, false
+		}
+	}
+	return ret, ret.Validate() == nil
+}
+
 func interlinkLoadRules() ([]interlinkRule, error) {
 	var rules []interlinkRule
 
@@ -398,11 +806,11 @@ func interlinkLoadRules() ([]interlinkRule, error) {
 			nr.ruletype = assetgroupAdd
 			nr.destAssetGroupMatch = tokens[2]
 			valid = true
-		} else if len(tokens) == 4 && tokens[0] == "add" && tokens[1] == "owner" {
+		} else if len(tokens) >= 4 && tokens[0] == "add" && tokens[1] == "owner" {
 			nr.ruletype = ownerAdd
 			nr.destOwnerMatch.Operator = tokens[2]
 			nr.destOwnerMatch.Team = tokens[3]
-			valid = true
+			nr.destOwnerContact, valid = interlinkParseContact(tokens[4:])
 		} else if len(tokens) == 3 && tokens[0] == "add" && tokens[1] == "website" {
 			nr.ruletype = websiteAdd
 			nr.destWebsiteMatch = tokens[2]
@@ -413,6 +821,49 @@ func interlinkLoadRules() ([]interlinkRule, error) {
 			nr.srcAssetGroupMatch = tokens[2]
 			nr.destServiceMatch = tokens[5]
 			valid = true
+		} else if len(tokens) >= 6 && len(tokens) <= 7 && tokens[0] == "assetgroup" &&
+			tokens[1] == "matches" && tokens[3] == "ownership" {
+			nr.ruletype = assetgroupOwnership
+			nr.srcAssetGroupMatch = tokens[2]
+			nr.destOwnerMatch.Operator = tokens[4]
+			nr.destOwnerMatch.Team = tokens[5]
+			if len(tokens) == 7 {
+				nr.destTriageOverride = tokens[6]
+			}
+			valid = true
+		} else if len(tokens) >= 6 && len(tokens) <= 7 && tokens[0] == "website" &&
+			tokens[1] == "matches" && tokens[3] == "ownership" {
+			nr.ruletype = assetOwnership
+			nr.srcAssetType = slib.AssetTypeWebsite
+			nr.srcAssetMatch = tokens[2]
+			nr.destOwnerMatch.Operator = tokens[4]
+			nr.destOwnerMatch.Team = tokens[5]
+			if len(tokens) == 7 {
+				nr.destTriageOverride = tokens[6]
+			}
+			valid = true
+		} else if len(tokens) >= 7 && len(tokens) <= 8 && tokens[0] == "asset" &&
+			tokens[2] == "matches" && tokens[4] == "ownership" {
+			nr.ruletype = assetOwnership
+			nr.srcAssetType, valid = slib.CanonicalAssetType(tokens[1])
+			nr.srcAssetMatch = tokens[3]
+			nr.destOwnerMatch.Operator = tokens[5]
+			nr.destOwnerMatch.Team = tokens[6]
+			if len(tokens) == 8 {
+				nr.destTriageOverride = tokens[7]
+			}
+		} else if len(tokens) == 6 && tokens[0] == "service" &&
+			tokens[1] == "matches" && tokens[3] == "depends" && tokens[4] == "service" {
+			nr.ruletype = serviceDependsService
+			nr.srcServiceMatch = tokens[2]
+			nr.destServiceMatch = tokens[5]
+			valid = true
+		} else if len(tokens) == 6 && tokens[0] == "host" &&
+			tokens[1] == "matches" && tokens[3] == "supports" && tokens[4] == "assetgroup" {
+			nr.ruletype = hostSupportsAssetgroup
+			nr.srcHostMatch = tokens[2]
+			nr.destAssetGroupMatch = tokens[5]
+			valid = true
 		} else if len(tokens) == 6 && tokens[0] == "host" &&
 			tokens[1] == "matches" && tokens[3] == "link" && tokens[4] == "assetgroup" {
 			nr.ruletype = hostLinkAssetgroup
@@ -435,6 +886,32 @@ func interlinkLoadRules() ([]interlinkRule, error) {
 			nr.srcWebsiteMatch = tokens[2]
 			nr.destAssetGroupMatch = tokens[5]
 			valid = true
+		} else if len(tokens) == 6 && tokens[0] == "ip" &&
+			tokens[1] == "within" && tokens[3] == "link" && tokens[4] == "assetgroup" {
+			nr.ruletype = ipLinkAssetgroup
+			nr.srcIPWithin = tokens[2]
+			nr.destAssetGroupMatch = tokens[5]
+			valid = interlinkValidNetwork(tokens[2])
+		} else if len(tokens) >= 6 && len(tokens) <= 7 && tokens[0] == "ip" &&
+			tokens[1] == "within" && tokens[3] == "ownership" {
+			nr.ruletype = ipOwnership
+			nr.srcIPWithin = tokens[2]
+			nr.destOwnerMatch.Operator = tokens[4]
+			nr.destOwnerMatch.Team = tokens[5]
+			if len(tokens) == 7 {
+				nr.destTriageOverride = tokens[6]
+			}
+			valid = interlinkValidNetwork(tokens[2])
+		} else if len(tokens) == 5 && tokens[0] == "label" &&
+			tokens[2] == "link" && tokens[3] == "assetgroup" {
+			kv := strings.SplitN(tokens[1], "=", 2)
+			if len(kv) == 2 && kv[0] != "" && kv[1] != "" {
+				nr.ruletype = labelLinkAssetgroup
+				nr.srcLabelKey = kv[0]
+				nr.srcLabelValue = kv[1]
+				nr.destAssetGroupMatch = tokens[4]
+				valid = true
+			}
 		}
 		if !valid {
 			return rules, errors.New("syntax error in interlink rules")
@@ -0,0 +1,134 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor:
+// - Aaron Meihm ameihm@mozilla.com
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	slib "github.com/mozilla/service-map/servicelib"
+	"net/http"
+)
+
+// assetAddress returns the value stored in the address column for an asset; for ip assets
+// this is the asset name (which has been normalized and is a valid address), and for other
+// types it is NULL
+func assetAddress(atype, name string) sql.NullString {
+	if atype != slib.AssetTypeIP {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: name, Valid: true}
+}
+
+// assetGetMapped returns the IDs of the assets mapped to asset a; for an ip asset these are
+// hostname assets, and for a hostname asset these are ip assets
+func assetGetMapped(op opContext, a slib.Asset) (ret []int, err error) {
+	rows, err := op.Query(`SELECT hostassetid FROM assetipmap WHERE ipassetid = $1
+		UNION SELECT ipassetid FROM assetipmap WHERE hostassetid = $1
+		ORDER BY 1`, a.ID)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		var aid int
+		err = rows.Scan(&aid)
+		if err != nil {
+			rows.Close()
+			return
+		}
+		ret = append(ret, aid)
+	}
+	err = rows.Err()
+	return
+}
+
+// errIPMapType is returned if an ip mapping refers to assets of the wrong type
+var errIPMapType = errors.New("mapping requires an ip asset and a hostname asset")
+
+// ipMapAdd maps an ip asset to a hostname asset
+func ipMapAdd(op opContext, m slib.AssetIPMapping) error {
+	for _, x := range []struct {
+		aid   int
+		atype string
+	}{
+		{m.IPAssetID, slib.AssetTypeIP},
+		{m.HostnameAssetID, slib.AssetTypeHostname},
+	} {
+		a, err := getAssetBase(op, x.aid)
+		if err != nil {
+			return err
+		}
+		if a.Type != x.atype {
+			return errIPMapType
+		}
+	}
+	_, err := op.Exec(`INSERT INTO assetipmap (ipassetid, hostassetid) VALUES ($1, $2)
+		ON CONFLICT (ipassetid, hostassetid) DO NOTHING`, m.IPAssetID, m.HostnameAssetID)
+	return err
+}
+
+// ipMapDelete removes a mapping between an ip asset and a hostname asset
+func ipMapDelete(op opContext, m slib.AssetIPMapping) error {
+	res, err := op.Exec(`DELETE FROM assetipmap WHERE ipassetid = $1 AND
+		hostassetid = $2`, m.IPAssetID, m.HostnameAssetID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ipMapRequest handles a request to add or remove a mapping between an ip asset and a
+// hostname asset, using fn to apply the change
+func ipMapRequest(rw http.ResponseWriter, req *http.Request, fn func(opContext, slib.AssetIPMapping) error) {
+	op := opContext{}
+	op.newContext(dbconn, false, req.RemoteAddr)
+
+	var m slib.AssetIPMapping
+	err := json.NewDecoder(req.Body).Decode(&m)
+	if err == nil {
+		err = m.Validate()
+	}
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "mapping document malformed", 400)
+		return
+	}
+	err = fn(op, m)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(rw, "asset or mapping not found", 404)
+			return
+		}
+		if err == errIPMapType {
+			http.Error(rw, err.Error(), 400)
+			return
+		}
+		op.logf(err.Error())
+		http.Error(rw, "error updating ip mapping", 500)
+		return
+	}
+	assetWriteResponse(op, rw, m.IPAssetID, "error updating ip mapping")
+}
+
+// serviceAddIPMap is the API entry point to map an ip asset to a hostname asset
+func serviceAddIPMap(rw http.ResponseWriter, req *http.Request) {
+	ipMapRequest(rw, req, ipMapAdd)
+}
+
+// serviceDeleteIPMap is the API entry point to remove a mapping between an ip asset and
+// a hostname asset
+func serviceDeleteIPMap(rw http.ResponseWriter, req *http.Request) {
+	ipMapRequest(rw, req, ipMapDelete)
+}
@@ -0,0 +1,105 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor:
+// - Aaron Meihm ameihm@mozilla.com
+
+package main
+
+import (
+	"encoding/json"
+	slib "github.com/mozilla/service-map/servicelib"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestIPAssets(t *testing.T) {
+	client := http.Client{}
+	now := time.Now().UTC()
+
+	var batch []slib.RawIndicator
+	for _, x := range []struct {
+		atype string
+		name  string
+	}{
+		{"ip", "10.10.1.5"},
+		{"ip", "10.20.1.5"},
+		{"ip", "10.30.1.5"},
+		{"ip", "10.40.1.500"},
+		{"hostname", "testhost9.ipmap.mozilla.com"},
+	} {
+		batch = append(batch, slib.RawIndicator{
+			Type:        x.atype,
+			Name:        x.name,
+			Zone:        "scl3",
+			EventSource: "iptest",
+			Likelihood:  "low",
+			Timestamp:   now,
+			Details:     map[string]interface{}{"ip": true},
+		})
+	}
+	buf, err := json.Marshal(batch)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	resp := postIndicators(t, &client, buf)
+	if resp.Accepted != 4 || resp.Failed != 1 {
+		t.Fatalf("unexpected ip indicator results, accepted %v failed %v",
+			resp.Accepted, resp.Failed)
+	}
+
+	hostid := testAssetID(t, "hostname", "testhost9.ipmap.mozilla.com")
+	ipid := testAssetID(t, "ip", "10.30.1.5")
+	testPostJSON(t, "/api/v1/asset/ipmap/add", slib.AssetIPMapping{IPAssetID: ipid,
+		HostnameAssetID: hostid}, http.StatusOK, nil)
+	testPostJSON(t, "/api/v1/asset/ipmap/add", slib.AssetIPMapping{IPAssetID: hostid,
+		HostnameAssetID: ipid}, http.StatusBadRequest, nil)
+
+	rules, err := interlinkLoadRules()
+	if err != nil {
+		t.Fatalf("interlinkLoadRules: %v", err)
+	}
+	err = interlinkRunRules(rules)
+	if err != nil {
+		t.Fatalf("interlinkRunRules: %v", err)
+	}
+
+	op := opContext{}
+	op.newContext(dbconn, false, "127.0.0.1")
+	get := func(id int) slib.Asset {
+		a, err := getAssetBase(op, id)
+		if err != nil {
+			t.Fatalf("getAssetBase: %v", err)
+		}
+		return a
+	}
+	var agid int
+	err = op.QueryRow(`SELECT assetgroupid FROM assetgroup WHERE name = 'testgroup3'`).Scan(&agid)
+	if err != nil {
+		t.Fatalf("op.QueryRow: %v", err)
+	}
+	if get(testAssetID(t, "ip", "10.10.1.5")).AssetGroupID != agid {
+		t.Fatalf("ip asset was not linked to asset group using network rule")
+	}
+	a := get(testAssetID(t, "ip", "10.20.1.5"))
+	if a.Owner.Operator != "operator" || a.Owner.Team != "anothertestservice" ||
+		a.Owner.TriageKey != "iptriage" {
+		t.Fatalf("ip asset was not linked to owner using network rule")
+	}
+	h := get(hostid)
+	a = get(ipid)
+	if a.Owner.Team != "testservice" || a.AssetGroupID != h.AssetGroupID ||
+		len(a.MappedAssets) != 1 || a.MappedAssets[0] != hostid {
+		t.Fatalf("ip asset did not inherit linkage from mapped hostname")
+	}
+	if len(h.MappedAssets) != 1 || h.MappedAssets[0] != ipid {
+		t.Fatalf("hostname asset did not include mapped ip asset")
+	}
+
+	testPostJSON(t, "/api/v1/asset/ipmap/delete", slib.AssetIPMapping{IPAssetID: ipid,
+		HostnameAssetID: hostid}, http.StatusOK, nil)
+	testPostJSON(t, "/api/v1/asset/ipmap/delete", slib.AssetIPMapping{IPAssetID: ipid,
+		HostnameAssetID: hostid}, http.StatusNotFound, nil)
+}
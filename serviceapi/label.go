@@ -0,0 +1,178 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor:
+// - Aaron Meihm ameihm@mozilla.com
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	slib "github.com/mozilla/service-map/servicelib"
+	"net/http"
+	"strconv"
+)
+
+// assetGetLabels returns the labels for asset a
+func assetGetLabels(op opContext, a slib.Asset) (ret map[string]string, err error) {
+	rows, err := op.Query(`SELECT key, value FROM assetlabel WHERE assetid = $1`, a.ID)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		var k, v string
+		err = rows.Scan(&k, &v)
+		if err != nil {
+			rows.Close()
+			return
+		}
+		if ret == nil {
+			ret = make(map[string]string)
+		}
+		ret[k] = v
+	}
+	err = rows.Err()
+	return
+}
+
+// assetSetLabels sets the labels in l on asset ID aid, replacing the value of any existing
+// label with the same key
+func assetSetLabels(op opContext, aid int, l map[string]string) error {
+	for k, v := range l {
+		_, err := op.Exec(`INSERT INTO assetlabel (assetid, key, value, manual)
+			VALUES ($1, $2, $3, TRUE)
+			ON CONFLICT (assetid, key) DO UPDATE SET
+			value = EXCLUDED.value, manual = TRUE`, aid, k, v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indicatorLabels returns labels extracted from the details of an indicator, using the
+// top level detail keys configured as label keys. Only string, number and boolean values
+// are used.
+func indicatorLabels(details interface{}) (ret map[string]string) {
+	m, ok := details.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	for _, k := range cfg.Labels.DetailKey {
+		var v string
+		switch x := m[k].(type) {
+		case string:
+			v = x
+		case float64:
+			v = strconv.FormatFloat(x, 'f', -1, 64)
+		case bool:
+			v = strconv.FormatBool(x)
+		default:
+			continue
+		}
+		if slib.ValidateLabel(k, v) != nil {
+			continue
+		}
+		if ret == nil {
+			ret = make(map[string]string)
+		}
+		ret[k] = v
+	}
+	return
+}
+
+// assetLabelsFromIndicator applies labels extracted from indicator to asset ID aid. Labels
+// are only applied if the indicator is the most recent indicator for the asset, and labels
+// that were set through the API are never replaced.
+func assetLabelsFromIndicator(op opContext, aid int, indicator slib.RawIndicator) error {
+	for k, v := range indicatorLabels(indicator.Details) {
+		_, err := op.Exec(`INSERT INTO assetlabel (assetid, key, value, manual)
+			SELECT $1::integer, $2::text, $3::text, FALSE WHERE EXISTS (
+				SELECT 1 FROM asset WHERE assetid = $1 AND lastindicator <= $4
+			)
+			ON CONFLICT (assetid, key) DO UPDATE SET value = EXCLUDED.value
+			WHERE assetlabel.manual = FALSE`, aid, k, v, indicator.Timestamp)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serviceSetLabels is the API entry point to set labels on an asset
+func serviceSetLabels(rw http.ResponseWriter, req *http.Request) {
+	op := opContext{}
+	op.newContext(dbconn, false, req.RemoteAddr)
+
+	var l slib.AssetLabels
+	err := json.NewDecoder(req.Body).Decode(&l)
+	if err == nil {
+		err = l.Validate()
+	}
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "label document malformed", 400)
+		return
+	}
+	err = op.begin()
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "error setting labels", 500)
+		return
+	}
+	_, err = getAssetBase(op, l.AssetID)
+	if err == nil {
+		err = assetSetLabels(op, l.AssetID, l.Labels)
+	}
+	if err != nil {
+		op.rollback()
+		if err == sql.ErrNoRows {
+			http.Error(rw, "asset not found", 404)
+			return
+		}
+		op.logf(err.Error())
+		http.Error(rw, "error setting labels", 500)
+		return
+	}
+	err = op.commit()
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "error setting labels", 500)
+		return
+	}
+	assetWriteResponse(op, rw, l.AssetID, "error setting labels")
+}
+
+// serviceDeleteLabel is the API entry point to remove a label from an asset
+func serviceDeleteLabel(rw http.ResponseWriter, req *http.Request) {
+	op := opContext{}
+	op.newContext(dbconn, false, req.RemoteAddr)
+
+	req.ParseForm()
+	aid, err := strconv.Atoi(req.FormValue("id"))
+	if err != nil {
+		http.Error(rw, "invalid asset id", 400)
+		return
+	}
+	key := req.FormValue("key")
+	if key == "" {
+		http.Error(rw, "invalid label key", 400)
+		return
+	}
+	res, err := op.Exec(`DELETE FROM assetlabel WHERE assetid = $1 AND key = $2`, aid, key)
+	if err == nil {
+		var n int64
+		n, err = res.RowsAffected()
+		if err == nil && n == 0 {
+			http.Error(rw, "label not found", 404)
+			return
+		}
+	}
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "error deleting label", 500)
+		return
+	}
+}
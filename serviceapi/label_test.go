@@ -0,0 +1,137 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor:
+// - Aaron Meihm ameihm@mozilla.com
+
+package main
+
+import (
+	"encoding/json"
+	slib "github.com/mozilla/service-map/servicelib"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAssetLabels(t *testing.T) {
+	cfg.Labels.DetailKey = []string{"env", "role"}
+	defer func() {
+		cfg.Labels.DetailKey = nil
+	}()
+	client := http.Client{}
+	now := time.Now().UTC().Truncate(time.Second)
+
+	post := func(ts time.Time, details map[string]interface{}) {
+		ind := slib.RawIndicator{
+			Type:        "hostname",
+			Name:        "labelhost.mozilla.com",
+			Zone:        "scl3",
+			EventSource: "labeltest",
+			Likelihood:  "low",
+			Timestamp:   ts,
+			Details:     details,
+		}
+		buf, err := json.Marshal([]slib.RawIndicator{ind})
+		if err != nil {
+			t.Fatalf("json.Marshal: %v", err)
+		}
+		resp := postIndicators(t, &client, buf)
+		if resp.Accepted != 1 {
+			t.Fatalf("label test indicator was not accepted")
+		}
+	}
+	labels := func() map[string]string {
+		op := opContext{}
+		op.newContext(dbconn, false, "127.0.0.1")
+		a, err := getAssetBase(op, testAssetID(t, "hostname", "labelhost.mozilla.com"))
+		if err != nil {
+			t.Fatalf("getAssetBase: %v", err)
+		}
+		return a.Labels
+	}
+
+	post(now.Add(-1*time.Hour), map[string]interface{}{"env": "staging", "role": "db",
+		"other": "ignored"})
+	l := labels()
+	if len(l) != 2 || l["env"] != "staging" || l["role"] != "db" {
+		t.Fatalf("labels were not extracted from indicator details")
+	}
+	// Labels from an indicator older than the most recent indicator are not applied
+	post(now.Add(-2*time.Hour), map[string]interface{}{"role": "web"})
+	if labels()["role"] != "db" {
+		t.Fatalf("label was applied from older indicator")
+	}
+
+	// Labels set through the API are not replaced by labels from indicators
+	aid := testAssetID(t, "hostname", "labelhost.mozilla.com")
+	testPostJSON(t, "/api/v1/asset/labels/set", slib.AssetLabels{AssetID: aid,
+		Labels: map[string]string{"env": "labeltest"}}, http.StatusOK, nil)
+	testPostJSON(t, "/api/v1/asset/labels/set", slib.AssetLabels{AssetID: aid,
+		Labels: map[string]string{"env": "has space"}}, http.StatusBadRequest, nil)
+	post(now, map[string]interface{}{"env": "staging"})
+	if labels()["env"] != "labeltest" {
+		t.Fatalf("label set through API was replaced")
+	}
+
+	// The asset should be linked to the asset group using the label rule
+	rules, err := interlinkLoadRules()
+	if err != nil {
+		t.Fatalf("interlinkLoadRules: %v", err)
+	}
+	err = interlinkRunRules(rules)
+	if err != nil {
+		t.Fatalf("interlinkRunRules: %v", err)
+	}
+	op := opContext{}
+	op.newContext(dbconn, false, "127.0.0.1")
+	a, err := getAssetBase(op, aid)
+	if err != nil {
+		t.Fatalf("getAssetBase: %v", err)
+	}
+	var agid int
+	err = op.QueryRow(`SELECT assetgroupid FROM assetgroup WHERE name = 'testgroup3'`).Scan(&agid)
+	if err != nil {
+		t.Fatalf("op.QueryRow: %v", err)
+	}
+	if a.AssetGroupID != agid {
+		t.Fatalf("asset was not linked to asset group using label")
+	}
+
+	testPostJSON(t, "/api/v1/asset/labels/delete?key=role&id="+strconv.Itoa(aid), nil,
+		http.StatusOK, nil)
+	testPostJSON(t, "/api/v1/asset/labels/delete?key=role&id="+strconv.Itoa(aid), nil,
+		http.StatusNotFound, nil)
+	if _, ok := labels()["role"]; ok {
+		t.Fatalf("label was not deleted")
+	}
+
+	// An asset of a type only linked to groups by label rules should be removed from the
+	// group once the label is removed
+	var img slib.Asset
+	testPostJSON(t, "/api/v1/asset/create", slib.Asset{Type: "container_image",
+		Name: "labelimage", Zone: "scl3"}, http.StatusOK, &img)
+	testPostJSON(t, "/api/v1/asset/labels/set", slib.AssetLabels{AssetID: img.ID,
+		Labels: map[string]string{"env": "labeltest"}}, http.StatusOK, nil)
+	group := func() int {
+		err = interlinkRunRules(rules)
+		if err != nil {
+			t.Fatalf("interlinkRunRules: %v", err)
+		}
+		a, err := getAssetBase(op, img.ID)
+		if err != nil {
+			t.Fatalf("getAssetBase: %v", err)
+		}
+		return a.AssetGroupID
+	}
+	if group() != agid {
+		t.Fatalf("container image was not linked to asset group using label")
+	}
+	testPostJSON(t, "/api/v1/asset/labels/delete?key=env&id="+strconv.Itoa(img.ID), nil,
+		http.StatusOK, nil)
+	if group() != 0 {
+		t.Fatalf("container image remained in asset group after label was removed")
+	}
+}
@@ -0,0 +1,94 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor:
+// - Aaron Meihm ameihm@mozilla.com
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	slib "github.com/mozilla/service-map/servicelib"
+	"net/http"
+	"time"
+)
+
+// assetSetState sets the lifecycle state of asset ID aid, returning sql.ErrNoRows if
+// the asset does not exist
+func assetSetState(op opContext, aid int, state string) error {
+	res, err := op.Exec(`UPDATE asset SET state = $1 WHERE assetid = $2`, state, aid)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// assetAutoDecommission marks active assets that have not had an indicator since cutoff
+// as decommissioned, returning the number of assets that were changed. Assets that have
+// never had an indicator (e.g., manually registered assets) are excluded on purpose; there
+// is nothing to indicate they have gone away, so they are only reported as stale assets.
+func assetAutoDecommission(op opContext, cutoff time.Time) (int64, error) {
+	res, err := op.Exec(`UPDATE asset SET state = $1
+		WHERE state = $2 AND lastindicator < $3`,
+		slib.AssetStateDecommissioned, slib.AssetStateActive, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func assetLifecycle() {
+	defer func() {
+		if e := recover(); e != nil {
+			logf("error in asset lifecycle routine: %v", e)
+		}
+	}()
+	op := opContext{}
+	op.newContext(dbconn, false, "lifecycle")
+	// Value is checked when the configuration is validated
+	after, _ := time.ParseDuration(cfg.General.DecommissionAfter)
+	cutoff := time.Now().UTC().Add(-1 * after)
+	n, err := assetAutoDecommission(op, cutoff)
+	if err != nil {
+		panic(err)
+	}
+	logf("lifecycle: decommissioned %v assets with no indicators since %v", n, cutoff)
+}
+
+// serviceAssetState is the API entry point to change the lifecycle state of an asset
+func serviceAssetState(rw http.ResponseWriter, req *http.Request) {
+	op := opContext{}
+	op.newContext(dbconn, false, req.RemoteAddr)
+
+	var s slib.AssetStateChange
+	err := json.NewDecoder(req.Body).Decode(&s)
+	if err == nil {
+		err = s.Validate()
+	}
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "asset state document malformed", 400)
+		return
+	}
+	err = assetSetState(op, s.AssetID, s.State)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(rw, "asset not found", 404)
+			return
+		}
+		op.logf(err.Error())
+		http.Error(rw, "error changing asset state", 500)
+		return
+	}
+	op.logf("asset %v state changed to %v", s.AssetID, s.State)
+	assetWriteResponse(op, rw, s.AssetID, "error changing asset state")
+}
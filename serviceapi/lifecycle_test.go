@@ -0,0 +1,130 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor:
+// - Aaron Meihm ameihm@mozilla.com
+
+package main
+
+import (
+	slib "github.com/mozilla/service-map/servicelib"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAssetLifecycle(t *testing.T) {
+	client := http.Client{}
+	now := time.Now().UTC().Truncate(time.Second)
+
+	testPostAssetIndicators(t, "lifecyclehost.mozilla.com", "lifecycle",
+		now.Add(-40*24*time.Hour))
+	aid := testAssetID(t, "hostname", "lifecyclehost.mozilla.com")
+
+	op := opContext{}
+	op.newContext(dbconn, false, "127.0.0.1")
+	state := func(id int) string {
+		a, err := getAssetBase(op, id)
+		if err != nil {
+			t.Fatalf("getAssetBase: %v", err)
+		}
+		return a.State
+	}
+	_, err := assetAutoDecommission(op, now.Add(-30*24*time.Hour))
+	if err != nil {
+		t.Fatalf("assetAutoDecommission: %v", err)
+	}
+	if state(aid) != slib.AssetStateDecommissioned {
+		t.Fatalf("asset was not decommissioned")
+	}
+	if state(1) != slib.AssetStateActive {
+		t.Fatalf("current asset was decommissioned")
+	}
+
+	// Decommissioned assets should not be included in the owners output
+	rr, err := client.Get(testserv.URL + "/api/v1/owners")
+	if err != nil {
+		t.Fatalf("client.Get: %v", err)
+	}
+	buf, err := ioutil.ReadAll(rr.Body)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll: %v", err)
+	}
+	rr.Body.Close()
+	if strings.Contains(string(buf), "lifecyclehost.mozilla.com") {
+		t.Fatalf("owners output included decommissioned asset")
+	}
+
+	// A new indicator should make the asset active again
+	testPostAssetIndicators(t, "lifecyclehost.mozilla.com", "lifecycle", now)
+	if state(aid) != slib.AssetStateActive {
+		t.Fatalf("asset was not made active by new indicator")
+	}
+
+	// Excluded assets remain excluded when new indicators are received
+	var a slib.Asset
+	testPostJSON(t, "/api/v1/asset/state", slib.AssetStateChange{AssetID: aid,
+		State: "Excluded"}, http.StatusOK, &a)
+	if a.State != slib.AssetStateExcluded {
+		t.Fatalf("asset state was not changed")
+	}
+	testPostAssetIndicators(t, "lifecyclehost.mozilla.com", "lifecycle", now.Add(time.Minute))
+	if state(aid) != slib.AssetStateExcluded {
+		t.Fatalf("excluded asset state was changed by new indicator")
+	}
+	testPostJSON(t, "/api/v1/asset/state", slib.AssetStateChange{AssetID: aid,
+		State: "retired"}, http.StatusBadRequest, nil)
+	testPostJSON(t, "/api/v1/asset/state", slib.AssetStateChange{AssetID: 999999,
+		State: "active"}, http.StatusNotFound, nil)
+}
+
+func TestRiskDecommissionedAssets(t *testing.T) {
+	op := opContext{}
+	op.newContext(dbconn, false, "127.0.0.1")
+	// Decommission all assets in the first service, which should remove the indicator
+	// derived risk scenarios
+	_, err := op.Exec(`UPDATE asset SET state = $1 WHERE assetgroupid = 1`,
+		slib.AssetStateDecommissioned)
+	if err != nil {
+		t.Fatalf("op.Exec: %v", err)
+	}
+	defer func() {
+		_, err := op.Exec(`UPDATE asset SET state = $1 WHERE assetgroupid = 1`,
+			slib.AssetStateActive)
+		if err != nil {
+			t.Fatalf("op.Exec: %v", err)
+		}
+	}()
+	risk, err := riskForRRA(op, false, 1)
+	if err != nil {
+		t.Fatalf("riskForRRA: %v", err)
+	}
+	for _, x := range risk.Scenarios {
+		if strings.HasPrefix(x.Name, "testing ") {
+			t.Fatalf("risk scenario was generated from decommissioned asset")
+		}
+	}
+}
+
+func TestLifecycleConfig(t *testing.T) {
+	for _, x := range []struct {
+		every, after string
+		valid        bool
+	}{
+		{"1h", "2160h", true},
+		{"1h", "-2160h", false},
+		{"1h", "0s", false},
+		{"0s", "2160h", false},
+	} {
+		c := cfg
+		c.General.DecommissionEvery = x.every
+		c.General.DecommissionAfter = x.after
+		err := c.validate()
+		if x.valid != (err == nil) {
+			t.Fatalf("validate %v/%v: unexpected result %v", x.every, x.after, err)
+		}
+	}
+}
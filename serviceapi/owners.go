@@ -9,32 +9,47 @@ package main
 
 import (
 	"database/sql"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
+	"github.com/lib/pq"
 	slib "github.com/mozilla/service-map/servicelib"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// ownerSelect is used to query owners along with any contact details for the owner
+const ownerSelect = `SELECT ownerid, o.operator, o.team,
+	COALESCE(c.email, ''), COALESCE(c.chat, ''),
+	COALESCE(c.escalation, ''), COALESCE(c.description, '')
+	FROM assetowners o LEFT OUTER JOIN ownercontact c ON
+	(o.operator = c.operator AND o.team = c.team)`
+
+// scanOwner scans an owner selected using ownerSelect
+func scanOwner(row interface {
+	Scan(...interface{}) error
+}) (ret slib.Owner, err error) {
+	err = row.Scan(&ret.ID, &ret.Operator, &ret.Team, &ret.Email, &ret.Chat,
+		&ret.Escalation, &ret.Description)
+	return
+}
+
 // getOwner returns Owner ID oid from the database
 func getOwner(op opContext, oid int) (ret slib.Owner, err error) {
-	err = op.QueryRow(`SELECT ownerid, operator, team
-		FROM assetowners WHERE ownerid = $1`, oid).Scan(&ret.ID, &ret.Operator, &ret.Team)
-	if err != nil {
-		return
-	}
-	return
+	return scanOwner(op.QueryRow(ownerSelect+` WHERE ownerid = $1`, oid))
 }
 
 // getOwners returns all owners from database
 func getOwners(op opContext) (ret []slib.Owner, err error) {
-	rows, err := op.Query(`SELECT ownerid, operator, team
-		FROM assetowners`)
+	rows, err := op.Query(ownerSelect)
 	if err != nil {
 		return
 	}
 	for rows.Next() {
 		var nown slib.Owner
-		err = rows.Scan(&nown.ID, &nown.Operator, &nown.Team)
+		nown, err = scanOwner(rows)
 		if err != nil {
 			rows.Close()
 			return ret, err
@@ -48,8 +63,205 @@ func getOwners(op opContext) (ret []slib.Owner, err error) {
 	return
 }
 
+// ownerSetContact sets the contact details for owner o, returning sql.ErrNoRows if the
+// owner does not exist. Contact details set this way take precedence over details from
+// the interlink rules.
+func ownerSetContact(op opContext, o slib.Owner) error {
+	var oid int
+	err := op.QueryRow(`SELECT ownerid FROM assetowners WHERE operator = $1 AND
+		team = $2`, o.Operator, o.Team).Scan(&oid)
+	if err != nil {
+		return err
+	}
+	_, err = op.Exec(`INSERT INTO ownercontact (operator, team, email, chat,
+		escalation, description, manual) VALUES ($1, $2, $3, $4, $5, $6, TRUE)
+		ON CONFLICT (operator, team) DO UPDATE SET email = EXCLUDED.email,
+		chat = EXCLUDED.chat, escalation = EXCLUDED.escalation,
+		description = EXCLUDED.description, manual = TRUE`,
+		o.Operator, o.Team, o.Email, o.Chat, o.Escalation, o.Description)
+	return err
+}
+
+// ownerDeleteContact removes contact details that were set for owner o using the API; if
+// the interlink rules include contact details for the owner, they are applied the next
+// time the rules are run
+func ownerDeleteContact(op opContext, o slib.Owner) error {
+	res, err := op.Exec(`DELETE FROM ownercontact WHERE operator = $1 AND
+		team = $2 AND manual = TRUE`, o.Operator, o.Team)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ownerContactRequest handles a request to set or remove owner contact details, using fn
+// to apply the change
+func ownerContactRequest(rw http.ResponseWriter, req *http.Request, fn func(opContext, slib.Owner) error) {
+	op := opContext{}
+	op.newContext(dbconn, false, req.RemoteAddr)
+
+	var o slib.Owner
+	err := json.NewDecoder(req.Body).Decode(&o)
+	if err == nil {
+		err = o.Validate()
+	}
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "owner document malformed", 400)
+		return
+	}
+	err = fn(op, o)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(rw, "owner or contact not found", 404)
+			return
+		}
+		op.logf(err.Error())
+		http.Error(rw, "error updating owner contact", 500)
+		return
+	}
+	o, err = scanOwner(op.QueryRow(ownerSelect+` WHERE o.operator = $1 AND o.team = $2`,
+		o.Operator, o.Team))
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "error updating owner contact", 500)
+		return
+	}
+	buf, err := json.Marshal(&o)
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "error updating owner contact", 500)
+		return
+	}
+	fmt.Fprint(rw, string(buf))
+}
+
+// serviceSetOwnerContact is the API entry point to set contact details for an owner
+func serviceSetOwnerContact(rw http.ResponseWriter, req *http.Request) {
+	ownerContactRequest(rw, req, ownerSetContact)
+}
+
+// serviceDeleteOwnerContact is the API entry point to remove contact details for an owner
+func serviceDeleteOwnerContact(rw http.ResponseWriter, req *http.Request) {
+	ownerContactRequest(rw, req, ownerDeleteContact)
+}
+
+// ownerLookupMax is the maximum number of hostnames and websites accepted in a bulk owner
+// lookup request
+const ownerLookupMax = 1000
+
+// ownerLookupAssets returns assets of type atype where the name of the asset or an alias
+// of the asset satisfies cond, which compares the name column with v using parameter $2.
+// If zone is set, only assets in the zone are returned. The name and short name (the
+// first label of the name) of assets and aliases are indexed, so cond should compare one
+// of these with v.
+func ownerLookupAssets(op opContext, atype, cond, v, zone string) (ret []slib.Asset, err error) {
+	rows, err := op.Query(`SELECT assetid FROM asset WHERE assetid IN (
+		SELECT assetid FROM asset WHERE assettype = $1 AND `+cond+`
+		UNION SELECT assetid FROM assetalias WHERE assettype = $1 AND `+cond+`)
+		AND ($3 = '' OR zone = $3) ORDER BY assetid`, atype, v, zone)
+	if err != nil {
+		return
+	}
+	var aids []int
+	for rows.Next() {
+		var aid int
+		err = rows.Scan(&aid)
+		if err != nil {
+			rows.Close()
+			return
+		}
+		aids = append(aids, aid)
+	}
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+	for _, aid := range aids {
+		var a slib.Asset
+		a, err = getAssetBase(op, aid)
+		if err != nil {
+			return
+		}
+		ret = append(ret, a)
+	}
+	return
+}
+
+// ownerLookupHostname returns hostname type assets matching hn, which should already be
+// normalized. If there is no exact match for hn, a fully qualified name falls back to
+// matching on the short name, and a short name falls back to matching assets with a fully
+// qualified name that starts with the short name.
+func ownerLookupHostname(op opContext, hn, zone string) (ret []slib.Asset, err error) {
+	ret, err = ownerLookupAssets(op, slib.AssetTypeHostname, "name = $2", hn, zone)
+	if err != nil || len(ret) != 0 {
+		return
+	}
+	if i := strings.Index(hn, "."); i != -1 {
+		return ownerLookupAssets(op, slib.AssetTypeHostname, "name = $2", hn[:i], zone)
+	}
+	return ownerLookupAssets(op, slib.AssetTypeHostname,
+		"name LIKE '%.%' AND split_part(name, '.', 1) = $2", hn, zone)
+}
+
+// ownerLookupWebsite returns website type assets matching u, which should already be
+// normalized. If there is no exact match for the URL, any query is removed, then path
+// components are removed from the end of the URL until a website is found or only the
+// scheme and host remain.
+func ownerLookupWebsite(op opContext, u, zone string) (ret []slib.Asset, err error) {
+	root := strings.Index(u, "://") + 3
+	for {
+		ret, err = ownerLookupAssets(op, slib.AssetTypeWebsite, "name = $2", u, zone)
+		if err != nil || len(ret) != 0 {
+			return
+		}
+		if i := strings.Index(u, "?"); i != -1 {
+			u = u[:i]
+			continue
+		}
+		i := strings.LastIndex(u, "/")
+		if i < root {
+			return
+		}
+		u = u[:i]
+	}
+}
+
+// ownerLookupResult converts the assets matched for query q into an OwnerLookupResult, or
+// sets the error in the result if err is not nil
+func ownerLookupResult(q, atype string, alist []slib.Asset, err error) (ret slib.OwnerLookupResult) {
+	ret.Query = q
+	ret.Type = atype
+	ret.Matches = make([]slib.OwnerLookupMatch, 0)
+	if err != nil {
+		ret.Error = err.Error()
+		return
+	}
+	for _, a := range alist {
+		ret.Matches = append(ret.Matches, slib.OwnerLookupMatch{
+			AssetID: a.ID,
+			Type:    a.Type,
+			Name:    a.Name,
+			Zone:    a.Zone,
+			Owner:   a.Owner,
+		})
+	}
+	return
+}
+
 // serviceHostOwner is the API entry point to fetch known ownership information
 // for a host type asset
+//
+// All assets matching the hostname are returned in the matches list, optionally limited
+// to a given zone. For existing integrated tools, the owner of the first match is also
+// returned at the top level of the response.
 func serviceHostOwner(rw http.ResponseWriter, req *http.Request) {
 	op := opContext{}
 	op.newContext(dbconn, false, req.RemoteAddr)
@@ -61,103 +273,358 @@ func serviceHostOwner(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	alist, err := getAssetHostname(op, assethostname)
+	_, hn, err := slib.NormalizeAsset(slib.AssetTypeHostname, assethostname)
+	if err != nil {
+		http.Error(rw, "no matching assets found", 404)
+		return
+	}
+	alist, err := ownerLookupHostname(op, hn, req.FormValue("zone"))
 	if err != nil {
 		op.logf(err.Error())
 		http.Error(rw, "error retrieving owner info", 500)
 		return
 	}
-
-	// XXX We only return a single owner entry here for the asset, even
-	// though getAssetHostname could return more than one asset if there are a
-	// more than one asset in the database with the same hostname but a different
-	// zone ID.
-	//
-	// This should be adjusted in the future but for now we just return the first
-	// result we get.
 	if len(alist) == 0 {
 		http.Error(rw, "no matching assets found", 404)
 		return
 	}
-	a := alist[0]
-	buf, err := json.Marshal(&a.Owner)
+	resp := slib.HostOwnerResponse{
+		Owner:   alist[0].Owner,
+		Matches: ownerLookupResult(assethostname, slib.AssetTypeHostname, alist, nil).Matches,
+	}
+	buf, err := json.Marshal(&resp)
 	if err != nil {
 		op.logf(err.Error())
 		http.Error(rw, "error retrieving owner info", 500)
 		return
 	}
-	fmt.Fprintf(rw, string(buf))
+	fmt.Fprint(rw, string(buf))
 }
 
-// serviceOwners is the API entry point to fetch raw owner map
-//
-// This is a legacy function that supports a few integrated tools, providing a
-// simple method to obtain asset ownership details.
-func serviceOwners(rw http.ResponseWriter, req *http.Request) {
+// serviceOwnerLookup is the API entry point for bulk owner lookups of hostnames and
+// websites. A result is returned for each hostname and website in the request in the order
+// they were provided; a hostname or website that can't be parsed results in an error being
+// set in the result for the entry rather than the entire request failing.
+func serviceOwnerLookup(rw http.ResponseWriter, req *http.Request) {
 	op := opContext{}
 	op.newContext(dbconn, false, req.RemoteAddr)
 
-	type respent struct {
-		name      string
-		assettype string
-		zone      string
-		operator  string
-		team      string
-		triagekey string
+	var l slib.OwnerLookup
+	err := json.NewDecoder(req.Body).Decode(&l)
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "lookup document malformed", 400)
+		return
 	}
+	if len(l.Hostnames)+len(l.Websites) > ownerLookupMax {
+		http.Error(rw, fmt.Sprintf("lookup exceeds maximum of %v entries", ownerLookupMax), 400)
+		return
+	}
+
+	resp := slib.OwnerLookupResponse{Results: make([]slib.OwnerLookupResult, 0)}
+	for _, x := range []struct {
+		atype string
+		names []string
+		fn    func(opContext, string, string) ([]slib.Asset, error)
+	}{
+		{slib.AssetTypeHostname, l.Hostnames, ownerLookupHostname},
+		{slib.AssetTypeWebsite, l.Websites, ownerLookupWebsite},
+	} {
+		for _, n := range x.names {
+			_, name, err := slib.NormalizeAsset(x.atype, n)
+			if err != nil {
+				resp.Results = append(resp.Results, ownerLookupResult(n, x.atype, nil, err))
+				continue
+			}
+			alist, err := x.fn(op, name, l.Zone)
+			if err != nil {
+				op.logf(err.Error())
+				http.Error(rw, "error retrieving owner info", 500)
+				return
+			}
+			resp.Results = append(resp.Results, ownerLookupResult(n, x.atype, alist, nil))
+		}
+	}
+	buf, err := json.Marshal(&resp)
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "error retrieving owner info", 500)
+		return
+	}
+	fmt.Fprint(rw, string(buf))
+}
+
+// getOwnerSummary returns a summary of the active assets owned by owner o, the services
+// the assets support along with the current risk for each service, and any assets which
+// have stale or high likelihood indicators
+func getOwnerSummary(op opContext, o slib.Owner) (ret slib.OwnerSummary, err error) {
+	ret.Owner = o
+	ret.Assets = make(map[string][]slib.Asset)
+	ret.Zones = make(map[string]int)
+	ret.Services = make([]slib.OwnerSummaryService, 0)
+	ret.Attention = make([]slib.OwnerSummaryAsset, 0)
+
+	rows, err := op.Query(`SELECT assetid FROM asset WHERE ownerid = $1 AND
+		state = $2 ORDER BY assettype, name`, o.ID, slib.AssetStateActive)
+	if err != nil {
+		return
+	}
+	var aids []int
+	for rows.Next() {
+		var aid int
+		err = rows.Scan(&aid)
+		if err != nil {
+			rows.Close()
+			return
+		}
+		aids = append(aids, aid)
+	}
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+	for _, aid := range aids {
+		var a slib.Asset
+		a, err = getAsset(op, aid)
+		if err != nil {
+			return
+		}
+		ret.Assets[a.Type] = append(ret.Assets[a.Type], a)
+		ret.Zones[a.Zone]++
+		flagged := slib.OwnerSummaryAsset{
+			AssetID: a.ID,
+			Type:    a.Type,
+			Name:    a.Name,
+			Zone:    a.Zone,
+		}
+		for _, i := range a.Indicators {
+			v, _ := slib.ImpactValueFromLabel(i.Likelihood)
+			if i.Stale || v >= slib.ImpactHighValue {
+				flagged.Indicators = append(flagged.Indicators, i)
+			}
+		}
+		if len(flagged.Indicators) != 0 {
+			ret.Attention = append(ret.Attention, flagged)
+		}
+	}
+
+	rows, err = op.Query(`SELECT x.rraid, x.service, COUNT(DISTINCT a.assetid)
+		FROM rra x INNER JOIN rra_assetgroup r ON x.rraid = r.rraid
+		INNER JOIN asset a ON r.assetgroupid = a.assetgroupid
+		WHERE a.ownerid = $1 AND a.state = $2 AND x.lastupdated = (
+			SELECT MAX(lastupdated) FROM rra y
+			WHERE x.service = y.service
+		) GROUP BY x.rraid, x.service ORDER BY x.service`, o.ID, slib.AssetStateActive)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		var s slib.OwnerSummaryService
+		err = rows.Scan(&s.RRAID, &s.Name, &s.Assets)
+		if err != nil {
+			rows.Close()
+			return
+		}
+		ret.Services = append(ret.Services, s)
+	}
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+	for i := range ret.Services {
+		var rs slib.Risk
+		rs, err = riskForRRA(op, true, ret.Services[i].RRAID)
+		if err != nil {
+			// A service whose risk can't be calculated, for example because the RRA
+			// has no usable attributes, is still included with unknown risk
+			op.logf("owner summary: risk for rra %v: %v", ret.Services[i].RRAID, err)
+			ret.Services[i].Risk = slib.RiskValues{
+				MedianLabel:    "unknown",
+				AverageLabel:   "unknown",
+				WorstCaseLabel: "unknown",
+				ImpactLabel:    "unknown",
+			}
+			err = nil
+			continue
+		}
+		ret.Services[i].Risk = rs.Risk
+	}
+	return
+}
+
+// serviceOwnerSummary is the API entry point to retrieve a summary of everything an
+// owner is responsible for
+func serviceOwnerSummary(rw http.ResponseWriter, req *http.Request) {
+	op := opContext{}
+	op.newContext(dbconn, false, req.RemoteAddr)
+
+	req.ParseForm()
+	operator := req.FormValue("operator")
+	team := req.FormValue("team")
+	if operator == "" || team == "" {
+		http.Error(rw, "operator and team must be specified", 400)
+		return
+	}
+	o, err := scanOwner(op.QueryRow(ownerSelect+` WHERE o.operator = $1 AND o.team = $2`,
+		operator, team))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(rw, "owner not found", 404)
+			return
+		}
+		op.logf(err.Error())
+		http.Error(rw, "error retrieving owner summary", 500)
+		return
+	}
+	o.TriageKey = o.Operator + "-" + o.Team
+	summary, err := getOwnerSummary(op, o)
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "error retrieving owner summary", 500)
+		return
+	}
+	buf, err := json.Marshal(&summary)
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "error retrieving owner summary", 500)
+		return
+	}
+	fmt.Fprint(rw, string(buf))
+}
+
+// getOwnerMap returns ownership details for all active assets, ordered by asset name
+func getOwnerMap(op opContext) (ret []slib.OwnerMapEntry, err error) {
 	var (
-		resplist       []respent
 		operator       sql.NullString
 		team           sql.NullString
 		triageoverride sql.NullString
+		grpid          sql.NullInt64
+		grpname        sql.NullString
+		last           pq.NullTime
 	)
-	rows, err := op.Query(`SELECT name, assettype,
-		zone, operator, team, triageoverride
+	rows, err := op.Query(`SELECT assetid, asset.name, assettype,
+		zone, operator, team, triageoverride, asset.assetgroupid,
+		assetgroup.name, lastindicator
 		FROM asset LEFT OUTER JOIN assetowners ON
 		(asset.ownerid = assetowners.ownerid)
-		ORDER BY name`)
+		LEFT OUTER JOIN assetgroup ON
+		(asset.assetgroupid = assetgroup.assetgroupid)
+		WHERE state = $1
+		ORDER BY asset.name`, slib.AssetStateActive)
 	if err != nil {
-		op.logf(err.Error())
-		http.Error(rw, "error retrieving owner list", 500)
 		return
 	}
 	for rows.Next() {
-		x := respent{}
-		err = rows.Scan(&x.name, &x.assettype, &x.zone,
-			&operator, &team, &triageoverride)
+		x := slib.OwnerMapEntry{}
+		err = rows.Scan(&x.AssetID, &x.Name, &x.Type, &x.Zone,
+			&operator, &team, &triageoverride, &grpid, &grpname, &last)
 		if err != nil {
 			rows.Close()
-			op.logf(err.Error())
-			http.Error(rw, "error retrieving owner list", 500)
 			return
 		}
 		if !operator.Valid {
-			x.operator = "unset"
+			x.Operator = "unset"
 		} else {
-			x.operator = operator.String
+			x.Operator = operator.String
 		}
 		if !team.Valid {
-			x.team = "unset"
+			x.Team = "unset"
 		} else {
-			x.team = team.String
+			x.Team = team.String
 		}
 		if !triageoverride.Valid {
-			x.triagekey = x.operator + "-" + x.team
+			x.TriageKey = x.Operator + "-" + x.Team
 		} else {
-			x.triagekey = triageoverride.String
+			x.TriageKey = triageoverride.String
 		}
-		resplist = append(resplist, x)
+		if grpid.Valid {
+			x.AssetGroupID = int(grpid.Int64)
+			x.AssetGroup = grpname.String
+		}
+		if last.Valid {
+			x.LastIndicator = last.Time
+		}
+		ret = append(ret, x)
 	}
 	err = rows.Err()
+	return
+}
+
+// ownerMapFormat returns the owner map format for a request, using the format query
+// parameter if set or otherwise the Accept header; the legacy text format is the default
+func ownerMapFormat(req *http.Request) string {
+	if v := req.FormValue("format"); v != "" {
+		return strings.ToLower(v)
+	}
+	accept := req.Header.Get("Accept")
+	if strings.Contains(accept, "application/json") {
+		return "json"
+	} else if strings.Contains(accept, "text/csv") {
+		return "csv"
+	}
+	return "text"
+}
+
+// serviceOwners is the API entry point to fetch raw owner map
+//
+// This was originally a legacy function that supports a few integrated tools, providing a
+// simple method to obtain asset ownership details. The legacy space separated text format
+// is still returned by default, but the map can also be requested as JSON or CSV using the
+// format parameter or Accept header.
+func serviceOwners(rw http.ResponseWriter, req *http.Request) {
+	op := opContext{}
+	op.newContext(dbconn, false, req.RemoteAddr)
+
+	req.ParseForm()
+	format := ownerMapFormat(req)
+	if format != "text" && format != "json" && format != "csv" {
+		http.Error(rw, "invalid owner map format", 400)
+		return
+	}
+	ents, err := getOwnerMap(op)
 	if err != nil {
 		op.logf(err.Error())
 		http.Error(rw, "error retrieving owner list", 500)
 		return
 	}
 
-	fmt.Fprintf(rw, "# name type zone operator team triagekey\n")
-	for _, x := range resplist {
-		fmt.Fprintf(rw, "%v %v %v %v %v %v\n", x.name, x.assettype,
-			x.zone, x.operator, x.team, x.triagekey)
+	switch format {
+	case "json":
+		resp := slib.OwnerMapResponse{Owners: ents}
+		if resp.Owners == nil {
+			resp.Owners = make([]slib.OwnerMapEntry, 0)
+		}
+		buf, err := json.Marshal(&resp)
+		if err != nil {
+			op.logf(err.Error())
+			http.Error(rw, "error retrieving owner list", 500)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(rw, string(buf))
+	case "csv":
+		rw.Header().Set("Content-Type", "text/csv")
+		w := csv.NewWriter(rw)
+		w.Write([]string{"asset_id", "asset_identifier", "asset_type", "zone",
+			"operator", "team", "triagekey", "asset_group", "last_indicator"})
+		for _, x := range ents {
+			last := ""
+			if !x.LastIndicator.IsZero() {
+				last = x.LastIndicator.UTC().Format(time.RFC3339)
+			}
+			w.Write([]string{strconv.Itoa(x.AssetID), x.Name, x.Type, x.Zone,
+				x.Operator, x.Team, x.TriageKey, x.AssetGroup, last})
+		}
+		w.Flush()
+		err = w.Error()
+		if err != nil {
+			op.logf(err.Error())
+		}
+	default:
+		fmt.Fprintf(rw, "# name type zone operator team triagekey\n")
+		for _, x := range ents {
+			fmt.Fprintf(rw, "%v %v %v %v %v %v\n", x.Name, x.Type,
+				x.Zone, x.Operator, x.Team, x.TriageKey)
+		}
 	}
 }
@@ -8,11 +8,15 @@
 package main
 
 import (
+	"database/sql"
+	"encoding/csv"
 	"encoding/json"
 	slib "github.com/mozilla/service-map/servicelib"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestServiceHostOwner(t *testing.T) {
@@ -124,3 +128,416 @@ func TestServiceHostOwnerTriageKey(t *testing.T) {
 		t.Fatalf("host get owner had unexpected triage key")
 	}
 }
+
+func TestOwnerContact(t *testing.T) {
+	client := http.Client{}
+	hostOwner := func(hn string) (ret slib.Owner) {
+		rr, err := client.Get(testserv.URL + "/api/v1/owner/hostname?hostname=" + hn)
+		if err != nil {
+			t.Fatalf("client.Get: %v", err)
+		}
+		if rr.StatusCode != http.StatusOK {
+			t.Fatalf("host get owner response code %v", rr.StatusCode)
+		}
+		buf, err := ioutil.ReadAll(rr.Body)
+		if err != nil {
+			t.Fatalf("ioutil.ReadAll: %v", err)
+		}
+		rr.Body.Close()
+		err = json.Unmarshal(buf, &ret)
+		if err != nil {
+			t.Fatalf("json.Unmarshal: %v", err)
+		}
+		return
+	}
+	interlink := func() {
+		rules, err := interlinkLoadRules()
+		if err != nil {
+			t.Fatalf("interlinkLoadRules: %v", err)
+		}
+		err = interlinkRunRules(rules)
+		if err != nil {
+			t.Fatalf("interlinkRunRules: %v", err)
+		}
+	}
+
+	// Contact details from the interlink rules
+	owner := hostOwner("testhost1.mozilla.com")
+	if owner.Email != "testservice@mozilla.com" || owner.Chat != "#testservice" ||
+		owner.Escalation != "https://oncall.mozilla.com/testservice" ||
+		owner.Description != "Test service operators" {
+		t.Fatalf("owner did not include contact details from rules")
+	}
+
+	// Contact details set using the API take precedence over the rules
+	o := slib.Owner{Operator: "operator", Team: "testservice"}
+	o.Email = "override@mozilla.com"
+	testPostJSON(t, "/api/v1/owner/contact", o, http.StatusOK, &owner)
+	if owner.Email != "override@mozilla.com" || owner.Chat != "" {
+		t.Fatalf("owner contact was not updated")
+	}
+	interlink()
+	if hostOwner("testhost1.mozilla.com").Email != "override@mozilla.com" {
+		t.Fatalf("owner contact set using API was replaced by rules")
+	}
+	testPostJSON(t, "/api/v1/owner/contact/delete", o, http.StatusOK, nil)
+	testPostJSON(t, "/api/v1/owner/contact/delete", o, http.StatusNotFound, nil)
+	interlink()
+	if hostOwner("testhost1.mozilla.com").Email != "testservice@mozilla.com" {
+		t.Fatalf("owner contact from rules was not restored")
+	}
+
+	o.Email = "not an email"
+	testPostJSON(t, "/api/v1/owner/contact", o, http.StatusBadRequest, nil)
+	o.Email = ""
+	o.Escalation = "oncall"
+	testPostJSON(t, "/api/v1/owner/contact", o, http.StatusBadRequest, nil)
+	testPostJSON(t, "/api/v1/owner/contact", slib.Owner{Operator: "operator",
+		Team: "nosuchteam"}, http.StatusNotFound, nil)
+}
+
+func TestServiceOwnersFormats(t *testing.T) {
+	client := http.Client{}
+	get := func(query string, accept string, expect int) string {
+		req, err := http.NewRequest("GET", testserv.URL+"/api/v1/owners"+query, nil)
+		if err != nil {
+			t.Fatalf("http.NewRequest: %v", err)
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		rr, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("client.Do: %v", err)
+		}
+		buf, err := ioutil.ReadAll(rr.Body)
+		if err != nil {
+			t.Fatalf("ioutil.ReadAll: %v", err)
+		}
+		rr.Body.Close()
+		if rr.StatusCode != expect {
+			t.Fatalf("owners response code %v", rr.StatusCode)
+		}
+		return string(buf)
+	}
+
+	if !strings.HasPrefix(get("", "", http.StatusOK), "# name type zone") {
+		t.Fatalf("owners did not return legacy text format by default")
+	}
+
+	var resp slib.OwnerMapResponse
+	err := json.Unmarshal([]byte(get("?format=json", "", http.StatusOK)), &resp)
+	if err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	found := false
+	for _, x := range resp.Owners {
+		if x.Name != "testhost1.mozilla.com" {
+			continue
+		}
+		found = true
+		if x.AssetID == 0 || x.Operator != "operator" || x.Team != "testservice" ||
+			x.AssetGroup != "testgroup1" || x.LastIndicator.IsZero() {
+			t.Fatalf("owners json entry had unexpected values")
+		}
+	}
+	if !found {
+		t.Fatalf("owners json did not include expected asset")
+	}
+
+	records, err := csv.NewReader(strings.NewReader(get("", "text/csv",
+		http.StatusOK))).ReadAll()
+	if err != nil {
+		t.Fatalf("csv.ReadAll: %v", err)
+	}
+	if len(records) != len(resp.Owners)+1 || records[0][0] != "asset_id" {
+		t.Fatalf("owners csv had unexpected records")
+	}
+
+	get("?format=xml", "", http.StatusBadRequest)
+}
+
+func TestOwnerLookup(t *testing.T) {
+	client := http.Client{}
+	hostOwner := func(query string, expect int) (ret slib.HostOwnerResponse) {
+		rr, err := client.Get(testserv.URL + "/api/v1/owner/hostname?" + query)
+		if err != nil {
+			t.Fatalf("client.Get: %v", err)
+		}
+		buf, err := ioutil.ReadAll(rr.Body)
+		if err != nil {
+			t.Fatalf("ioutil.ReadAll: %v", err)
+		}
+		rr.Body.Close()
+		if rr.StatusCode != expect {
+			t.Fatalf("host get owner response code %v", rr.StatusCode)
+		}
+		if expect == http.StatusOK {
+			err = json.Unmarshal(buf, &ret)
+			if err != nil {
+				t.Fatalf("json.Unmarshal: %v", err)
+			}
+		}
+		return
+	}
+
+	// Short name falls back to the fully qualified name
+	resp := hostOwner("hostname=testhost1", http.StatusOK)
+	if len(resp.Matches) != 1 || resp.Matches[0].Name != "testhost1.mozilla.com" ||
+		resp.Matches[0].Zone == "" || resp.Team != "testservice" {
+		t.Fatalf("host get owner did not fall back to fully qualified name")
+	}
+	resp = hostOwner("hostname=testhost1.mozilla.com&zone="+resp.Matches[0].Zone, http.StatusOK)
+	if len(resp.Matches) != 1 {
+		t.Fatalf("host get owner with zone returned unexpected matches")
+	}
+	hostOwner("hostname=testhost1.mozilla.com&zone=nosuchzone", http.StatusNotFound)
+
+	ind := slib.RawIndicator{
+		Type:        "website",
+		Name:        "https://lookup.mozilla.com/app",
+		Zone:        "scl3",
+		EventSource: "lookuptest",
+		Likelihood:  "low",
+		Timestamp:   time.Now().UTC(),
+		Details:     map[string]interface{}{"lookup": true},
+	}
+	buf, err := json.Marshal([]slib.RawIndicator{ind})
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	if postIndicators(t, &client, buf).Accepted != 1 {
+		t.Fatalf("lookup test indicator was not accepted")
+	}
+
+	var lresp slib.OwnerLookupResponse
+	testPostJSON(t, "/api/v1/owner/lookup", slib.OwnerLookup{
+		Hostnames: []string{"testhost1.mozilla.com", "TESTHOST2.mozilla.com",
+			"not a hostname", "nosuchhost.mozilla.com"},
+		Websites: []string{"lookup.mozilla.com/app/login?next=/app/home"},
+	}, http.StatusOK, &lresp)
+	if len(lresp.Results) != 5 {
+		t.Fatalf("owner lookup returned unexpected number of results")
+	}
+	for i, x := range []struct {
+		matches int
+		err     bool
+	}{{1, false}, {1, false}, {0, true}, {0, false}, {1, false}} {
+		r := lresp.Results[i]
+		if len(r.Matches) != x.matches || (r.Error != "") != x.err {
+			t.Fatalf("owner lookup result for %v was unexpected", r.Query)
+		}
+	}
+	if lresp.Results[1].Matches[0].Owner.Team != "testservice" ||
+		lresp.Results[4].Matches[0].Name != "https://lookup.mozilla.com/app" {
+		t.Fatalf("owner lookup matches were unexpected")
+	}
+
+	hosts := make([]string, ownerLookupMax+1)
+	for i := range hosts {
+		hosts[i] = "testhost1.mozilla.com"
+	}
+	testPostJSON(t, "/api/v1/owner/lookup", slib.OwnerLookup{Hostnames: hosts},
+		http.StatusBadRequest, nil)
+}
+
+func TestOwnershipRules(t *testing.T) {
+	client := http.Client{}
+	var batch []slib.RawIndicator
+	for _, x := range []struct {
+		atype string
+		name  string
+	}{
+		{"website", "https://ownedsite.mozilla.com/app"},
+		{"container_image", "ownedimage:latest"},
+		{"ip", "10.10.2.7"},
+	} {
+		batch = append(batch, slib.RawIndicator{
+			Type:        x.atype,
+			Name:        x.name,
+			Zone:        "scl3",
+			EventSource: "ownershiptest",
+			Likelihood:  "low",
+			Timestamp:   time.Now().UTC(),
+			Details:     map[string]interface{}{"ownership": true},
+		})
+	}
+	buf, err := json.Marshal(batch)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	if postIndicators(t, &client, buf).Accepted != len(batch) {
+		t.Fatalf("ownership test indicators were not accepted")
+	}
+
+	// A triage key override left from a rule that no longer applies should be removed
+	op := opContext{}
+	op.newContext(dbconn, false, "127.0.0.1")
+	var staleid int
+	err = op.QueryRow(`INSERT INTO asset (assettype, name, zone, triageoverride)
+		VALUES ('container_image', 'staletriage:latest', 'ownertest', 'oldtriage')
+		RETURNING assetid`).Scan(&staleid)
+	if err != nil {
+		t.Fatalf("op.QueryRow: %v", err)
+	}
+
+	rules, err := interlinkLoadRules()
+	if err != nil {
+		t.Fatalf("interlinkLoadRules: %v", err)
+	}
+	err = interlinkRunRules(rules)
+	if err != nil {
+		t.Fatalf("interlinkRunRules: %v", err)
+	}
+
+	for _, x := range []struct {
+		atype     string
+		name      string
+		team      string
+		triagekey string
+	}{
+		{"website", "https://ownedsite.mozilla.com/app", "anothertestservice", "webtriage"},
+		{"container_image", "ownedimage:latest", "testservice", "operator-testservice"},
+		{"ip", "10.10.2.7", "anothertestservice", "operator-anothertestservice"},
+	} {
+		a, err := getAssetBase(op, testAssetID(t, x.atype, x.name))
+		if err != nil {
+			t.Fatalf("getAssetBase: %v", err)
+		}
+		if a.Owner.Team != x.team || a.Owner.TriageKey != x.triagekey {
+			t.Fatalf("%v asset %v had unexpected owner", x.atype, x.name)
+		}
+	}
+	var triage sql.NullString
+	err = op.QueryRow(`SELECT triageoverride FROM asset WHERE assetid = $1`,
+		staleid).Scan(&triage)
+	if err != nil {
+		t.Fatalf("op.QueryRow: %v", err)
+	}
+	if triage.Valid {
+		t.Fatalf("interlink did not remove triage key override for unowned asset")
+	}
+}
+
+func TestOwnerSummary(t *testing.T) {
+	client := http.Client{}
+	get := func(query string, expect int) (ret slib.OwnerSummary) {
+		rr, err := client.Get(testserv.URL + "/api/v1/owner/summary?" + query)
+		if err != nil {
+			t.Fatalf("client.Get: %v", err)
+		}
+		buf, err := ioutil.ReadAll(rr.Body)
+		if err != nil {
+			t.Fatalf("ioutil.ReadAll: %v", err)
+		}
+		rr.Body.Close()
+		if rr.StatusCode != expect {
+			t.Fatalf("owner summary response code %v", rr.StatusCode)
+		}
+		if expect == http.StatusOK {
+			err = json.Unmarshal(buf, &ret)
+			if err != nil {
+				t.Fatalf("json.Unmarshal: %v", err)
+			}
+		}
+		return
+	}
+
+	s := get("operator=operator&team=anothertestservice", http.StatusOK)
+	if s.Owner.Team != "anothertestservice" || len(s.Assets["hostname"]) == 0 {
+		t.Fatalf("owner summary did not include hostname assets")
+	}
+	total, zones := 0, 0
+	for atype, alist := range s.Assets {
+		for _, a := range alist {
+			if a.Type != atype || a.Owner.Team != "anothertestservice" {
+				t.Fatalf("owner summary included unexpected asset %v", a.Name)
+			}
+			total++
+		}
+	}
+	for _, n := range s.Zones {
+		zones += n
+	}
+	if total != zones {
+		t.Fatalf("owner summary zone counts did not match assets")
+	}
+	found := false
+	for _, x := range s.Services {
+		if x.Name == "another test service" && x.Assets > 0 && x.Risk.MedianLabel != "" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("owner summary did not include supported service risk")
+	}
+	found = false
+	for _, x := range s.Attention {
+		if x.Name == "anothertesthost.mozilla.com" && len(x.Indicators) != 0 {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("owner summary did not include asset with high likelihood indicators")
+	}
+
+	get("operator=operator", http.StatusBadRequest)
+	get("operator=operator&team=nosuchteam", http.StatusNotFound)
+}
+
+func TestOwnerSummaryUnusableRRA(t *testing.T) {
+	// An owner supporting a service whose RRA has no attributes; changes are made in a
+	// transaction that is rolled back so interlink does not modify the linkage
+	op := opContext{}
+	op.newContext(dbconn, false, "127.0.0.1")
+	err := op.begin()
+	if err != nil {
+		t.Fatalf("op.begin: %v", err)
+	}
+	defer op.rollback()
+	service := "owner summary unusable rra"
+	var rraid, agid, oid int
+	err = op.QueryRow(`INSERT INTO rra (service,
+		impact_availrep, impact_availprd, impact_availfin,
+		impact_confirep, impact_confiprd, impact_confifin,
+		impact_integrep, impact_integprd, impact_integfin,
+		prob_availrep, prob_availprd, prob_availfin,
+		prob_confirep, prob_confiprd, prob_confifin,
+		prob_integrep, prob_integprd, prob_integfin,
+		datadefault, lastupdated, timestamp, raw)
+		VALUES ($1, '', '', '', '', '', '', '', '', '',
+		'', '', '', '', '', '', '', '', '',
+		'unknown', now(), now(), '{}') RETURNING rraid`,
+		service).Scan(&rraid)
+	if err == nil {
+		err = op.QueryRow(`INSERT INTO assetgroup (name) VALUES ($1)
+			RETURNING assetgroupid`, service).Scan(&agid)
+	}
+	if err == nil {
+		_, err = op.Exec(`INSERT INTO rra_assetgroup (rraid, assetgroupid)
+			VALUES ($1, $2)`, rraid, agid)
+	}
+	if err == nil {
+		err = op.QueryRow(`INSERT INTO assetowners (operator, team)
+			VALUES ('operator', 'unusablerra') RETURNING ownerid`).Scan(&oid)
+	}
+	if err == nil {
+		_, err = op.Exec(`INSERT INTO asset (assettype, name, zone, assetgroupid, ownerid)
+			VALUES ('container_image', 'unusablerraowner', 'unusablerra', $1, $2)`,
+			agid, oid)
+	}
+	if err != nil {
+		t.Fatalf("op.Exec: %v", err)
+	}
+	s, err := getOwnerSummary(op, slib.Owner{ID: oid, Operator: "operator",
+		Team: "unusablerra"})
+	if err != nil {
+		t.Fatalf("getOwnerSummary: %v", err)
+	}
+	if len(s.Services) != 1 || s.Services[0].RRAID != rraid {
+		t.Fatalf("owner summary did not include service with unusable rra")
+	}
+	if s.Services[0].Risk.WorstCaseLabel != "unknown" {
+		t.Fatalf("owner summary risk for unusable rra was not unknown")
+	}
+}
@@ -0,0 +1,191 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor:
+// - Aaron Meihm ameihm@mozilla.com
+
+package main
+
+// Related to indicator retention; raw indicators older than the configured
+// maximum age are rolled up into daily summaries and removed from the indicator
+// table. The most recent indicator for each asset and event source is always
+// retained, as it is used for risk calculation.
+
+import (
+	"database/sql"
+	"github.com/lib/pq"
+	slib "github.com/mozilla/service-map/servicelib"
+	"time"
+)
+
+// Default number of indicators processed in a single retention transaction
+const retentionDefaultBatchSize = 1000
+
+// retentionSummaryKey identifies a daily summary for an asset and event source
+type retentionSummaryKey struct {
+	assetid     int
+	eventSource string
+	day         string
+}
+
+// retentionSummary is a daily summary of indicators for an asset and event source
+type retentionSummary struct {
+	count      int
+	likelihood string
+	firstseen  time.Time
+	lastseen   time.Time
+}
+
+// merge combines summary s with summary n
+func (s *retentionSummary) merge(n retentionSummary) {
+	s.count += n.count
+	if n.firstseen.Before(s.firstseen) {
+		s.firstseen = n.firstseen
+	}
+	if n.lastseen.After(s.lastseen) {
+		s.lastseen = n.lastseen
+	}
+	// The label will have been validated when the indicator was submitted, so
+	// ignore any error here
+	sv, _ := slib.ImpactValueFromLabel(s.likelihood)
+	nv, _ := slib.ImpactValueFromLabel(n.likelihood)
+	if nv > sv {
+		s.likelihood = n.likelihood
+	}
+}
+
+// retentionStoreSummary adds summary s to the stored daily summary identified by k,
+// creating the stored summary if it does not exist
+func retentionStoreSummary(op opContext, k retentionSummaryKey, s retentionSummary) error {
+	var e retentionSummary
+	err := op.QueryRow(`SELECT count, likelihood_indicator, firstseen, lastseen
+		FROM indicatorsummary WHERE assetid = $1 AND event_source = $2 AND
+		day = $3 FOR UPDATE`, k.assetid, k.eventSource, k.day).Scan(&e.count,
+		&e.likelihood, &e.firstseen, &e.lastseen)
+	if err == nil {
+		e.merge(s)
+		_, err = op.Exec(`UPDATE indicatorsummary SET count = $1,
+			likelihood_indicator = $2, firstseen = $3, lastseen = $4
+			WHERE assetid = $5 AND event_source = $6 AND day = $7`,
+			e.count, e.likelihood, e.firstseen, e.lastseen,
+			k.assetid, k.eventSource, k.day)
+	} else if err == sql.ErrNoRows {
+		_, err = op.Exec(`INSERT INTO indicatorsummary
+			(assetid, event_source, day, count, likelihood_indicator,
+			firstseen, lastseen) VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+			k.assetid, k.eventSource, k.day, s.count, s.likelihood,
+			s.firstseen, s.lastseen)
+	}
+	return err
+}
+
+// retentionRunBatch summarizes and removes a single batch of at most batchsize expired
+// indicators older than cutoff, returning the number of indicators that were removed
+func retentionRunBatch(op opContext, cutoff time.Time, batchsize int) (int, error) {
+	var ids []int64
+	// Summaries are keyed by UTC day, which is passed to the database as a date string
+	// so the session time zone does not influence the day the summary applies to
+	summaries := make(map[retentionSummaryKey]retentionSummary)
+
+	rows, err := op.Query(`SELECT indicatorid, assetid, event_source, timestamp,
+		likelihood_indicator FROM indicator x
+		WHERE timestamp < $1 AND EXISTS (
+			SELECT 1 FROM indicator y WHERE y.assetid = x.assetid AND
+			y.event_source = x.event_source AND y.timestamp > x.timestamp
+		) ORDER BY indicatorid LIMIT $2 FOR UPDATE SKIP LOCKED`, cutoff, batchsize)
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var (
+			id int64
+			k  retentionSummaryKey
+			s  retentionSummary
+		)
+		err = rows.Scan(&id, &k.assetid, &k.eventSource, &s.firstseen, &s.likelihood)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		s.count = 1
+		s.lastseen = s.firstseen
+		k.day = s.firstseen.UTC().Format("2006-01-02")
+		if v, ok := summaries[k]; ok {
+			v.merge(s)
+			summaries[k] = v
+		} else {
+			summaries[k] = s
+		}
+		ids = append(ids, id)
+	}
+	err = rows.Err()
+	if err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	for k, s := range summaries {
+		err = retentionStoreSummary(op, k, s)
+		if err != nil {
+			return 0, err
+		}
+	}
+	_, err = op.Exec(`DELETE FROM indicator WHERE indicatorid = ANY($1)`, pq.Array(ids))
+	if err != nil {
+		return 0, err
+	}
+	return len(ids), nil
+}
+
+// retentionRun applies indicator retention to all indicators older than maxage, processing
+// indicators in batches of batchsize with each batch in a separate transaction
+func retentionRun(maxage time.Duration, batchsize int) error {
+	cutoff := time.Now().UTC().Add(-1 * maxage)
+	total := 0
+	for {
+		op := opContext{}
+		err := op.newContext(dbconn, true, "retention")
+		if err != nil {
+			return err
+		}
+		n, err := retentionRunBatch(op, cutoff, batchsize)
+		if err != nil {
+			e := op.rollback()
+			if e != nil {
+				panic(e)
+			}
+			return err
+		}
+		err = op.commit()
+		if err != nil {
+			return err
+		}
+		total += n
+		if n < batchsize {
+			break
+		}
+	}
+	logf("retention: summarized and removed %v indicators older than %v", total, cutoff)
+	return nil
+}
+
+func indicatorRetention() {
+	defer func() {
+		if e := recover(); e != nil {
+			logf("error in indicator retention routine: %v", e)
+		}
+	}()
+	// Values are checked when the configuration is validated
+	maxage, _ := time.ParseDuration(cfg.General.RetentionMaxAge)
+	batchsize := cfg.General.RetentionBatchSize
+	if batchsize <= 0 {
+		batchsize = retentionDefaultBatchSize
+	}
+	err := retentionRun(maxage, batchsize)
+	if err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,137 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor:
+// - Aaron Meihm ameihm@mozilla.com
+
+package main
+
+import (
+	"encoding/json"
+	slib "github.com/mozilla/service-map/servicelib"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetentionRun(t *testing.T) {
+	client := http.Client{}
+
+	// Generate a set of old indicators over two days for one event source, with a
+	// recent indicator, and a set of old indicators for another event source with no
+	// recent indicator
+	base := time.Now().UTC().Truncate(24 * time.Hour).Add(-10 * 24 * time.Hour).Add(time.Hour)
+	ind := slib.RawIndicator{
+		Type:        "hostname",
+		Name:        "retentionhost.mozilla.com",
+		Zone:        "scl3",
+		EventSource: "retention",
+		Details:     map[string]string{"noop": "retention indicator"},
+	}
+	var batch []slib.RawIndicator
+	for i, x := range []string{"low", "high", "medium"} {
+		ind.Likelihood = x
+		ind.Timestamp = base.Add(time.Duration(i) * time.Minute)
+		batch = append(batch, ind)
+	}
+	for i, x := range []string{"low", "low"} {
+		ind.Likelihood = x
+		ind.Timestamp = base.Add(24 * time.Hour).Add(time.Duration(i) * time.Minute)
+		batch = append(batch, ind)
+	}
+	ind.Likelihood = "low"
+	ind.Timestamp = time.Now().Add(-1 * time.Hour)
+	batch = append(batch, ind)
+	ind.EventSource = "retentionold"
+	for i := 0; i < 2; i++ {
+		ind.Timestamp = base.Add(time.Duration(i) * time.Minute)
+		batch = append(batch, ind)
+	}
+	sendbuf, err := json.Marshal(batch)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	resp := postIndicators(t, &client, sendbuf)
+	if resp.Accepted != len(batch) {
+		t.Fatalf("retention test indicators were not accepted")
+	}
+	aid := resp.Results[0].ID
+	op := opContext{}
+	op.newContext(dbconn, false, "127.0.0.1")
+	err = op.QueryRow(`SELECT assetid FROM indicator WHERE indicatorid = $1`, aid).Scan(&aid)
+	if err != nil {
+		t.Fatalf("op.QueryRow: %v", err)
+	}
+
+	// Use a small batch size so multiple batches are processed
+	err = retentionRun(72*time.Hour, 2)
+	if err != nil {
+		t.Fatalf("retentionRun: %v", err)
+	}
+
+	var atab = []struct {
+		src   string
+		count int
+	}{
+		{"retention", 1},
+		{"retentionold", 1},
+	}
+	for _, x := range atab {
+		var cnt int
+		err = op.QueryRow(`SELECT COUNT(*) FROM indicator WHERE assetid = $1 AND
+			event_source = $2`, aid, x.src).Scan(&cnt)
+		if err != nil {
+			t.Fatalf("op.QueryRow: %v", err)
+		}
+		if cnt != x.count {
+			t.Fatalf("retention left unexpected number of %v indicators", x.src)
+		}
+	}
+
+	var stab = []struct {
+		src        string
+		day        time.Time
+		count      int
+		likelihood string
+	}{
+		{"retention", base, 3, "high"},
+		{"retention", base.Add(24 * time.Hour), 2, "low"},
+		{"retentionold", base, 1, "low"},
+	}
+	for _, x := range stab {
+		var (
+			cnt        int
+			likelihood string
+		)
+		err = op.QueryRow(`SELECT count, likelihood_indicator FROM indicatorsummary
+			WHERE assetid = $1 AND event_source = $2 AND day = $3`, aid, x.src,
+			x.day.Format("2006-01-02")).Scan(&cnt, &likelihood)
+		if err != nil {
+			t.Fatalf("op.QueryRow: %v", err)
+		}
+		if cnt != x.count || likelihood != x.likelihood {
+			t.Fatalf("retention summary for %v had unexpected values", x.src)
+		}
+	}
+}
+
+func TestRetentionConfig(t *testing.T) {
+	for _, x := range []struct {
+		every, maxage string
+		valid         bool
+	}{
+		{"6h", "2160h", true},
+		{"6h", "-2160h", false},
+		{"6h", "0s", false},
+		{"0s", "2160h", false},
+	} {
+		c := cfg
+		c.General.RetentionEvery = x.every
+		c.General.RetentionMaxAge = x.maxage
+		err := c.validate()
+		if x.valid != (err == nil) {
+			t.Fatalf("validate %v/%v: unexpected result %v", x.every, x.maxage, err)
+		}
+	}
+}
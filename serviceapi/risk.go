@@ -14,6 +14,7 @@ import (
 	"github.com/lib/pq"
 	"github.com/montanaflynn/stats"
 	slib "github.com/mozilla/service-map/servicelib"
+	"math"
 	"time"
 )
 
@@ -46,31 +47,46 @@ func riskRRAScenario(op opContext, rs *slib.Risk, src slib.RRAAttribute) error {
 	return nil
 }
 
+// riskRRAAssets returns all assets which are part of the asset groups linked to the RRA
+// in rs
+func riskRRAAssets(rs *slib.Risk) (ret []slib.Asset) {
+	for _, g := range rs.RRA.Groups {
+		ret = append(ret, g.Assets...)
+	}
+	return
+}
+
 // riskIndicatorScenarios creates a risk scenario for each distinct event_source for the
-// assets which are part of the service
-func riskIndicatorScenarios(op opContext, rs *slib.Risk, src slib.RRAAttribute) error {
-	var err error
+// active assets in assets; stale indicators are not included
+func riskIndicatorScenarios(op opContext, rs *slib.Risk, src slib.RRAAttribute, assets []slib.Asset) error {
+	type scenent struct {
+		probability float64
+		likelihood  string
+		decay       float64
+	}
 	// First build a map, where the key is a distinct event source name from an indicator
-	// and the value is the highest likelihood reported for that event source for all assets
-	// which are part of the service.
-	scenmap := make(map[string]float64)
-	for _, g := range rs.RRA.Groups {
-		for _, a := range g.Assets {
-			for _, i := range a.Indicators {
-				if v, ok := scenmap[i.EventSource]; ok {
-					tv, err := slib.ImpactValueFromLabel(i.Likelihood)
-					if err != nil {
-						return err
-					}
-					if tv > v {
-						scenmap[i.EventSource] = tv
-					}
-				} else {
-					scenmap[i.EventSource], err = slib.ImpactValueFromLabel(i.Likelihood)
-					if err != nil {
-						return err
-					}
-				}
+	// and the value is the highest likelihood reported for that event source for all of
+	// the assets.
+	scenmap := make(map[string]scenent)
+	for _, a := range assets {
+		if a.State != slib.AssetStateActive {
+			continue
+		}
+		for _, i := range a.Indicators {
+			if i.Stale {
+				continue
+			}
+			tv, decay, err := riskIndicatorProbability(i)
+			if err != nil {
+				return err
+			}
+			if v, ok := scenmap[i.EventSource]; ok && v.probability >= tv {
+				continue
+			}
+			scenmap[i.EventSource] = scenent{
+				probability: tv,
+				likelihood:  i.Likelihood,
+				decay:       decay,
 			}
 		}
 	}
@@ -78,9 +94,11 @@ func riskIndicatorScenarios(op opContext, rs *slib.Risk, src slib.RRAAttribute)
 	// Next, we generate a scenario for each element in the map
 	for k, v := range scenmap {
 		newscen := slib.RiskScenario{
-			Name: k + " derived risk for " + src.Attribute,
+			Name:        k + " derived risk for " + src.Attribute,
+			Likelihood:  v.likelihood,
+			DecayFactor: v.decay,
 		}
-		newscen.Probability = v
+		newscen.Probability = v.probability
 		newscen.Impact = src.Impact
 		newscen.Score = newscen.Impact * newscen.Probability
 		err := newscen.Validate()
@@ -92,6 +110,28 @@ func riskIndicatorScenarios(op opContext, rs *slib.Risk, src slib.RRAAttribute)
 	return nil
 }
 
+// riskIndicatorProbability returns the probability value for indicator i. If a half-life
+// is configured for the event source the indicator is from, the value associated with the
+// likelihood label is decayed based on the age of the indicator, and the factor that was
+// applied is returned in decay (otherwise decay will be 0).
+func riskIndicatorProbability(i slib.Indicator) (ret float64, decay float64, err error) {
+	ret, err = slib.ImpactValueFromLabel(i.Likelihood)
+	if err != nil {
+		return
+	}
+	hl := indicatorHalfLife(i.EventSource)
+	if hl == 0 {
+		return
+	}
+	age := time.Now().Sub(i.Timestamp)
+	if age < 0 {
+		age = 0
+	}
+	decay = math.Pow(0.5, age.Seconds()/hl.Seconds())
+	ret *= decay
+	return
+}
+
 // riskFinalize takes into account all scenarios present in rs and calculates a final
 // risk score for the RRA
 func riskFinalize(op opContext, rs *slib.Risk) error {
@@ -211,10 +251,16 @@ func riskCalculation(op opContext, rs *slib.Risk) error {
 	if err != nil {
 		return err
 	}
-	err = riskIndicatorScenarios(op, rs, rs.UsedRRAAttrib)
+	err = riskIndicatorScenarios(op, rs, rs.UsedRRAAttrib, riskRRAAssets(rs))
 	if err != nil {
 		return err
 	}
+	if cfg.General.PropagateRisk {
+		err = riskDependencyScenarios(op, rs)
+		if err != nil {
+			return err
+		}
+	}
 	err = riskFinalize(op, rs)
 	if err != nil {
 		return err
@@ -273,6 +319,99 @@ func riskForRRA(op opContext, useCache bool, rraid int) (ret slib.Risk, err erro
 	return ret, nil
 }
 
+// riskForAsset returns AssetRisk representing the calculated risk for asset ID aid at the
+// current time. The most recent RRA for each service the asset supports through its asset
+// group is examined, and the RRA with the highest business impact is combined with the
+// indicators for the asset to produce the risk scenarios.
+func riskForAsset(op opContext, aid int) (ret slib.AssetRisk, err error) {
+	ret.Asset, err = getAsset(op, aid)
+	if err != nil {
+		return
+	}
+	ret.Services = make([]slib.AssetRiskService, 0)
+	rows, err := op.Query(`SELECT x.rraid FROM rra x
+		INNER JOIN rra_assetgroup r ON x.rraid = r.rraid
+		INNER JOIN asset a ON r.assetgroupid = a.assetgroupid
+		WHERE a.assetid = $1 AND x.lastupdated = (
+			SELECT MAX(lastupdated) FROM rra y
+			WHERE x.service = y.service
+		) ORDER BY x.rraid`, aid)
+	if err != nil {
+		return
+	}
+	var rraids []int
+	for rows.Next() {
+		var rraid int
+		err = rows.Scan(&rraid)
+		if err != nil {
+			rows.Close()
+			return
+		}
+		rraids = append(rraids, rraid)
+	}
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+
+	found := false
+	for _, rraid := range rraids {
+		var r slib.RRA
+		r, err = getRRABase(op, rraid)
+		if err != nil {
+			return
+		}
+		if r.Name == "" {
+			continue
+		}
+		// The raw RRA is not included in the asset risk document
+		r.RawRRA = nil
+		rs := slib.Risk{RRA: r}
+		svc := slib.AssetRiskService{RRAID: r.ID, Name: r.Name}
+		// An RRA with no valid attributes is still listed as a service the asset
+		// supports, but it can't be used for the business impact
+		if riskFindHighestImpact(&rs) == nil {
+			svc.Attribute = rs.UsedRRAAttrib.Attribute
+			svc.Impact = rs.UsedRRAAttrib.Impact
+			svc.ImpactLabel, err = slib.ImpactLabelFromValue(svc.Impact)
+			if err != nil {
+				return
+			}
+			u := ret.UsedRRAAttrib
+			if !found || rs.UsedRRAAttrib.Impact > u.Impact ||
+				(rs.UsedRRAAttrib.Impact == u.Impact &&
+					rs.UsedRRAAttrib.Probability > u.Probability) {
+				ret.Risk = rs
+				found = true
+			}
+		}
+		ret.Services = append(ret.Services, svc)
+	}
+	if !found {
+		ret.Risk.Risk.MedianLabel = "unknown"
+		ret.Risk.Risk.AverageLabel = "unknown"
+		ret.Risk.Risk.WorstCaseLabel = "unknown"
+		ret.Risk.Risk.ImpactLabel = "unknown"
+		ret.Risk.Scenarios = make([]slib.RiskScenario, 0)
+		return ret, ret.Validate()
+	}
+
+	err = riskRRAScenario(op, &ret.Risk, ret.UsedRRAAttrib)
+	if err != nil {
+		return
+	}
+	err = riskIndicatorScenarios(op, &ret.Risk, ret.UsedRRAAttrib, []slib.Asset{ret.Asset})
+	if err != nil {
+		return
+	}
+	err = riskFinalize(op, &ret.Risk)
+	if err != nil {
+		return
+	}
+	err = ret.Validate()
+	return
+}
+
 // Cache entry point, called from risk cache routine to store risk document
 // for a service at current point in time
 func cacheRisk(op opContext, rraid int) error {
@@ -9,11 +9,15 @@ package main
 
 import (
 	"encoding/json"
+	slib "github.com/mozilla/service-map/servicelib"
 	"io/ioutil"
+	"math"
+	"net/http"
 	"path"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 type resultSpec struct {
@@ -59,3 +63,231 @@ func TestRiskResults(t *testing.T) {
 		}
 	}
 }
+
+func TestRiskStaleIndicators(t *testing.T) {
+	cfg.EventSource = map[string]*eventSourceConfig{
+		"secondeventsource": {TTL: "1s"},
+	}
+	defer func() {
+		cfg.EventSource = nil
+	}()
+
+	op := opContext{}
+	op.newContext(dbconn, false, "127.0.0.1")
+	// The first asset in service1 has indicators from testing and secondeventsource,
+	// the secondeventsource indicators should now be stale
+	a, err := getAsset(op, 1)
+	if err != nil {
+		t.Fatalf("getAsset: %v", err)
+	}
+	if len(a.Indicators) != 2 {
+		t.Fatalf("getAsset: unexpected number of indicators")
+	}
+	for _, x := range a.Indicators {
+		if x.Stale != (x.EventSource == "secondeventsource") {
+			t.Fatalf("getAsset: indicator from %v had unexpected stale flag", x.EventSource)
+		}
+	}
+
+	risk, err := riskForRRA(op, false, 1)
+	if err != nil {
+		t.Fatalf("riskForRRA: %v", err)
+	}
+	found := false
+	for _, x := range risk.Scenarios {
+		if strings.HasPrefix(x.Name, "secondeventsource ") {
+			t.Fatalf("risk scenario was generated from stale indicator")
+		}
+		if strings.HasPrefix(x.Name, "testing ") {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("risk scenario missing for current indicator")
+	}
+
+	// TTLs that are not positive are rejected, as every indicator would be stale
+	for _, ttl := range []string{"-1h", "0s"} {
+		c := cfg
+		c.EventSource = map[string]*eventSourceConfig{"expiring": {TTL: ttl}}
+		if c.validate() == nil {
+			t.Fatalf("validate: ttl %v accepted", ttl)
+		}
+		c.EventSource = nil
+		c.General.IndicatorTTL = ttl
+		if c.validate() == nil {
+			t.Fatalf("validate: general ttl %v accepted", ttl)
+		}
+	}
+}
+
+func TestRiskIndicatorProbability(t *testing.T) {
+	cfg.EventSource = map[string]*eventSourceConfig{
+		"decaying": {HalfLife: "24h"},
+	}
+	defer func() {
+		cfg.EventSource = nil
+	}()
+
+	var atab = []struct {
+		src   string
+		age   time.Duration
+		value float64
+		decay float64
+	}{
+		{"decaying", 0, 3, 1},
+		{"decaying", 24 * time.Hour, 1.5, 0.5},
+		{"decaying", 48 * time.Hour, 0.75, 0.25},
+		{"testing", 48 * time.Hour, 3, 0},
+	}
+	for _, x := range atab {
+		i := slib.Indicator{
+			EventSource: x.src,
+			Likelihood:  "high",
+			Timestamp:   time.Now().Add(-1 * x.age),
+		}
+		v, decay, err := riskIndicatorProbability(i)
+		if err != nil {
+			t.Fatalf("riskIndicatorProbability: %v", err)
+		}
+		if math.Abs(v-x.value) > 0.001 || math.Abs(decay-x.decay) > 0.001 {
+			t.Fatalf("riskIndicatorProbability: unexpected value for %v aged %v", x.src, x.age)
+		}
+	}
+
+	// Half-lives that are not positive are rejected, as they would not decay the value
+	for _, hl := range []string{"-24h", "0s"} {
+		c := cfg
+		c.EventSource = map[string]*eventSourceConfig{"decaying": {HalfLife: hl}}
+		if c.validate() == nil {
+			t.Fatalf("validate: half-life %v accepted", hl)
+		}
+		c.EventSource = nil
+		c.General.IndicatorHalfLife = hl
+		if c.validate() == nil {
+			t.Fatalf("validate: general half-life %v accepted", hl)
+		}
+	}
+}
+
+func TestAssetRisk(t *testing.T) {
+	client := http.Client{}
+	get := func(id string, expect int) (ret slib.AssetRisk) {
+		rr, err := client.Get(testserv.URL + "/api/v1/asset/risk?id=" + id)
+		if err != nil {
+			t.Fatalf("client.Get: %v", err)
+		}
+		buf, err := ioutil.ReadAll(rr.Body)
+		if err != nil {
+			t.Fatalf("ioutil.ReadAll: %v", err)
+		}
+		rr.Body.Close()
+		if rr.StatusCode != expect {
+			t.Fatalf("asset risk response code %v", rr.StatusCode)
+		}
+		if expect == http.StatusOK {
+			err = json.Unmarshal(buf, &ret)
+			if err != nil {
+				t.Fatalf("json.Unmarshal: %v", err)
+			}
+		}
+		return
+	}
+
+	// The first asset is part of service1, so the business impact should match the
+	// impact used for the service
+	op := opContext{}
+	op.newContext(dbconn, false, "127.0.0.1")
+	srisk, err := riskForRRA(op, false, 1)
+	if err != nil {
+		t.Fatalf("riskForRRA: %v", err)
+	}
+	risk := get("1", http.StatusOK)
+	if risk.Asset.ID != 1 || len(risk.Services) == 0 {
+		t.Fatalf("asset risk did not include supported services")
+	}
+	if risk.UsedRRAAttrib.Impact < srisk.UsedRRAAttrib.Impact {
+		t.Fatalf("asset risk did not use highest business impact")
+	}
+	if risk.Risk.Risk.ImpactLabel == "unknown" || len(risk.Scenarios) < 2 {
+		t.Fatalf("asset risk is missing scenarios")
+	}
+	found := false
+	for _, x := range risk.Scenarios {
+		if strings.HasPrefix(x.Name, "testing ") {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("asset risk scenario missing for asset indicator")
+	}
+
+	// An asset that does not support any services has an unknown risk
+	var a slib.Asset
+	testPostJSON(t, "/api/v1/asset/create", slib.Asset{Type: "hostname",
+		Name: "norisk.mozilla.com", Zone: "scl3"}, http.StatusOK, &a)
+	risk = get(strconv.Itoa(a.ID), http.StatusOK)
+	if len(risk.Services) != 0 || risk.Risk.Risk.WorstCaseLabel != "unknown" {
+		t.Fatalf("asset risk for asset without services was not unknown")
+	}
+
+	get("notanid", http.StatusBadRequest)
+	get("999999", http.StatusNotFound)
+}
+
+func TestAssetRiskUnusableRRA(t *testing.T) {
+	// RRAs with labels that are all unknown, or that can't be used to determine the
+	// business impact at all; changes are made in a transaction that is rolled back so
+	// interlink does not modify the asset group linkage during the test
+	for _, label := range []string{"unknown", ""} {
+		op := opContext{}
+		op.newContext(dbconn, false, "127.0.0.1")
+		err := op.begin()
+		if err != nil {
+			t.Fatalf("op.begin: %v", err)
+		}
+		service := "unusable rra service " + label
+		var rraid, agid, aid int
+		err = op.QueryRow(`INSERT INTO rra (service,
+			impact_availrep, impact_availprd, impact_availfin,
+			impact_confirep, impact_confiprd, impact_confifin,
+			impact_integrep, impact_integprd, impact_integfin,
+			prob_availrep, prob_availprd, prob_availfin,
+			prob_confirep, prob_confiprd, prob_confifin,
+			prob_integrep, prob_integprd, prob_integfin,
+			datadefault, lastupdated, timestamp, raw)
+			VALUES ($1, $2, $2, $2, $2, $2, $2, $2, $2, $2,
+			$2, $2, $2, $2, $2, $2, $2, $2, $2,
+			'unknown', now(), now(), '{}') RETURNING rraid`,
+			service, label).Scan(&rraid)
+		if err == nil {
+			err = op.QueryRow(`INSERT INTO assetgroup (name) VALUES ($1)
+				RETURNING assetgroupid`, service).Scan(&agid)
+		}
+		if err == nil {
+			_, err = op.Exec(`INSERT INTO rra_assetgroup (rraid, assetgroupid)
+				VALUES ($1, $2)`, rraid, agid)
+		}
+		if err == nil {
+			err = op.QueryRow(`INSERT INTO asset (assettype, name, zone, assetgroupid)
+				VALUES ('container_image', 'unusablerra', 'unusablerra', $1)
+				RETURNING assetid`, agid).Scan(&aid)
+		}
+		if err != nil {
+			op.rollback()
+			t.Fatalf("op.Exec: %v", err)
+		}
+		risk, err := riskForAsset(op, aid)
+		op.rollback()
+		if err != nil {
+			t.Fatalf("riskForAsset with %q labels: %v", label, err)
+		}
+		if len(risk.Services) != 1 || risk.Services[0].RRAID != rraid {
+			t.Fatalf("asset risk with %q labels did not include service", label)
+		}
+		if label == "" && (risk.RRA.Name != "" ||
+			risk.Risk.Risk.WorstCaseLabel != "unknown") {
+			t.Fatalf("asset risk for unusable rra was not unknown")
+		}
+	}
+}
@@ -20,6 +20,20 @@ import (
 // getRRA returns a fully populated RRA by ID; in the event the requested ID does
 // not exist, err will be nil and rr.Name will be the zero value
 func getRRA(op opContext, rraid int) (rr slib.RRA, err error) {
+	rr, err = getRRABase(op, rraid)
+	if err != nil || rr.Name == "" {
+		return
+	}
+	err = rraResolveSupportGroups(op, &rr)
+	if err != nil {
+		return
+	}
+	return
+}
+
+// getRRABase returns an RRA by ID without any asset group information; in the event the
+// requested ID does not exist, err will be nil and rr.Name will be the zero value
+func getRRABase(op opContext, rraid int) (rr slib.RRA, err error) {
 	err = op.QueryRow(`SELECT rraid, service,
 		impact_availrep, impact_availprd, impact_availfin,
 		impact_confirep, impact_confiprd, impact_confifin,
@@ -36,15 +50,8 @@ func getRRA(op opContext, rraid int) (rr slib.RRA, err error) {
 		&rr.ConfiRepProb, &rr.ConfiPrdProb, &rr.ConfiFinProb,
 		&rr.IntegRepProb, &rr.IntegPrdProb, &rr.IntegFinProb,
 		&rr.DefData, &rr.RawRRA, &rr.LastUpdated)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return rr, nil
-		}
-		return
-	}
-	err = rraResolveSupportGroups(op, &rr)
-	if err != nil {
-		return
+	if err == sql.ErrNoRows {
+		return rr, nil
 	}
 	return
 }
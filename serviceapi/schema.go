@@ -0,0 +1,327 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor:
+// - Aaron Meihm ameihm@mozilla.com
+
+package main
+
+// Related to validation of indicator details using JSON schema documents which
+// can be configured for each event source.
+//
+// The validator supports a subset of JSON schema, which covers the keywords
+// that are typically needed to describe indicator details: type, enum,
+// properties, required, additionalProperties, items, minItems, maxItems,
+// minLength, maxLength, pattern, minimum, maximum, allOf and anyOf. Other
+// keywords are ignored.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// jsonSchema is a parsed JSON schema document
+type jsonSchema struct {
+	Type                 schemaTypes            `json:"type"`
+	Enum                 []interface{}          `json:"enum"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *schemaAdditional      `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+	MinItems             *int                   `json:"minItems"`
+	MaxItems             *int                   `json:"maxItems"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	Pattern              string                 `json:"pattern"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+	AllOf                []*jsonSchema          `json:"allOf"`
+	AnyOf                []*jsonSchema          `json:"anyOf"`
+
+	pattern *regexp.Regexp
+}
+
+// schemaTypes holds the value of the type keyword, which can either be a single
+// type name or a list of type names
+type schemaTypes []string
+
+func (s *schemaTypes) UnmarshalJSON(buf []byte) error {
+	var one string
+	if json.Unmarshal(buf, &one) == nil {
+		*s = schemaTypes{one}
+		return nil
+	}
+	var many []string
+	err := json.Unmarshal(buf, &many)
+	if err != nil {
+		return fmt.Errorf("schema type must be a string or list of strings")
+	}
+	*s = many
+	return nil
+}
+
+// schemaAdditional holds the value of the additionalProperties keyword, which can
+// either be a boolean or a schema
+type schemaAdditional struct {
+	allowed bool
+	schema  *jsonSchema
+}
+
+func (s *schemaAdditional) UnmarshalJSON(buf []byte) error {
+	if json.Unmarshal(buf, &s.allowed) == nil {
+		return nil
+	}
+	s.allowed = true
+	return json.Unmarshal(buf, &s.schema)
+}
+
+// indicatorSchemas contains the schema for each event source which has a schema
+// configured, keyed by event source name
+var indicatorSchemas map[string]*jsonSchema
+
+// schemaLoad loads the schema configured for each event source
+func schemaLoad() error {
+	schemas := make(map[string]*jsonSchema)
+	for k, v := range cfg.EventSource {
+		if v.Schema == "" {
+			continue
+		}
+		buf, err := ioutil.ReadFile(v.Schema)
+		if err != nil {
+			return err
+		}
+		s, err := schemaParse(buf)
+		if err != nil {
+			return fmt.Errorf("schema for event source %v: %v", k, err)
+		}
+		schemas[k] = s
+	}
+	indicatorSchemas = schemas
+	return nil
+}
+
+// schemaParse parses and compiles a JSON schema document
+func schemaParse(buf []byte) (ret *jsonSchema, err error) {
+	err = json.Unmarshal(buf, &ret)
+	if err != nil {
+		return
+	}
+	if ret == nil {
+		return nil, fmt.Errorf("schema document is empty")
+	}
+	err = ret.compile()
+	return
+}
+
+// compile prepares s and any subschemas for validation
+func (s *jsonSchema) compile() (err error) {
+	for _, x := range s.Type {
+		switch x {
+		case "object", "array", "string", "number", "integer", "boolean", "null":
+		default:
+			return fmt.Errorf("invalid schema type %q", x)
+		}
+	}
+	if s.Pattern != "" {
+		s.pattern, err = regexp.Compile(s.Pattern)
+		if err != nil {
+			return err
+		}
+	}
+	subs := []*jsonSchema{s.Items}
+	for _, x := range s.Properties {
+		subs = append(subs, x)
+	}
+	if s.AdditionalProperties != nil {
+		subs = append(subs, s.AdditionalProperties.schema)
+	}
+	subs = append(subs, s.AllOf...)
+	subs = append(subs, s.AnyOf...)
+	for _, x := range subs {
+		if x == nil {
+			continue
+		}
+		err = x.compile()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// schemaTypeOf returns the JSON schema type name for a value decoded using encoding/json
+func schemaTypeOf(v interface{}) string {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		if t == math.Trunc(t) {
+			return "integer"
+		}
+		return "number"
+	case bool:
+		return "boolean"
+	case nil:
+		return "null"
+	}
+	return "unknown"
+}
+
+// validate checks value v against schema s, returning an error describing the first
+// violation that is found; path is used to identify the location of v in the document
+func (s *jsonSchema) validate(path string, v interface{}) error {
+	vtype := schemaTypeOf(v)
+	if len(s.Type) > 0 {
+		found := false
+		for _, x := range s.Type {
+			if x == vtype || (x == "number" && vtype == "integer") {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%v: expected %v, found %v", path,
+				strings.Join(s.Type, " or "), vtype)
+		}
+	}
+	if len(s.Enum) > 0 {
+		found := false
+		for _, x := range s.Enum {
+			if reflect.DeepEqual(x, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%v: value is not one of the permitted values", path)
+		}
+	}
+	for _, x := range s.AllOf {
+		err := x.validate(path, v)
+		if err != nil {
+			return err
+		}
+	}
+	if len(s.AnyOf) > 0 {
+		var err error
+		for _, x := range s.AnyOf {
+			err = x.validate(path, v)
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%v: value does not match any permitted schema", path)
+		}
+	}
+
+	switch t := v.(type) {
+	case map[string]interface{}:
+		return s.validateObject(path, t)
+	case []interface{}:
+		if s.MinItems != nil && len(t) < *s.MinItems {
+			return fmt.Errorf("%v: expected at least %v items", path, *s.MinItems)
+		}
+		if s.MaxItems != nil && len(t) > *s.MaxItems {
+			return fmt.Errorf("%v: expected at most %v items", path, *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, x := range t {
+				err := s.Items.validate(fmt.Sprintf("%v[%v]", path, i), x)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		l := utf8.RuneCountInString(t)
+		if s.MinLength != nil && l < *s.MinLength {
+			return fmt.Errorf("%v: expected at least %v characters", path, *s.MinLength)
+		}
+		if s.MaxLength != nil && l > *s.MaxLength {
+			return fmt.Errorf("%v: expected at most %v characters", path, *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(t) {
+			return fmt.Errorf("%v: value does not match pattern %q", path, s.Pattern)
+		}
+	case float64:
+		if s.Minimum != nil && t < *s.Minimum {
+			return fmt.Errorf("%v: value is less than minimum %v", path, *s.Minimum)
+		}
+		if s.Maximum != nil && t > *s.Maximum {
+			return fmt.Errorf("%v: value is greater than maximum %v", path, *s.Maximum)
+		}
+	}
+	return nil
+}
+
+// validateObject checks the properties of object v against schema s
+func (s *jsonSchema) validateObject(path string, v map[string]interface{}) error {
+	for _, x := range s.Required {
+		if _, ok := v[x]; !ok {
+			return fmt.Errorf("%v: missing required property %q", path, x)
+		}
+	}
+	// Check properties in a consistent order so the same violation is always reported
+	keys := make([]string, 0, len(v))
+	for k := range v {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		ppath := path + "." + k
+		if ps, ok := s.Properties[k]; ok {
+			err := ps.validate(ppath, v[k])
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if s.AdditionalProperties == nil {
+			continue
+		}
+		if !s.AdditionalProperties.allowed {
+			return fmt.Errorf("%v: property is not permitted", ppath)
+		}
+		if s.AdditionalProperties.schema != nil {
+			err := s.AdditionalProperties.schema.validate(ppath, v[k])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// indicatorValidateDetails validates the details in an indicator using the schema
+// configured for the event source, if one exists
+func indicatorValidateDetails(eventSource string, details interface{}) error {
+	s, ok := indicatorSchemas[eventSource]
+	if !ok {
+		return nil
+	}
+	// Round trip the details so we are validating the same types we would store,
+	// regardless of how the indicator was constructed
+	buf, err := json.Marshal(details)
+	if err != nil {
+		return err
+	}
+	var v interface{}
+	err = json.Unmarshal(buf, &v)
+	if err != nil {
+		return err
+	}
+	return s.validate("details", v)
+}
@@ -0,0 +1,141 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor:
+// - Aaron Meihm ameihm@mozilla.com
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	slib "github.com/mozilla/service-map/servicelib"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testSchema = `{
+	"type": "object",
+	"required": ["cve", "score"],
+	"additionalProperties": false,
+	"properties": {
+		"cve": {
+			"type": "array",
+			"minItems": 1,
+			"items": {"type": "string", "pattern": "^CVE-\\d{4}-\\d+$"}
+		},
+		"score": {"type": "number", "minimum": 0, "maximum": 10},
+		"severity": {"enum": ["low", "medium", "high"]},
+		"port": {"type": ["integer", "null"]}
+	}
+}`
+
+func TestSchemaValidate(t *testing.T) {
+	s, err := schemaParse([]byte(testSchema))
+	if err != nil {
+		t.Fatalf("schemaParse: %v", err)
+	}
+
+	var stab = []struct {
+		doc   string
+		valid bool
+		path  string
+	}{
+		{`{"cve": ["CVE-2017-5638"], "score": 9.8}`, true, ""},
+		{`{"cve": ["CVE-2017-5638"], "score": 5, "severity": "high", "port": 443}`, true, ""},
+		{`{"cve": ["CVE-2017-5638"], "score": 5, "port": null}`, true, ""},
+		{`{"cve": ["CVE-2017-5638"]}`, false, "details:"},
+		{`{"cve": [], "score": 1}`, false, "details.cve:"},
+		{`{"cve": ["notacve"], "score": 1}`, false, "details.cve[0]:"},
+		{`{"cve": ["CVE-2017-5638"], "score": 11}`, false, "details.score:"},
+		{`{"cve": ["CVE-2017-5638"], "score": "high"}`, false, "details.score:"},
+		{`{"cve": ["CVE-2017-5638"], "score": 1, "severity": "extreme"}`, false, "details.severity:"},
+		{`{"cve": ["CVE-2017-5638"], "score": 1, "port": 1.5}`, false, "details.port:"},
+		{`{"cve": ["CVE-2017-5638"], "score": 1, "extra": true}`, false, "details.extra:"},
+		{`"string"`, false, "details:"},
+	}
+	for _, x := range stab {
+		var v interface{}
+		err = json.Unmarshal([]byte(x.doc), &v)
+		if err != nil {
+			t.Fatalf("json.Unmarshal: %v", err)
+		}
+		err = s.validate("details", v)
+		if (err == nil) != x.valid {
+			t.Fatalf("schema validation of %v returned unexpected result: %v", x.doc, err)
+		}
+		if err != nil && !strings.HasPrefix(err.Error(), x.path) {
+			t.Fatalf("schema validation of %v reported unexpected path: %v", x.doc, err)
+		}
+	}
+
+	_, err = schemaParse([]byte(`{"type": "nothing"}`))
+	if err == nil {
+		t.Fatalf("schemaParse should have failed with invalid type")
+	}
+	_, err = schemaParse([]byte(`{"pattern": "("}`))
+	if err == nil {
+		t.Fatalf("schemaParse should have failed with invalid pattern")
+	}
+}
+
+func TestServiceIndicatorSchema(t *testing.T) {
+	s, err := schemaParse([]byte(testSchema))
+	if err != nil {
+		t.Fatalf("schemaParse: %v", err)
+	}
+	indicatorSchemas = map[string]*jsonSchema{"schematest": s}
+	defer func() {
+		indicatorSchemas = nil
+	}()
+
+	client := http.Client{}
+	ind := slib.RawIndicator{
+		Type:        "hostname",
+		Name:        "schemahost.mozilla.com",
+		Zone:        "scl3",
+		EventSource: "schematest",
+		Likelihood:  "high",
+		Timestamp:   time.Now().Add(-1 * time.Minute),
+		Details:     map[string]interface{}{"cve": []string{"CVE-2017-5638"}},
+	}
+	buf, err := json.Marshal(ind)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	rr, err := client.Post(testserv.URL+"/api/v1/indicator", "application/json",
+		bytes.NewReader(buf))
+	if err != nil {
+		t.Fatalf("client.Post: %v", err)
+	}
+	if rr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("indicator with invalid details response code %v", rr.StatusCode)
+	}
+	rbuf, err := ioutil.ReadAll(rr.Body)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll: %v", err)
+	}
+	rr.Body.Close()
+	if !strings.Contains(string(rbuf), "missing required property \"score\"") {
+		t.Fatalf("indicator with invalid details response did not describe violation")
+	}
+
+	ind.Details = map[string]interface{}{"cve": []string{"CVE-2017-5638"}, "score": 9.8}
+	buf, err = json.Marshal(ind)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	rr, err = client.Post(testserv.URL+"/api/v1/indicator", "application/json",
+		bytes.NewReader(buf))
+	if err != nil {
+		t.Fatalf("client.Post: %v", err)
+	}
+	if rr.StatusCode != http.StatusOK {
+		t.Fatalf("indicator with valid details response code %v", rr.StatusCode)
+	}
+	rr.Body.Close()
+}
@@ -0,0 +1,264 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor:
+// - Aaron Meihm ameihm@mozilla.com
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	slib "github.com/mozilla/service-map/servicelib"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// searchParsePath converts a JSONPath expression into a list of path elements that can
+// be used with the Postgres JSON path operators. Only simple paths made up of member names
+// and array indices are supported (e.g., $.vuln.cve[0] or vuln.cve[0]).
+func searchParsePath(expr string) (ret []string, err error) {
+	expr = strings.TrimPrefix(strings.TrimPrefix(expr, "$"), ".")
+	if expr == "" {
+		return nil, errors.New("empty path expression")
+	}
+	for _, x := range strings.Split(expr, ".") {
+		name := x
+		var idx []string
+		if n := strings.Index(x, "["); n != -1 {
+			name = x[:n]
+			rest := x[n:]
+			for rest != "" {
+				e := strings.Index(rest, "]")
+				if rest[0] != '[' || e == -1 {
+					return nil, fmt.Errorf("invalid path element %q", x)
+				}
+				_, err = strconv.Atoi(rest[1:e])
+				if err != nil {
+					return nil, fmt.Errorf("unsupported array index in %q", x)
+				}
+				idx = append(idx, rest[1:e])
+				rest = rest[e+1:]
+			}
+		}
+		if name == "" && len(ret) != 0 {
+			return nil, fmt.Errorf("invalid path element %q", x)
+		}
+		if name == "*" || strings.ContainsAny(name, "*?()@") {
+			return nil, fmt.Errorf("unsupported path element %q", x)
+		}
+		if name != "" {
+			ret = append(ret, name)
+		}
+		ret = append(ret, idx...)
+	}
+	return
+}
+
+// indicatorSearch returns indicators matching search s, along with the asset each
+// indicator is associated with, and the total number of matching indicators
+func indicatorSearch(op opContext, s slib.IndicatorSearch) (ret []slib.IndicatorSearchResult,
+	total int, err error) {
+	var (
+		where []string
+		args  []interface{}
+	)
+	ret = make([]slib.IndicatorSearchResult, 0)
+	addArg := func(clause string, v interface{}) {
+		args = append(args, v)
+		where = append(where, fmt.Sprintf(clause, len(args)))
+	}
+	if s.Contains != nil {
+		buf, err := json.Marshal(s.Contains)
+		if err != nil {
+			return ret, 0, err
+		}
+		addArg("details @> $%v::jsonb", string(buf))
+	}
+	for _, x := range s.Paths {
+		p, err := searchParsePath(x.Path)
+		if err != nil {
+			return ret, 0, err
+		}
+		if x.Value == nil {
+			addArg("details #> $%v IS NOT NULL", pq.Array(p))
+			continue
+		}
+		addArg("details #>> $%v", pq.Array(p))
+		args = append(args, *x.Value)
+		where[len(where)-1] += fmt.Sprintf(" = $%v", len(args))
+	}
+	if s.EventSource != "" {
+		addArg("event_source = $%v", s.EventSource)
+	}
+	if s.Likelihood != "" {
+		addArg("likelihood_indicator = $%v", s.Likelihood)
+	}
+	if !s.Since.IsZero() {
+		addArg("timestamp >= $%v", s.Since)
+	}
+	if !s.Until.IsZero() {
+		addArg("timestamp <= $%v", s.Until)
+	}
+	wherestr := "TRUE"
+	if len(where) > 0 {
+		wherestr = strings.Join(where, " AND ")
+	}
+
+	err = op.QueryRow(`SELECT COUNT(*) FROM indicator WHERE `+wherestr, args...).Scan(&total)
+	if err != nil {
+		return
+	}
+	args = append(args, s.Limit, s.Offset)
+	rows, err := op.Query(fmt.Sprintf(`SELECT indicatorid, clientid, timestamp, event_source,
+		likelihood_indicator, details, assetid FROM indicator WHERE %v
+		ORDER BY timestamp DESC, indicatorid DESC LIMIT $%v OFFSET $%v`,
+		wherestr, len(args)-1, len(args)), args...)
+	if err != nil {
+		return
+	}
+	var aids []int
+	for rows.Next() {
+		var (
+			nres slib.IndicatorSearchResult
+			aid  int
+		)
+		nres.Indicator, err = scanIndicator(rows, &aid)
+		if err != nil {
+			rows.Close()
+			return
+		}
+		ret = append(ret, nres)
+		aids = append(aids, aid)
+	}
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+	// Add the asset details for each result, multiple results will often refer to the
+	// same asset so cache them as we go
+	assets := make(map[int]slib.Asset)
+	for i, aid := range aids {
+		a, ok := assets[aid]
+		if !ok {
+			a, err = getAssetBase(op, aid)
+			if err != nil {
+				return
+			}
+			assets[aid] = a
+		}
+		ret[i].Asset = a
+	}
+	return
+}
+
+// searchFromForm populates s using the query parameters in a GET request
+func searchFromForm(req *http.Request, s *slib.IndicatorSearch) (err error) {
+	if v := req.FormValue("contains"); v != "" {
+		err = json.Unmarshal([]byte(v), &s.Contains)
+		if err != nil {
+			return errors.New("invalid contains value")
+		}
+	}
+	for _, x := range req.Form["path"] {
+		s.Paths = append(s.Paths, slib.IndicatorPathMatch{Path: x})
+	}
+	s.EventSource = req.FormValue("event_source")
+	s.Likelihood = req.FormValue("likelihood_indicator")
+	if v := req.FormValue("since"); v != "" {
+		s.Since, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return errors.New("invalid since value")
+		}
+	}
+	if v := req.FormValue("until"); v != "" {
+		s.Until, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return errors.New("invalid until value")
+		}
+	}
+	if v := req.FormValue("limit"); v != "" {
+		s.Limit, err = strconv.Atoi(v)
+		if err != nil {
+			return errors.New("invalid limit value")
+		}
+	}
+	if v := req.FormValue("offset"); v != "" {
+		s.Offset, err = strconv.Atoi(v)
+		if err != nil {
+			return errors.New("invalid offset value")
+		}
+	}
+	return nil
+}
+
+// serviceIndicatorSearch is the API entry point to search for indicators based on the
+// content of the indicator details, in addition to event source, likelihood and time range.
+// The search can be provided as query parameters in a GET request, or as an IndicatorSearch
+// document in a POST request.
+func serviceIndicatorSearch(rw http.ResponseWriter, req *http.Request) {
+	op := opContext{}
+	op.newContext(dbconn, false, req.RemoteAddr)
+
+	var (
+		s   slib.IndicatorSearch
+		err error
+	)
+	if req.Method == "POST" {
+		err = json.NewDecoder(req.Body).Decode(&s)
+		if err != nil {
+			op.logf(err.Error())
+			http.Error(rw, "indicator search document malformed", 400)
+			return
+		}
+	} else {
+		req.ParseForm()
+		err = searchFromForm(req, &s)
+		if err != nil {
+			http.Error(rw, err.Error(), 400)
+			return
+		}
+	}
+	err = s.Validate()
+	if err != nil {
+		http.Error(rw, err.Error(), 400)
+		return
+	}
+	if s.Limit == 0 {
+		s.Limit = indicatorHistoryDefaultLimit
+	}
+	if s.Limit < 0 || s.Limit > indicatorHistoryMaxLimit {
+		http.Error(rw, "invalid limit value", 400)
+		return
+	}
+	for _, x := range s.Paths {
+		_, err = searchParsePath(x.Path)
+		if err != nil {
+			http.Error(rw, err.Error(), 400)
+			return
+		}
+	}
+
+	resp := slib.IndicatorSearchResponse{
+		Limit:  s.Limit,
+		Offset: s.Offset,
+	}
+	resp.Results, resp.Total, err = indicatorSearch(op, s)
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "error searching indicators", 500)
+		return
+	}
+	buf, err := json.Marshal(&resp)
+	if err != nil {
+		op.logf(err.Error())
+		http.Error(rw, "error searching indicators", 500)
+		return
+	}
+	fmt.Fprint(rw, string(buf))
+}
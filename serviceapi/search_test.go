@@ -0,0 +1,133 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor:
+// - Aaron Meihm ameihm@mozilla.com
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	slib "github.com/mozilla/service-map/servicelib"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSearchParsePath(t *testing.T) {
+	tests := []struct {
+		path   string
+		expect []string
+		valid  bool
+	}{
+		{"$.vuln.cve[0]", []string{"vuln", "cve", "0"}, true},
+		{"vuln.cve", []string{"vuln", "cve"}, true},
+		{"$.matrix[1][2]", []string{"matrix", "1", "2"}, true},
+		{"$.vuln.*", nil, false},
+		{"$.vuln[?(@.x)]", nil, false},
+		{"$", nil, false},
+		{"$.a..b", nil, false},
+	}
+	for _, x := range tests {
+		ret, err := searchParsePath(x.path)
+		if x.valid != (err == nil) {
+			t.Fatalf("searchParsePath %q: unexpected result %v", x.path, err)
+		}
+		if x.valid && !reflect.DeepEqual(ret, x.expect) {
+			t.Fatalf("searchParsePath %q: unexpected path %v", x.path, ret)
+		}
+	}
+}
+
+func TestServiceIndicatorSearch(t *testing.T) {
+	client := http.Client{}
+
+	var inds []slib.RawIndicator
+	hosts := []string{"searchhosta", "searchhostb", "searchhostc"}
+	for i, cve := range []string{"CVE-2017-5638", "CVE-2014-0160", "CVE-2017-5638"} {
+		inds = append(inds, slib.RawIndicator{
+			Type:        "hostname",
+			Name:        hosts[i] + ".mozilla.com",
+			Zone:        "scl3",
+			EventSource: "searchtest",
+			Likelihood:  "high",
+			Timestamp:   time.Now().Add(-1 * time.Minute),
+			Details: map[string]interface{}{
+				"vuln": map[string]interface{}{"cve": []string{cve}},
+			},
+		})
+	}
+	buf, err := json.Marshal(inds)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	resp := postIndicators(t, &client, buf)
+	if resp.Accepted != 3 {
+		t.Fatalf("unexpected number of accepted indicators %v", resp.Accepted)
+	}
+
+	search := func(rr *http.Response, err error) (ret slib.IndicatorSearchResponse) {
+		if err != nil {
+			t.Fatalf("indicator search: %v", err)
+		}
+		if rr.StatusCode != http.StatusOK {
+			t.Fatalf("indicator search response code %v", rr.StatusCode)
+		}
+		rbuf, err := ioutil.ReadAll(rr.Body)
+		if err != nil {
+			t.Fatalf("ioutil.ReadAll: %v", err)
+		}
+		rr.Body.Close()
+		err = json.Unmarshal(rbuf, &ret)
+		if err != nil {
+			t.Fatalf("json.Unmarshal: %v", err)
+		}
+		return
+	}
+
+	// Containment search using a GET request
+	v := url.Values{}
+	v.Set("contains", `{"vuln":{"cve":["CVE-2017-5638"]}}`)
+	v.Set("event_source", "searchtest")
+	ret := search(client.Get(testserv.URL + "/api/v1/indicators/search?" + v.Encode()))
+	if ret.Total != 2 || len(ret.Results) != 2 {
+		t.Fatalf("unexpected number of search results %v", ret.Total)
+	}
+	for _, x := range ret.Results {
+		if x.Indicator.EventSource != "searchtest" || x.Asset.Zone != "scl3" {
+			t.Fatalf("unexpected search result")
+		}
+	}
+
+	// Path search using a POST request
+	val := "CVE-2014-0160"
+	s := slib.IndicatorSearch{
+		Paths: []slib.IndicatorPathMatch{{Path: "$.vuln.cve[0]", Value: &val}},
+	}
+	buf, err = json.Marshal(s)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	ret = search(client.Post(testserv.URL+"/api/v1/indicators/search", "application/json",
+		bytes.NewReader(buf)))
+	if ret.Total != 1 || ret.Results[0].Asset.Name != "searchhostb.mozilla.com" {
+		t.Fatalf("unexpected path search results")
+	}
+
+	// Unsupported path expressions should be rejected
+	v = url.Values{}
+	v.Set("path", "$.vuln[*]")
+	rr, err := client.Get(testserv.URL + "/api/v1/indicators/search?" + v.Encode())
+	if err != nil {
+		t.Fatalf("client.Get: %v", err)
+	}
+	rr.Body.Close()
+	if rr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("invalid path search response code %v", rr.StatusCode)
+	}
+}
@@ -40,14 +40,17 @@ func (o *opContext) newContext(db *sql.DB, useTransaction bool, rhost string) (e
 	o.db = db
 	o.rhost = rhost
 	if useTransaction {
-		o.tx, err = db.Begin()
-		if err != nil {
-			return err
-		}
+		return o.begin()
 	}
 	return nil
 }
 
+// begin starts a transaction in a context that was created without one
+func (o *opContext) begin() (err error) {
+	o.tx, err = o.db.Begin()
+	return
+}
+
 func (o *opContext) Query(qs string, args ...interface{}) (*sql.Rows, error) {
 	if o.tx != nil {
 		return o.tx.Query(qs, args...)
@@ -69,15 +72,21 @@ func (o *opContext) Exec(qs string, args ...interface{}) (sql.Result, error) {
 	return o.db.Exec(qs, args...)
 }
 
+// commit commits the transaction in the context; once complete, further operations
+// using the context are made without a transaction
 func (o *opContext) commit() error {
 	if o.tx == nil {
 		return nil
 	}
-	return o.tx.Commit()
+	err := o.tx.Commit()
+	o.tx = nil
+	return err
 }
 
 func (o *opContext) rollback() error {
-	return o.tx.Rollback()
+	err := o.tx.Rollback()
+	o.tx = nil
+	return err
 }
 
 func (o *opContext) logf(s string, args ...interface{}) {
@@ -91,9 +100,19 @@ func (o *opContext) logf(s string, args ...interface{}) {
 
 type config struct {
 	General struct {
-		Listen         string
-		RiskCacheEvery string
-		DisableAPIAuth bool
+		Listen             string
+		RiskCacheEvery     string
+		DisableAPIAuth     bool
+		IndicatorChunkSize int
+		IndicatorBatchMax  int
+		IndicatorTTL       string
+		IndicatorHalfLife  string
+		RetentionEvery     string
+		RetentionMaxAge    string
+		RetentionBatchSize int
+		DecommissionEvery  string
+		DecommissionAfter  string
+		PropagateRisk      bool
 	}
 	Database struct {
 		Hostname string
@@ -108,18 +127,105 @@ type config struct {
 		S3Bucket string
 		S3Region string
 	}
+	Ingest struct {
+		PollEvery          string
+		SQSQueueURL        string
+		SQSDeadLetterURL   string
+		SQSRegion          string
+		SQSEndpoint        string
+		SpoolDir           string
+		SpoolDeadLetterDir string
+	}
+	Labels struct {
+		DetailKey []string
+	}
+	AssetTypes struct {
+		Unknown string   // allow (default) or reject
+		Map     []string // Mappings of unknown types to known types (e.g., vm=hostname)
+	}
+	EventSource map[string]*eventSourceConfig
+}
+
+// eventSourceConfig contains configuration specific to indicators from a given
+// event source, and is configured in an eventsource subsection with the event
+// source name (e.g., [eventsource "scanner"])
+type eventSourceConfig struct {
+	TTL      string // Overrides general..indicatorttl for the event source
+	HalfLife string // Overrides general..indicatorhalflife for the event source
+	Schema   string // Path to JSON schema used to validate indicator details
 }
 
 func (c *config) validate() error {
 	if c.General.Listen == "" {
 		return fmt.Errorf("missing configuration option: general..listen")
 	}
+	if c.General.RetentionEvery != "" && c.General.RetentionMaxAge == "" {
+		return fmt.Errorf("missing configuration option: general..retentionmaxage")
+	}
+	if c.General.DecommissionEvery != "" && c.General.DecommissionAfter == "" {
+		return fmt.Errorf("missing configuration option: general..decommissionafter")
+	}
+	// Failed indicators are removed from the queue once sent to the dead-letter queue; if
+	// they were left in the queue the entire message would be processed again
+	if c.Ingest.SQSQueueURL != "" && c.Ingest.SQSDeadLetterURL == "" {
+		return fmt.Errorf("missing configuration option: ingest..sqsdeadletterurl")
+	}
 	if c.Database.Hostname == "" {
 		return fmt.Errorf("missing configuration option: database..hostname")
 	}
 	if c.Database.Database == "" {
 		return fmt.Errorf("missing configuration option: database..database")
 	}
+	durations := map[string]string{
+		"general..indicatorttl":      c.General.IndicatorTTL,
+		"general..indicatorhalflife": c.General.IndicatorHalfLife,
+		"general..retentionevery":    c.General.RetentionEvery,
+		"general..retentionmaxage":   c.General.RetentionMaxAge,
+		"general..decommissionevery": c.General.DecommissionEvery,
+		"general..decommissionafter": c.General.DecommissionAfter,
+		"ingest..pollevery":          c.Ingest.PollEvery,
+	}
+	for k, v := range c.EventSource {
+		durations["eventsource."+k+".ttl"] = v.TTL
+		durations["eventsource."+k+".halflife"] = v.HalfLife
+	}
+	// Intervals, ages, TTLs and half-lives must be greater than zero; an interval of zero
+	// would run a routine continuously, an age or TTL of zero or less would apply to every
+	// asset or indicator, and a negative half-life would increase the probability of older
+	// indicators
+	positive := map[string]bool{
+		"general..indicatorttl":      true,
+		"general..indicatorhalflife": true,
+		"general..retentionevery":    true,
+		"general..retentionmaxage":   true,
+		"general..decommissionevery": true,
+		"general..decommissionafter": true,
+	}
+	for k := range c.EventSource {
+		positive["eventsource."+k+".ttl"] = true
+		positive["eventsource."+k+".halflife"] = true
+	}
+	for k, v := range durations {
+		if v == "" {
+			continue
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid configuration option: %v: %v", k, err)
+		}
+		if positive[k] && d <= 0 {
+			return fmt.Errorf("invalid configuration option: %v: must be greater than zero", k)
+		}
+	}
+	switch c.AssetTypes.Unknown {
+	case "", "allow", "reject":
+	default:
+		return fmt.Errorf("invalid configuration option: assettypes..unknown")
+	}
+	_, err := assetTypeMap()
+	if err != nil {
+		return fmt.Errorf("invalid configuration option: assettypes..map: %v", err)
+	}
 	return nil
 }
 
@@ -167,10 +273,20 @@ func createPid() error {
 }
 
 func main() {
-	var cfgpath string
+	var (
+		cfgpath      string
+		importpath   string
+		importformat string
+		importdryrun bool
+		normalize    bool
+	)
 
 	flag.StringVar(&cfgpath, "f", "/etc/serviceapi.conf", "path to configuration file")
 	flag.StringVar(&pidFile, "p", "/var/run/serviceapi.pid", "path to pid file")
+	flag.StringVar(&importpath, "import", "", "import assets from file and exit")
+	flag.StringVar(&importformat, "importformat", "", "import file format (csv or json)")
+	flag.BoolVar(&importdryrun, "dryrun", false, "report import or normalize changes without making them")
+	flag.BoolVar(&normalize, "normalize", false, "normalize names of existing assets and exit")
 	flag.Parse()
 
 	err := gcfg.ReadFileInto(&cfg, cfgpath)
@@ -202,12 +318,43 @@ func main() {
 		os.Exit(1)
 	}
 
+	err = schemaLoad()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+
 	err = dbInit()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
 	}
 
+	// In import or normalize mode, run the operation and exit without starting the service
+	if importpath != "" || normalize {
+		logChan = make(chan string, 64)
+		wg.Add(1)
+		go func() {
+			for x := range logChan {
+				fmt.Fprintf(os.Stderr, "%v\n", x)
+			}
+			wg.Done()
+		}()
+		if normalize {
+			err = assetTypeNormalizeCLI(importdryrun)
+		} else {
+			err = importCLI(importpath, importformat, importdryrun)
+		}
+		// Make sure all log messages are written before exiting
+		close(logChan)
+		wg.Wait()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	sigch := make(chan os.Signal, 1)
 	signal.Notify(sigch, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
@@ -238,6 +385,40 @@ func main() {
 			time.Sleep(5 * time.Second)
 		}
 	}()
+	if cfg.General.RetentionEvery != "" {
+		go func() {
+			logf("spawning indicator retention routine")
+			sd, _ := time.ParseDuration(cfg.General.RetentionEvery)
+			for {
+				indicatorRetention()
+				time.Sleep(sd)
+			}
+		}()
+	}
+	if cfg.General.DecommissionEvery != "" {
+		go func() {
+			logf("spawning asset lifecycle routine")
+			sd, _ := time.ParseDuration(cfg.General.DecommissionEvery)
+			for {
+				assetLifecycle()
+				time.Sleep(sd)
+			}
+		}()
+	}
+	srcs, err := ingestSources()
+	if err != nil {
+		logf("ingest: %v", err)
+		doExit(1)
+	}
+	for _, x := range srcs {
+		go func(src ingestSource) {
+			sd, err := time.ParseDuration(cfg.Ingest.PollEvery)
+			if err != nil {
+				sd, _ = time.ParseDuration("10s")
+			}
+			ingestRun(src, sd)
+		}(x)
+	}
 	go func() {
 		logf("spawning interlink manager")
 		for {
@@ -278,6 +459,31 @@ func muxRouter() *mux.Router {
 	r := mux.NewRouter()
 	s := r.PathPrefix("/api/v1").Subrouter()
 	s.HandleFunc("/indicator", authenticate(serviceIndicator, authWriteIndicator)).Methods("POST")
+	s.HandleFunc("/indicators", authenticate(serviceIndicators, authWriteIndicator)).Methods("POST")
+	s.HandleFunc("/indicators/search", authenticate(serviceIndicatorSearch, authReadRisk)).Methods("GET", "POST")
+	s.HandleFunc("/asset/indicators", authenticate(serviceAssetIndicators, authReadRisk)).Methods("GET")
+	s.HandleFunc("/asset/id", authenticate(serviceGetAsset, authReadRisk)).Methods("GET")
+	s.HandleFunc("/asset/risk", authenticate(serviceGetAssetRisk, authReadRisk)).Methods("GET")
+	s.HandleFunc("/asset/create", authenticate(serviceCreateAsset, authWriteAsset)).Methods("POST")
+	s.HandleFunc("/asset/update", authenticate(serviceUpdateAsset, authWriteAsset)).Methods("POST")
+	s.HandleFunc("/asset/delete", authenticate(serviceDeleteAsset, authWriteAsset)).Methods("POST")
+	s.HandleFunc("/asset/alias/add", authenticate(serviceAddAlias, authWriteAsset)).Methods("POST")
+	s.HandleFunc("/asset/alias/delete", authenticate(serviceDeleteAlias, authWriteAsset)).Methods("POST")
+	s.HandleFunc("/asset/labels/set", authenticate(serviceSetLabels, authWriteAsset)).Methods("POST")
+	s.HandleFunc("/asset/labels/delete", authenticate(serviceDeleteLabel, authWriteAsset)).Methods("POST")
+	s.HandleFunc("/asset/state", authenticate(serviceAssetState, authWriteAsset)).Methods("POST")
+	s.HandleFunc("/asset/ipmap/add", authenticate(serviceAddIPMap, authWriteAsset)).Methods("POST")
+	s.HandleFunc("/asset/ipmap/delete", authenticate(serviceDeleteIPMap, authWriteAsset)).Methods("POST")
+	s.HandleFunc("/asset/merge", authenticate(serviceMergeAssets, authWriteAsset)).Methods("POST")
+	s.HandleFunc("/assets/import", authenticate(serviceAssetImport, authWriteAsset)).Methods("POST")
+	s.HandleFunc("/assets/duplicates", authenticate(serviceAssetDuplicates, authReadRisk)).Methods("GET")
+	s.HandleFunc("/assets", authenticate(serviceAssets, authReadRisk)).Methods("GET")
+	s.HandleFunc("/assets/stale", authenticate(serviceStaleAssets, authReadOwner)).Methods("GET")
+	s.HandleFunc("/dependencies", authenticate(serviceDependencies, authReadRisk)).Methods("GET")
+	s.HandleFunc("/dependency/service/add", authenticate(serviceAddServiceDependency, authWriteRRA)).Methods("POST")
+	s.HandleFunc("/dependency/service/delete", authenticate(serviceDeleteServiceDependency, authWriteRRA)).Methods("POST")
+	s.HandleFunc("/dependency/asset/add", authenticate(serviceAddAssetDependency, authWriteAsset)).Methods("POST")
+	s.HandleFunc("/dependency/asset/delete", authenticate(serviceDeleteAssetDependency, authWriteAsset)).Methods("POST")
 	s.HandleFunc("/assetgroups", authenticate(serviceAssetGroups, authReadRisk)).Methods("GET")
 	s.HandleFunc("/assetgroup/id", authenticate(serviceGetAssetGroup, authReadRisk)).Methods("GET")
 	s.HandleFunc("/rras", authenticate(serviceRRAs, authReadRisk)).Methods("GET")
@@ -287,6 +493,10 @@ func muxRouter() *mux.Router {
 	s.HandleFunc("/rra/risk", authenticate(serviceGetRRARisk, authReadRisk)).Methods("GET")
 	s.HandleFunc("/owners", authenticate(serviceOwners, authReadOwner)).Methods("GET")
 	s.HandleFunc("/owner/hostname", authenticate(serviceHostOwner, authReadOwner)).Methods("GET")
+	s.HandleFunc("/owner/lookup", authenticate(serviceOwnerLookup, authReadOwner)).Methods("POST")
+	s.HandleFunc("/owner/summary", authenticate(serviceOwnerSummary, authReadRisk)).Methods("GET")
+	s.HandleFunc("/owner/contact", authenticate(serviceSetOwnerContact, authWriteAsset)).Methods("POST")
+	s.HandleFunc("/owner/contact/delete", authenticate(serviceDeleteOwnerContact, authWriteAsset)).Methods("POST")
 	s.HandleFunc("/ping", servicePing).Methods("GET")
 	http.Handle("/", context.ClearHandler(r))
 	return r
@@ -336,6 +546,10 @@ func authenticate(runfunc func(http.ResponseWriter, *http.Request), p int) func(
 			if authpeer.writerra {
 				haveperm = true
 			}
+		case authWriteAsset:
+			if authpeer.writeasset {
+				haveperm = true
+			}
 		default:
 			http.Error(rw, "unauthorized", http.StatusUnauthorized)
 			return
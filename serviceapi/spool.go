@@ -0,0 +1,84 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor:
+// - Aaron Meihm ameihm@mozilla.com
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// Maximum number of spool files processed in a single receive
+const spoolMaxFiles = 100
+
+// ingestSpool is an ingestion source which processes files containing indicators that
+// are written into a spool directory. Files must have a .json or .ndjson extension, and
+// publishers should write files using another name (or in another directory on the same
+// file system) and rename them into place once they are complete.
+type ingestSpool struct {
+	dir           string
+	deadLetterDir string
+}
+
+// newIngestSpool returns a spool directory ingestion source for dir, if deadLetterDir is
+// not set a deadletter directory within dir is used
+func newIngestSpool(dir string, deadLetterDir string) (*ingestSpool, error) {
+	if deadLetterDir == "" {
+		deadLetterDir = path.Join(dir, "deadletter")
+	}
+	err := os.MkdirAll(deadLetterDir, 0750)
+	if err != nil {
+		return nil, err
+	}
+	return &ingestSpool{dir: dir, deadLetterDir: deadLetterDir}, nil
+}
+
+func (s *ingestSpool) name() string {
+	return "spool " + s.dir
+}
+
+func (s *ingestSpool) receive() (ret []ingestMessage, err error) {
+	dirlist, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return
+	}
+	for _, f := range dirlist {
+		if len(ret) >= spoolMaxFiles {
+			break
+		}
+		if !f.Mode().IsRegular() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		if !strings.HasSuffix(f.Name(), ".json") && !strings.HasSuffix(f.Name(), ".ndjson") {
+			continue
+		}
+		fpath := path.Join(s.dir, f.Name())
+		buf, err := ioutil.ReadFile(fpath)
+		if err != nil {
+			return ret, err
+		}
+		ret = append(ret, ingestMessage{id: fpath, body: buf})
+	}
+	return
+}
+
+func (s *ingestSpool) done(m ingestMessage) error {
+	return os.Remove(m.id)
+}
+
+// deadLetter writes body to a file with the same name as the spool file in the dead-letter
+// directory, and the reason to an accompanying file with a .reason extension
+func (s *ingestSpool) deadLetter(m ingestMessage, body []byte, reason string) error {
+	dpath := path.Join(s.deadLetterDir, path.Base(m.id))
+	err := ioutil.WriteFile(dpath, body, 0640)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dpath+".reason", []byte(reason+"\n"), 0640)
+}
@@ -0,0 +1,96 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor:
+// - Aaron Meihm ameihm@mozilla.com
+
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// ingestSQS is an ingestion source which consumes indicators from an SQS queue, where
+// each message body contains one or more indicators
+type ingestSQS struct {
+	queueURL      string
+	deadLetterURL string
+	svc           *sqs.SQS
+}
+
+// newIngestSQS returns an SQS ingestion source for queueURL. If endpoint is set, it is
+// used in place of the default SQS endpoint for the region (for example to make use of
+// a local SQS compatible service). Messages, or the indicators from a message, that cannot
+// be processed are sent to the queue at deadLetterURL.
+func newIngestSQS(queueURL string, deadLetterURL string, region string, endpoint string) *ingestSQS {
+	awscfg := &aws.Config{
+		Region: &region,
+	}
+	if endpoint != "" {
+		awscfg.Endpoint = &endpoint
+	}
+	sess := session.Must(session.NewSession())
+	return &ingestSQS{
+		queueURL:      queueURL,
+		deadLetterURL: deadLetterURL,
+		svc:           sqs.New(sess, awscfg),
+	}
+}
+
+func (s *ingestSQS) name() string {
+	return "sqs " + s.queueURL
+}
+
+func (s *ingestSQS) receive() (ret []ingestMessage, err error) {
+	result, err := s.svc.ReceiveMessage(&sqs.ReceiveMessageInput{
+		QueueUrl:            &s.queueURL,
+		MaxNumberOfMessages: aws.Int64(10),
+		WaitTimeSeconds:     aws.Int64(20),
+	})
+	if err != nil {
+		return
+	}
+	for _, x := range result.Messages {
+		if x.Body == nil || x.MessageId == nil || x.ReceiptHandle == nil {
+			continue
+		}
+		ret = append(ret, ingestMessage{
+			id:   *x.MessageId,
+			body: []byte(*x.Body),
+			ref:  *x.ReceiptHandle,
+		})
+	}
+	return
+}
+
+func (s *ingestSQS) done(m ingestMessage) error {
+	handle := m.ref.(string)
+	_, err := s.svc.DeleteMessage(&sqs.DeleteMessageInput{
+		QueueUrl:      &s.queueURL,
+		ReceiptHandle: &handle,
+	})
+	return err
+}
+
+// deadLetter sends body to the dead-letter queue, with the reason and the original
+// message ID included as message attributes
+func (s *ingestSQS) deadLetter(m ingestMessage, body []byte, reason string) error {
+	_, err := s.svc.SendMessage(&sqs.SendMessageInput{
+		QueueUrl:    &s.deadLetterURL,
+		MessageBody: aws.String(string(body)),
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			"reason": {
+				DataType:    aws.String("String"),
+				StringValue: aws.String(reason),
+			},
+			"original_message_id": {
+				DataType:    aws.String("String"),
+				StringValue: aws.String(m.id),
+			},
+		},
+	})
+	return err
+}
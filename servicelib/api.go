@@ -21,3 +21,217 @@ type RRAsResponse struct {
 type RisksResponse struct {
 	Risks []Risk `json:"risks"`
 }
+
+// DependenciesResponse describes the response to a dependency list request
+type DependenciesResponse struct {
+	Services []ServiceDependency `json:"services"`
+	Assets   []AssetDependency   `json:"assets"`
+}
+
+// OwnerMapResponse describes the response to an owner map request
+type OwnerMapResponse struct {
+	Owners []OwnerMapEntry `json:"owners"`
+}
+
+// HostOwnerResponse describes the response to a hostname owner request. The owner of the
+// first matching asset is included at the top level of the response, and all matching
+// assets are included in Matches.
+type HostOwnerResponse struct {
+	Owner
+	Matches []OwnerLookupMatch `json:"matches"`
+}
+
+// OwnerLookup describes a bulk owner lookup request for hostnames and websites, optionally
+// limited to assets in a given zone
+type OwnerLookup struct {
+	Hostnames []string `json:"hostnames,omitempty"`
+	Websites  []string `json:"websites,omitempty"`
+	Zone      string   `json:"zone,omitempty"`
+}
+
+// OwnerLookupMatch describes an asset matched in an owner lookup along with the owner
+type OwnerLookupMatch struct {
+	AssetID int    `json:"asset_id"`
+	Type    string `json:"asset_type"`
+	Name    string `json:"asset_identifier"`
+	Zone    string `json:"zone"`
+	Owner   Owner  `json:"owner"`
+}
+
+// OwnerLookupResult describes the result of an owner lookup for a single hostname or website
+type OwnerLookupResult struct {
+	Query   string             `json:"query"`           // Hostname or website from the request
+	Type    string             `json:"asset_type"`      // Asset type the query was for
+	Matches []OwnerLookupMatch `json:"matches"`         // Matching assets
+	Error   string             `json:"error,omitempty"` // Error description if query was invalid
+}
+
+// OwnerLookupResponse describes the response to a bulk owner lookup request
+type OwnerLookupResponse struct {
+	Results []OwnerLookupResult `json:"results"`
+}
+
+// OwnerSummary describes the active assets an owner is responsible for, the services those
+// assets support, and assets which may need attention
+type OwnerSummary struct {
+	Owner     Owner                 `json:"owner"`
+	Assets    map[string][]Asset    `json:"assets"`    // Active assets by asset type
+	Zones     map[string]int        `json:"zones"`     // Number of active assets in each zone
+	Services  []OwnerSummaryService `json:"services"`  // Services the assets support
+	Attention []OwnerSummaryAsset   `json:"attention"` // Assets with stale or high likelihood indicators
+}
+
+// OwnerSummaryService describes a service supported by assets in an OwnerSummary
+type OwnerSummaryService struct {
+	RRAID  int        `json:"rra_id"`
+	Name   string     `json:"name"`
+	Assets int        `json:"asset_count"` // Number of assets for the owner supporting the service
+	Risk   RiskValues `json:"risk"`        // Current risk for the service
+}
+
+// OwnerSummaryAsset describes an asset in an OwnerSummary which has stale or high
+// likelihood indicators
+type OwnerSummaryAsset struct {
+	AssetID    int         `json:"asset_id"`
+	Type       string      `json:"asset_type"`
+	Name       string      `json:"asset_identifier"`
+	Zone       string      `json:"zone"`
+	Indicators []Indicator `json:"indicators"` // Stale or high likelihood indicators for the asset
+}
+
+// Status values used in IndicatorResult
+const (
+	IndicatorStatusOK        = "ok"        // Indicator was stored
+	IndicatorStatusDuplicate = "duplicate" // Indicator with the same ID was already stored
+	IndicatorStatusConflict  = "conflict"  // Indicator conflicts with an existing indicator
+	IndicatorStatusError     = "error"     // Indicator was invalid or could not be stored
+)
+
+// IndicatorResult describes the result of processing a single indicator that was
+// submitted as part of a batch
+type IndicatorResult struct {
+	Index  int    `json:"index"`           // Index of the indicator in the submitted batch
+	Status string `json:"status"`          // Processing status
+	ID     int    `json:"id,omitempty"`    // Indicator ID if the indicator was stored
+	Error  string `json:"error,omitempty"` // Error description if processing failed
+}
+
+// Accepted returns true if the indicator described by the result has been stored, either
+// as a result of this submission or a previous one
+func (r *IndicatorResult) Accepted() bool {
+	return r.Status == IndicatorStatusOK || r.Status == IndicatorStatusDuplicate
+}
+
+// IndicatorResponse describes the response to an indicator submission
+type IndicatorResponse struct {
+	ID          int    `json:"id"`                     // Indicator ID
+	IndicatorID string `json:"indicator_id,omitempty"` // Client supplied indicator ID
+	Duplicate   bool   `json:"duplicate"`              // True if indicator was previously stored
+}
+
+// IndicatorsResponse describes the response to an indicator batch submission
+type IndicatorsResponse struct {
+	Accepted int               `json:"accepted"`
+	Failed   int               `json:"failed"`
+	Results  []IndicatorResult `json:"results"`
+}
+
+// AssetIndicatorsResponse describes the response to an asset indicator history
+// request
+type AssetIndicatorsResponse struct {
+	AssetID    int         `json:"asset_id"`
+	Total      int         `json:"total"`  // Total number of indicators matching the request
+	Limit      int         `json:"limit"`  // Maximum number of indicators in this response
+	Offset     int         `json:"offset"` // Offset of the first indicator in this response
+	Indicators []Indicator `json:"indicators"`
+}
+
+// StaleAssetsResponse describes the response to a stale asset report request, which
+// lists assets that have not had an indicator within a given number of days, including
+// assets that have never had an indicator
+type StaleAssetsResponse struct {
+	Days   int               `json:"days"`
+	Owners []StaleAssetOwner `json:"owners"`
+}
+
+// StaleAssetOwner describes the stale assets for a given owner in a StaleAssetsResponse
+type StaleAssetOwner struct {
+	Owner  Owner   `json:"owner"`
+	Assets []Asset `json:"assets"`
+}
+
+// IndicatorSearchResult is an indicator returned from an indicator search, along with
+// the asset the indicator is associated with
+type IndicatorSearchResult struct {
+	Indicator Indicator `json:"indicator"`
+	Asset     Asset     `json:"asset"` // Asset details, without indicators
+}
+
+// IndicatorSearchResponse describes the response to an indicator search
+type IndicatorSearchResponse struct {
+	Total   int                     `json:"total"`  // Total number of matching indicators
+	Limit   int                     `json:"limit"`  // Maximum number of results in this response
+	Offset  int                     `json:"offset"` // Offset of the first result in this response
+	Results []IndicatorSearchResult `json:"results"`
+}
+
+// AssetsResponse describes the response to an asset listing
+type AssetsResponse struct {
+	Total  int     `json:"total"`  // Total number of matching assets
+	Limit  int     `json:"limit"`  // Maximum number of assets in this response
+	Offset int     `json:"offset"` // Offset of the first asset in this response
+	Assets []Asset `json:"assets"`
+}
+
+// AssetDuplicatesResponse is the response to a request for duplicate asset suggestions
+type AssetDuplicatesResponse struct {
+	Duplicates []AssetDuplicate `json:"duplicates"`
+}
+
+// Actions used in AssetImportResult
+const (
+	AssetImportCreate    = "create"    // Asset was created
+	AssetImportUpdate    = "update"    // Ownership or group details were updated
+	AssetImportUnchanged = "unchanged" // Asset exists and no changes were required
+	AssetImportConflict  = "conflict"  // Record conflicts with an existing asset or record
+	AssetImportError     = "error"     // Record was invalid
+)
+
+// AssetImportResult describes the result of importing a single record
+type AssetImportResult struct {
+	Index   int    `json:"index"` // Index of the record in the import
+	Action  string `json:"action"`
+	AssetID int    `json:"asset_id,omitempty"`
+	Type    string `json:"asset_type,omitempty"`       // Normalized asset type
+	Name    string `json:"asset_identifier,omitempty"` // Normalized asset name
+	Zone    string `json:"zone,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// AssetImportResponse describes the response to a bulk asset import
+type AssetImportResponse struct {
+	DryRun    bool                `json:"dry_run"` // If true, no changes were made
+	Created   int                 `json:"created"`
+	Updated   int                 `json:"updated"`
+	Unchanged int                 `json:"unchanged"`
+	Conflicts int                 `json:"conflicts"`
+	Errors    int                 `json:"errors"`
+	Results   []AssetImportResult `json:"results"`
+}
+
+// Add adds result r to the response, updating the totals
+func (a *AssetImportResponse) Add(r AssetImportResult) {
+	switch r.Action {
+	case AssetImportCreate:
+		a.Created++
+	case AssetImportUpdate:
+		a.Updated++
+	case AssetImportUnchanged:
+		a.Unchanged++
+	case AssetImportConflict:
+		a.Conflicts++
+	case AssetImportError:
+		a.Errors++
+	}
+	a.Results = append(a.Results, r)
+}
@@ -9,7 +9,11 @@ package servicelib
 
 import (
 	"errors"
+	"fmt"
+	"regexp"
+	"strings"
 	"time"
+	"unicode"
 )
 
 // Asset describes an asset stored within serviceapi
@@ -19,23 +23,203 @@ import (
 // all indicators seen over a time period (e.g., we should not include more than one indicator
 // for any given event source)
 type Asset struct {
-	ID            int         `json:"id"`                         // Asset ID
-	Type          string      `json:"asset_type,omitempty"`       // Asset type (e.g., hostname, website, etc)
-	Name          string      `json:"asset_identifier,omitempty"` // Asset name
-	Zone          string      `json:"zone,omitempty"`             // Asset zone
-	AssetGroupID  int         `json:"asset_group_id,omitempty"`   // Group ID asset is in
-	LastIndicator time.Time   `json:"last_indicator,omitempty"`   // Time last indicator was received for asset
-	Owner         Owner       `json:"owner"`                      // Ownership details
-	Indicators    []Indicator `json:"indicators"`                 // Most recent indicators for asset
-}
-
-// Validate ensures an Asset is formatted correctly
-func (a *Asset) Validate() error {
+	ID             int                `json:"id"`                         // Asset ID
+	Type           string             `json:"asset_type,omitempty"`       // Asset type (e.g., hostname, website, etc)
+	Name           string             `json:"asset_identifier,omitempty"` // Asset name
+	Zone           string             `json:"zone,omitempty"`             // Asset zone
+	AssetGroupID   int                `json:"asset_group_id,omitempty"`   // Group ID asset is in
+	FirstIndicator time.Time          `json:"first_indicator,omitempty"`  // Time first indicator was received for asset
+	LastIndicator  time.Time          `json:"last_indicator,omitempty"`   // Time last indicator was received for asset
+	Manual         bool               `json:"manual"`                     // Asset was registered manually
+	State          string             `json:"state,omitempty"`            // Lifecycle state of asset
+	Owner          Owner              `json:"owner"`                      // Ownership details
+	Indicators     []Indicator        `json:"indicators"`                 // Most recent indicators for asset
+	EventSources   []AssetEventSource `json:"event_sources,omitempty"`    // Event sources reporting on asset
+	Aliases        []AssetAlias       `json:"aliases,omitempty"`          // Alternate identities for asset
+	Labels         map[string]string  `json:"labels,omitempty"`           // Key/value labels for asset
+	MappedAssets   []int              `json:"mapped_assets,omitempty"`    // Hostname assets for an ip asset, or ip assets for a hostname
+}
+
+// AssetIPMapping describes a mapping between an ip asset and a hostname asset
+type AssetIPMapping struct {
+	IPAssetID       int `json:"ip_asset_id"`
+	HostnameAssetID int `json:"hostname_asset_id"`
+}
+
+// Validate ensures an AssetIPMapping is formatted correctly
+func (m *AssetIPMapping) Validate() error {
+	if m.IPAssetID == 0 || m.HostnameAssetID == 0 {
+		return errors.New("mapping asset id missing")
+	}
+	return nil
+}
+
+// AssetLabels describes labels to be set on an asset
+type AssetLabels struct {
+	AssetID int               `json:"asset_id"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// Validate ensures AssetLabels is formatted correctly
+func (l *AssetLabels) Validate() error {
+	if l.AssetID == 0 {
+		return errors.New("label asset id missing")
+	}
+	if len(l.Labels) == 0 {
+		return errors.New("no labels specified")
+	}
+	for k, v := range l.Labels {
+		err := ValidateLabel(k, v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var labelKeyRe = regexp.MustCompile("^[A-Za-z0-9_./-]+$")
+
+// ValidateLabel ensures a label key and value are valid; keys may contain letters,
+// digits and the characters _ . / - and values must be non-empty and not contain
+// whitespace so labels can be referenced in interlink rules
+func ValidateLabel(key, value string) error {
+	if !labelKeyRe.MatchString(key) {
+		return fmt.Errorf("invalid label key %q", key)
+	}
+	if value == "" || strings.IndexFunc(value, unicode.IsSpace) != -1 {
+		return fmt.Errorf("invalid value for label %q", key)
+	}
+	return nil
+}
+
+// AssetAlias describes an alternate type, name and zone that resolves to an asset; an
+// indicator that matches an alias is associated with the asset the alias refers to
+type AssetAlias struct {
+	ID      int    `json:"id"`
+	AssetID int    `json:"asset_id"`         // Asset the alias refers to
+	Type    string `json:"asset_type"`       // Alias asset type
+	Name    string `json:"asset_identifier"` // Alias name
+	Zone    string `json:"zone"`             // Alias zone
+}
+
+// Validate ensures an AssetAlias is formatted correctly, and normalizes the asset type
+// and name if the asset type is known
+func (a *AssetAlias) Validate() (err error) {
+	if a.AssetID == 0 {
+		return errors.New("alias asset id missing")
+	}
+	if a.Type == "" {
+		return errors.New("alias asset type missing")
+	}
+	if a.Name == "" {
+		return errors.New("alias name missing")
+	}
+	a.Type, a.Name, err = NormalizeAsset(a.Type, a.Name)
+	return
+}
+
+// AssetMerge describes a request to merge asset SourceID into asset TargetID
+type AssetMerge struct {
+	SourceID int `json:"source_id"` // Asset that will be merged and removed
+	TargetID int `json:"target_id"` // Asset that will remain
+}
+
+// Validate ensures an AssetMerge is formatted correctly
+func (m *AssetMerge) Validate() error {
+	if m.SourceID == 0 || m.TargetID == 0 {
+		return errors.New("merge asset id missing")
+	}
+	if m.SourceID == m.TargetID {
+		return errors.New("cannot merge asset with itself")
+	}
+	return nil
+}
+
+// AssetDuplicate describes a set of assets that are likely duplicates of each other
+type AssetDuplicate struct {
+	Reason string  `json:"reason"` // Why the assets are suggested as duplicates
+	Assets []Asset `json:"assets"`
+}
+
+// Asset lifecycle states; only active assets are considered in risk calculations and
+// ownership reports
+const (
+	AssetStateActive         = "active"
+	AssetStateDecommissioned = "decommissioned"
+	AssetStateExcluded       = "excluded"
+)
+
+// ValidAssetState returns true if s is a valid asset lifecycle state
+func ValidAssetState(s string) bool {
+	switch s {
+	case AssetStateActive, AssetStateDecommissioned, AssetStateExcluded:
+		return true
+	}
+	return false
+}
+
+// AssetStateChange describes a request to change the lifecycle state of an asset
+type AssetStateChange struct {
+	AssetID int    `json:"asset_id"`
+	State   string `json:"state"`
+}
+
+// Validate ensures an AssetStateChange is formatted correctly
+func (s *AssetStateChange) Validate() error {
+	if s.AssetID == 0 {
+		return errors.New("asset id missing")
+	}
+	s.State = strings.ToLower(s.State)
+	if !ValidAssetState(s.State) {
+		return errors.New("invalid asset state")
+	}
+	return nil
+}
+
+// AssetEventSource describes when indicators were received for an asset from a given
+// event source
+type AssetEventSource struct {
+	EventSource    string    `json:"event_source"`
+	FirstIndicator time.Time `json:"first_indicator"` // Time first indicator was received from source
+	LastIndicator  time.Time `json:"last_indicator"`  // Time last indicator was received from source
+}
+
+// Validate ensures an Asset is formatted correctly, and normalizes the asset type and
+// name if the asset type is known
+func (a *Asset) Validate() (err error) {
 	if a.Type == "" {
 		return errors.New("asset type missing")
 	}
 	if a.Name == "" {
 		return errors.New("asset name missing")
 	}
-	return nil
+	a.Type, a.Name, err = NormalizeAsset(a.Type, a.Name)
+	return
+}
+
+// AssetImportRecord describes an asset in a bulk import, along with optional ownership
+// and asset group details. If the type is not set, the asset is assumed to be a hostname.
+type AssetImportRecord struct {
+	Type       string `json:"asset_type,omitempty"`
+	Name       string `json:"asset_identifier"`
+	Zone       string `json:"zone,omitempty"`
+	Operator   string `json:"operator,omitempty"`
+	Team       string `json:"team,omitempty"`
+	AssetGroup string `json:"assetgroup,omitempty"`
+}
+
+// Validate ensures an AssetImportRecord is formatted correctly, and normalizes the asset
+// type and name
+func (r *AssetImportRecord) Validate() (err error) {
+	if r.Type == "" {
+		r.Type = AssetTypeHostname
+	}
+	if r.Name == "" {
+		return errors.New("asset name missing")
+	}
+	if (r.Operator == "") != (r.Team == "") {
+		return errors.New("operator and team must be specified together")
+	}
+	r.Type, r.Name, err = NormalizeAsset(r.Type, r.Name)
+	return
 }
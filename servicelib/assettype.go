@@ -0,0 +1,213 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor:
+// - Aaron Meihm ameihm@mozilla.com
+
+package servicelib
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Known asset types
+const (
+	AssetTypeHostname       = "hostname"
+	AssetTypeWebsite        = "website"
+	AssetTypeIP             = "ip"
+	AssetTypeContainerImage = "container_image"
+	AssetTypeCloudAccount   = "cloud_account"
+	AssetTypeRepository     = "code_repository"
+)
+
+// assetType describes a known asset type, including alternate names publishers may use
+// for the type and the function used to normalize and validate asset names
+type assetType struct {
+	aliases   []string
+	normalize func(string) (string, error)
+}
+
+var assetTypes = map[string]assetType{
+	AssetTypeHostname: {
+		aliases:   []string{"host", "fqdn"},
+		normalize: normalizeHostname,
+	},
+	AssetTypeWebsite: {
+		aliases:   []string{"site", "url"},
+		normalize: normalizeWebsite,
+	},
+	AssetTypeIP: {
+		aliases:   []string{"ipaddress", "ip_address", "ipv4", "ipv6"},
+		normalize: normalizeIP,
+	},
+	AssetTypeContainerImage: {
+		aliases:   []string{"image", "docker_image", "containerimage"},
+		normalize: normalizeContainerImage,
+	},
+	AssetTypeCloudAccount: {
+		aliases:   []string{"account", "aws_account", "cloudaccount"},
+		normalize: normalizeCloudAccount,
+	},
+	AssetTypeRepository: {
+		aliases:   []string{"repository", "repo", "coderepository"},
+		normalize: normalizeRepository,
+	},
+}
+
+// AssetTypes returns the names of all known asset types
+func AssetTypes() (ret []string) {
+	for k := range assetTypes {
+		ret = append(ret, k)
+	}
+	return
+}
+
+// CanonicalAssetType returns the name of the known asset type t refers to; t is not case
+// sensitive and can be an alternate name for a type (e.g., host for hostname). If t is
+// not a known type, t is returned in lower case and known will be false.
+func CanonicalAssetType(t string) (ret string, known bool) {
+	ret = strings.ToLower(strings.TrimSpace(t))
+	if _, ok := assetTypes[ret]; ok {
+		return ret, true
+	}
+	for k, v := range assetTypes {
+		for _, a := range v.aliases {
+			if ret == a {
+				return k, true
+			}
+		}
+	}
+	return ret, false
+}
+
+// NormalizeAsset converts an asset type and name into canonical form, returning an error
+// if the name is not valid for the type. Names for unknown types are returned with
+// surrounding whitespace removed, but are otherwise unchanged.
+func NormalizeAsset(t, name string) (rett string, retname string, err error) {
+	rett, known := CanonicalAssetType(t)
+	retname = strings.TrimSpace(name)
+	if !known {
+		return
+	}
+	retname, err = assetTypes[rett].normalize(retname)
+	if err != nil {
+		err = fmt.Errorf("invalid %v name: %v", rett, err)
+	}
+	return
+}
+
+var hostnameRe = regexp.MustCompile(`^[a-z0-9_]([a-z0-9_-]*[a-z0-9_])?(\.[a-z0-9_]([a-z0-9_-]*[a-z0-9_])?)*$`)
+
+// normalizeHostname converts a hostname to lower case and removes any trailing dot
+func normalizeHostname(name string) (string, error) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if len(name) > 253 || !hostnameRe.MatchString(name) {
+		return "", errors.New("not a valid hostname")
+	}
+	return name, nil
+}
+
+// normalizeWebsite converts a website to the form [scheme://]host[:port][/path][?query] with
+// the scheme and host in lower case, and default ports, trailing slashes and any fragment
+// removed. The query is kept as is, since it can identify a different resource. A name
+// without a scheme is kept without one, so it continues to match existing assets and
+// interlink rules written for the name as it was submitted.
+func normalizeWebsite(name string) (string, error) {
+	scheme := strings.Contains(name, "://")
+	if !scheme {
+		name = "//" + name
+	}
+	u, err := url.Parse(name)
+	if err != nil {
+		return "", err
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if scheme && u.Scheme != "http" && u.Scheme != "https" {
+		return "", errors.New("unsupported scheme")
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == "" {
+		return "", errors.New("missing host")
+	}
+	port := u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	if port != "" {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if scheme {
+		host = u.Scheme + "://" + host
+	}
+	ret := host + strings.TrimRight(u.EscapedPath(), "/")
+	if u.RawQuery != "" {
+		ret += "?" + u.RawQuery
+	}
+	return ret, nil
+}
+
+// normalizeIP converts an IP address into its canonical string form
+func normalizeIP(name string) (string, error) {
+	ip := net.ParseIP(name)
+	if ip == nil {
+		return "", errors.New("not a valid address")
+	}
+	return ip.String(), nil
+}
+
+// normalizeContainerImage converts the repository part of an image reference to lower
+// case, and removes the default registry and namespace (e.g., docker.io/library/nginx
+// becomes nginx). Tags and digests are kept as is.
+func normalizeContainerImage(name string) (string, error) {
+	repo, ref := name, ""
+	if n := strings.Index(repo, "@"); n != -1 {
+		repo, ref = repo[:n], repo[n:]
+	} else if n := strings.LastIndex(repo, ":"); n > strings.LastIndex(repo, "/") {
+		repo, ref = repo[:n], repo[n:]
+	}
+	repo = strings.ToLower(repo)
+	repo = strings.TrimPrefix(repo, "docker.io/")
+	repo = strings.TrimPrefix(repo, "library/")
+	if repo == "" || strings.ContainsAny(repo, " \t") || ref == ":" || ref == "@" {
+		return "", errors.New("not a valid image reference")
+	}
+	return repo + ref, nil
+}
+
+// normalizeCloudAccount converts a cloud account identifier to lower case
+func normalizeCloudAccount(name string) (string, error) {
+	name = strings.ToLower(name)
+	if strings.ContainsAny(name, " \t/") {
+		return "", errors.New("not a valid account identifier")
+	}
+	return name, nil
+}
+
+// normalizeRepository converts a code repository URL into the form host/path, removing
+// any scheme, user, .git suffix and trailing slashes (e.g., git@github.com:org/repo.git
+// becomes github.com/org/repo)
+func normalizeRepository(name string) (string, error) {
+	if n := strings.Index(name, "://"); n != -1 {
+		name = name[n+3:]
+	} else if n := strings.Index(name, ":"); n != -1 {
+		// scp style reference such as git@github.com:org/repo
+		name = name[:n] + "/" + name[n+1:]
+	}
+	if n := strings.Index(name, "@"); n != -1 && n < strings.Index(name, "/") {
+		name = name[n+1:]
+	}
+	name = strings.TrimSuffix(strings.TrimRight(name, "/"), ".git")
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", errors.New("not a valid repository")
+	}
+	return strings.ToLower(parts[0]) + "/" + parts[1], nil
+}
@@ -0,0 +1,47 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor:
+// - Aaron Meihm ameihm@mozilla.com
+
+package servicelib
+
+import (
+	"errors"
+)
+
+// ServiceDependency describes a dependency of one service on another service, where
+// services are identified using the service name from the RRA
+type ServiceDependency struct {
+	Service   string `json:"service"`    // Dependent service
+	DependsOn string `json:"depends_on"` // Service that Service depends on
+	Manual    bool   `json:"manual"`     // Dependency was added through the API
+}
+
+// Validate ensures a ServiceDependency is formatted correctly
+func (d *ServiceDependency) Validate() error {
+	if d.Service == "" || d.DependsOn == "" {
+		return errors.New("dependency service name missing")
+	}
+	if d.Service == d.DependsOn {
+		return errors.New("service cannot depend on itself")
+	}
+	return nil
+}
+
+// AssetDependency describes an asset which supports an asset group without being a member
+// of the group, for example a load balancer or a shared database used by the group
+type AssetDependency struct {
+	AssetID      int  `json:"asset_id"`       // Asset ID of supporting asset
+	AssetGroupID int  `json:"asset_group_id"` // Group ID asset supports
+	Manual       bool `json:"manual"`         // Dependency was added through the API
+}
+
+// Validate ensures an AssetDependency is formatted correctly
+func (d *AssetDependency) Validate() error {
+	if d.AssetID == 0 || d.AssetGroupID == 0 {
+		return errors.New("dependency asset or asset group id missing")
+	}
+	return nil
+}
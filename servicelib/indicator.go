@@ -9,6 +9,7 @@ package servicelib
 
 import (
 	"errors"
+	"github.com/pborman/uuid"
 	"strings"
 	"time"
 )
@@ -17,15 +18,21 @@ import (
 // indicators are associated with assets
 type Indicator struct {
 	ID          int         `json:"id"`
+	IndicatorID string      `json:"indicator_id,omitempty"`
 	EventSource string      `json:"event_source,omitempty"`
 	Timestamp   time.Time   `json:"timestamp_utc"`
 	Likelihood  string      `json:"likelihood_indicator"`
 	Details     interface{} `json:"details,omitempty"`
+	Stale       bool        `json:"stale"` // True if the indicator has expired
 }
 
 // RawIndicator describes an indicator as would be submitted to serviceapi from an
 // event publisher
+//
+// IndicatorID is an optional client supplied UUID. If it is set, resubmitting the same
+// indicator is idempotent.
 type RawIndicator struct {
+	IndicatorID string      `json:"indicator_id,omitempty"`
 	Type        string      `json:"asset_type,omitempty"`
 	Name        string      `json:"asset_identifier,omitempty"`
 	Zone        string      `json:"zone,omitempty"`
@@ -36,20 +43,32 @@ type RawIndicator struct {
 	Details     interface{} `json:"details,omitempty"`
 }
 
-// Validate ensures a RawIndicator is formatted correctly
-func (i *RawIndicator) Validate() error {
+// Validate ensures a RawIndicator is formatted correctly, and normalizes the asset type
+// and name if the asset type is known
+func (i *RawIndicator) Validate() (err error) {
 	if i.Type == "" {
 		return errors.New("indicator asset type missing")
 	}
 	if i.Name == "" {
 		return errors.New("indicator asset name/identifier missing")
 	}
+	i.Type, i.Name, err = NormalizeAsset(i.Type, i.Name)
+	if err != nil {
+		return err
+	}
 	if i.EventSource == "" {
 		return errors.New("indicator event source missing")
 	}
 	if i.Timestamp.IsZero() {
 		return errors.New("indicator has invalid time stamp")
 	}
+	if i.IndicatorID != "" {
+		id := uuid.Parse(i.IndicatorID)
+		if id == nil {
+			return errors.New("indicator has invalid indicator id")
+		}
+		i.IndicatorID = id.String()
+	}
 	i.Likelihood = strings.ToLower(i.Likelihood)
 	switch i.Likelihood {
 	case "maximum":
@@ -62,3 +81,47 @@ func (i *RawIndicator) Validate() error {
 	}
 	return nil
 }
+
+// IndicatorSearch describes a search for indicators; all criteria that are set must
+// match for an indicator to be returned
+type IndicatorSearch struct {
+	Contains    interface{}          `json:"contains,omitempty"`             // Document that must be contained in details
+	Paths       []IndicatorPathMatch `json:"paths,omitempty"`                // Path expressions that must match details
+	EventSource string               `json:"event_source,omitempty"`         // Event source name
+	Likelihood  string               `json:"likelihood_indicator,omitempty"` // Likelihood label
+	Since       time.Time            `json:"since,omitempty"`                // Earliest indicator time
+	Until       time.Time            `json:"until,omitempty"`                // Latest indicator time
+	Limit       int                  `json:"limit,omitempty"`                // Maximum number of results
+	Offset      int                  `json:"offset,omitempty"`               // Offset of first result
+}
+
+// IndicatorPathMatch describes a JSONPath expression (e.g., $.vuln.cve[0]) that must exist
+// in the details of an indicator. If Value is set, the value at the path must also be equal
+// to Value.
+type IndicatorPathMatch struct {
+	Path  string  `json:"path"`
+	Value *string `json:"value,omitempty"`
+}
+
+// Validate ensures an IndicatorSearch is formatted correctly
+func (s *IndicatorSearch) Validate() error {
+	if s.Likelihood != "" {
+		s.Likelihood = strings.ToLower(s.Likelihood)
+		_, err := ImpactValueFromLabel(s.Likelihood)
+		if err != nil {
+			return errors.New("search has invalid likelihood value")
+		}
+	}
+	for _, x := range s.Paths {
+		if x.Path == "" {
+			return errors.New("search has empty path expression")
+		}
+	}
+	if s.Offset < 0 {
+		return errors.New("search has invalid offset value")
+	}
+	if !s.Since.IsZero() && !s.Until.IsZero() && s.Until.Before(s.Since) {
+		return errors.New("search until time is before since time")
+	}
+	return nil
+}
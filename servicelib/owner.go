@@ -7,10 +7,63 @@
 
 package servicelib
 
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+)
+
 // Owner describes ownership information for an asset
 type Owner struct {
 	ID        int    `json:"id"`                  // Owner ID
 	Operator  string `json:"operator,omitempty"`  // The operator (e.g., group)
 	Team      string `json:"team,omitempty"`      // Team (e.g., team within the group)
 	TriageKey string `json:"triagekey,omitempty"` // Triage key, used for integrated escalation tools
+	OwnerContact
+}
+
+// OwnerContact describes contact and escalation details for an owner
+type OwnerContact struct {
+	Email       string `json:"email,omitempty"`       // Contact email address
+	Chat        string `json:"chat,omitempty"`        // Chat channel (e.g., #team)
+	Escalation  string `json:"escalation,omitempty"`  // On-call or escalation URL
+	Description string `json:"description,omitempty"` // Free-form description of owner
+}
+
+// Validate ensures the contact details in an OwnerContact are formatted correctly
+func (c *OwnerContact) Validate() error {
+	if c.Email != "" && (!strings.Contains(c.Email, "@") ||
+		strings.ContainsAny(c.Email, " \t")) {
+		return errors.New("owner contact email is not valid")
+	}
+	if c.Escalation != "" {
+		u, err := url.Parse(c.Escalation)
+		if err != nil || !u.IsAbs() {
+			return errors.New("owner escalation must be an absolute url")
+		}
+	}
+	return nil
+}
+
+// Validate ensures an Owner is formatted correctly for an owner update
+func (o *Owner) Validate() error {
+	if o.Operator == "" || o.Team == "" {
+		return errors.New("owner must have an operator and team")
+	}
+	return o.OwnerContact.Validate()
+}
+
+// OwnerMapEntry describes ownership details for a single asset in an owner map
+type OwnerMapEntry struct {
+	AssetID       int       `json:"asset_id"`                 // Asset ID
+	Name          string    `json:"asset_identifier"`         // Asset name
+	Type          string    `json:"asset_type"`               // Asset type
+	Zone          string    `json:"zone"`                     // Asset zone
+	Operator      string    `json:"operator"`                 // Owner operator, or unset
+	Team          string    `json:"team"`                     // Owner team, or unset
+	TriageKey     string    `json:"triagekey"`                // Triage key
+	AssetGroupID  int       `json:"asset_group_id,omitempty"` // Group ID asset is in
+	AssetGroup    string    `json:"asset_group,omitempty"`    // Name of group asset is in
+	LastIndicator time.Time `json:"last_indicator,omitempty"` // Time last indicator was received
 }
@@ -185,17 +185,7 @@ type Risk struct {
 	// devaluing high impact attributes when we consider the entire set combined.
 	UsedRRAAttrib RRAAttribute
 
-	Risk struct {
-		WorstCase      float64 `json:"worst_case"`
-		WorstCaseLabel string  `json:"worst_case_label"`
-		Median         float64 `json:"median"`
-		MedianLabel    string  `json:"median_label"`
-		Average        float64 `json:"average"`
-		AverageLabel   string  `json:"average_label"`
-		DataClass      float64 `json:"data_classification"`
-		Impact         float64 `json:"highest_business_impact"`
-		ImpactLabel    string  `json:"highest_business_impact_label"`
-	} `json:"risk"`
+	Risk RiskValues `json:"risk"`
 
 	Scenarios []RiskScenario `json:"scenarios"` // Risk scenarios
 }
@@ -209,14 +199,69 @@ func (r *Risk) Validate() error {
 	return nil
 }
 
+// RiskValues contains the final calculated risk values for a service
+type RiskValues struct {
+	WorstCase      float64 `json:"worst_case"`
+	WorstCaseLabel string  `json:"worst_case_label"`
+	Median         float64 `json:"median"`
+	MedianLabel    string  `json:"median_label"`
+	Average        float64 `json:"average"`
+	AverageLabel   string  `json:"average_label"`
+	DataClass      float64 `json:"data_classification"`
+	Impact         float64 `json:"highest_business_impact"`
+	ImpactLabel    string  `json:"highest_business_impact_label"`
+}
+
+// AssetRisk is the risk representation for a single asset. The business impact is taken from
+// the RRA that has the highest impact of all services the asset supports, and is combined
+// with indicators for the asset itself to generate scenarios.
+//
+// The embedded Risk describes the RRA that was selected; if the asset does not support any
+// services, or none of the RRAs for the services it supports have usable impact and
+// probability values, the RRA will be the zero value and the risk labels will be unknown.
+type AssetRisk struct {
+	Asset    Asset              `json:"asset"`    // The asset we are describing
+	Services []AssetRiskService `json:"services"` // Services the asset supports
+	Risk
+}
+
+// AssetRiskService describes a service an asset supports, and the highest business impact
+// for the service as determined from the RRA
+type AssetRiskService struct {
+	RRAID       int     `json:"rra_id"`
+	Name        string  `json:"name"`
+	Attribute   string  `json:"attribute,omitempty"`
+	Impact      float64 `json:"impact"`
+	ImpactLabel string  `json:"impact_label,omitempty"`
+}
+
+// Validate checks various values in AssetRisk type r to ensure they are correctly formatted
+func (r *AssetRisk) Validate() error {
+	if r.Asset.Name == "" {
+		return fmt.Errorf("asset risk must reference an asset")
+	}
+	// If no RRA was selected the risk is unknown, and there is nothing else to validate
+	if r.RRA.Name == "" {
+		return nil
+	}
+	return r.Risk.Validate()
+}
+
 // RiskScenario stores information used to support probability for risk calculation; this
 // generally would be created using control information and is combined with the
 // RRA impact scores to produce estimated service risk
+//
+// For scenarios derived from indicators, Likelihood contains the likelihood label from the
+// indicator the scenario is based on. If the probability has been decayed to account for the
+// age of the indicator, DecayFactor will contain the factor that was applied to the probability
+// associated with the label.
 type RiskScenario struct {
-	Name        string  `json:"name"`        // Name describing the datapoint
-	Probability float64 `json:"probability"` // Probability
-	Impact      float64 `json:"impact"`      // Impact
-	Score       float64 `json:"score"`       // Calculated score
+	Name        string  `json:"name"`                   // Name describing the datapoint
+	Probability float64 `json:"probability"`            // Probability
+	Impact      float64 `json:"impact"`                 // Impact
+	Score       float64 `json:"score"`                  // Calculated score
+	Likelihood  string  `json:"likelihood,omitempty"`   // Likelihood label from indicator
+	DecayFactor float64 `json:"decay_factor,omitempty"` // Age based decay applied to probability
 }
 
 // Validate checks a RiskScenario for consistency